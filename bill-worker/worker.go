@@ -28,7 +28,7 @@ func generateMonthConsumptionQueryString(deviceID string, startMonth string, end
 	fluxQuery := fmt.Sprintf(`
   from(bucket: "power_measurements")
     |> range(start: %s, stop: %s)
-    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r.device_id == "%s")
+    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r["_field"] == "value" and r.device_id == "%s")
     |> sum(column: "_value")
     `, startMonth, endMonth, deviceID)
 
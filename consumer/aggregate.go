@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// cityAggregateMeasurement holds the consumption of every city per
+	// window, tagged with the window size and stamped with the window start
+	cityAggregateMeasurement = "city_consumption"
+	// dirtyWindowsKeyPrefix starts the sorted set of window starts (unix
+	// seconds) that got new readings, scored by when that last happened
+	dirtyWindowsKeyPrefix = "aggregate:dirty:"
+	// maxWindowsPerPass bounds the work of one pass per window size, the
+	// rest stays dirty for the next one
+	maxWindowsPerPass = 288
+	// aggregateBackfillStep is the range the aggregate subcommand computes
+	// per query
+	aggregateBackfillStep = 24 * time.Hour
+)
+
+// AggregateWindow is a window size city consumption is rolled up into.
+type AggregateWindow struct {
+	Name string
+	Size time.Duration
+}
+
+var aggregateWindows = []AggregateWindow{
+	{Name: "5m", Size: 5 * time.Minute},
+	{Name: "1h", Size: time.Hour},
+	{Name: "1d", Size: 24 * time.Hour},
+}
+
+// CityAggregate is the consumption of a city within one window.
+type CityAggregate struct {
+	City   string
+	Window string
+	Start  time.Time
+	Value  float64
+}
+
+// clearDirtyScript removes the window starts ARGV[2..] that were not marked
+// dirty again after ARGV[1], readings arriving during a pass keep theirs.
+var clearDirtyScript = redis.NewScript(`
+local cleared = 0
+for i = 2, #ARGV do
+	local score = redis.call("ZSCORE", KEYS[1], ARGV[i])
+	if score and tonumber(score) <= tonumber(ARGV[1]) then
+		redis.call("ZREM", KEYS[1], ARGV[i])
+		cleared = cleared + 1
+	end
+end
+return cleared
+`)
+
+// CityAggregator rolls up city consumption into 5m, 1h and 1d windows. The
+// consumer only marks the windows its readings fell into, a pass recomputes
+// those windows from the stored readings and overwrites their points. Passes
+// can therefore be repeated, interrupted or run by several replicas without
+// counting anything twice, unlike a counter that is reset after sending.
+type CityAggregator struct {
+	redisClient *redis.Client
+	queryAPI    api.QueryAPI
+	writeAPI    api.WriteAPIBlocking
+}
+
+func NewCityAggregator(redisClient *redis.Client, influxClient influxdb2.Client) *CityAggregator {
+	return &CityAggregator{
+		redisClient: redisClient,
+		queryAPI:    influxClient.QueryAPI(influxOrg),
+		writeAPI:    influxClient.WriteAPIBlocking(influxOrg, measurementsBucket),
+	}
+}
+
+// MarkDirty records the windows of stored readings for the next pass.
+func (a *CityAggregator) MarkDirty(ctx context.Context, readings []Measurement) error {
+	now := float64(time.Now().UnixMilli())
+	pipe := a.redisClient.Pipeline()
+	for _, window := range aggregateWindows {
+		members := make([]redis.Z, 0, len(readings))
+		for _, reading := range readings {
+			start := reading.Timestamp.Truncate(window.Size).Unix()
+			members = append(members, redis.Z{Score: now, Member: strconv.FormatInt(start, 10)})
+		}
+		pipe.ZAdd(ctx, dirtyWindowsKeyPrefix+window.Name, members...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to mark aggregate windows: %v", err)
+	}
+	return nil
+}
+
+// Run recomputes the dirty windows of every size and returns the 5m
+// aggregates it wrote, oldest first.
+func (a *CityAggregator) Run(ctx context.Context, now time.Time) ([]CityAggregate, error) {
+	var updated []CityAggregate
+	for _, window := range aggregateWindows {
+		aggregates, err := a.runWindow(ctx, window, now)
+		if err != nil {
+			return updated, err
+		}
+		if window.Name == aggregateWindows[0].Name {
+			updated = aggregates
+		}
+	}
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].Start.Before(updated[j].Start)
+	})
+	return updated, nil
+}
+
+// latestClosed keeps the newest aggregate of every city whose window ended
+// by now. The open window and recomputed older ones are left to the history
+// queries, a dashboard only follows the last closed window.
+func latestClosed(aggregates []CityAggregate, size time.Duration, now time.Time) []CityAggregate {
+	latest := make(map[string]int)
+	var closed []CityAggregate
+	for _, aggregate := range aggregates {
+		if aggregate.Start.Add(size).After(now) {
+			continue
+		}
+		if i, ok := latest[aggregate.City]; ok {
+			if aggregate.Start.After(closed[i].Start) {
+				closed[i] = aggregate
+			}
+			continue
+		}
+		latest[aggregate.City] = len(closed)
+		closed = append(closed, aggregate)
+	}
+	return closed
+}
+
+func (a *CityAggregator) runWindow(ctx context.Context, window AggregateWindow, now time.Time) ([]CityAggregate, error) {
+	key := dirtyWindowsKeyPrefix + window.Name
+	passStart := now.UnixMilli()
+	members, err := a.redisClient.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(passStart, 10),
+		Count: maxWindowsPerPass,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dirty %s windows: %v", window.Name, err)
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	starts := make([]time.Time, 0, len(members))
+	for _, member := range members {
+		seconds, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			log.Printf("Skipping malformed %s window %q", window.Name, member)
+			continue
+		}
+		starts = append(starts, time.Unix(seconds, 0))
+	}
+
+	var aggregates []CityAggregate
+	for _, span := range windowSpans(starts, window.Size) {
+		spanAggregates, err := a.Compute(ctx, window, span[0], span[1])
+		if err != nil {
+			return aggregates, err
+		}
+		aggregates = append(aggregates, spanAggregates...)
+	}
+
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, passStart)
+	for _, member := range members {
+		args = append(args, member)
+	}
+	if err := clearDirtyScript.Run(ctx, a.redisClient, []string{key}, args...).Err(); err != nil {
+		return aggregates, fmt.Errorf("failed to clear dirty %s windows: %v", window.Name, err)
+	}
+	return aggregates, nil
+}
+
+// windowSpans merges sorted adjacent window starts into [start, stop)
+// ranges, so neighbouring windows are computed by one query.
+func windowSpans(starts []time.Time, size time.Duration) [][2]time.Time {
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+	var spans [][2]time.Time
+	for _, start := range starts {
+		if len(spans) > 0 && !start.After(spans[len(spans)-1][1]) {
+			spans[len(spans)-1][1] = start.Add(size)
+			continue
+		}
+		spans = append(spans, [2]time.Time{start, start.Add(size)})
+	}
+	return spans
+}
+
+// Compute sums the readings of every city per window between start and stop
+// and writes the sums to the city_consumption measurement.
+func (a *CityAggregator) Compute(ctx context.Context, window AggregateWindow, start time.Time, stop time.Time) ([]CityAggregate, error) {
+	query := fmt.Sprintf(`
+  from(bucket: "%s")
+    |> range(start: %s, stop: %s)
+    |> filter(fn: (r) => r._measurement == "power_consumption" and r._field == "value")
+    |> group(columns: ["city"])
+    |> aggregateWindow(every: %s, fn: sum, timeSrc: "_start", createEmpty: false)
+    `, measurementsBucket, start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339), window.Name)
+
+	result, err := a.queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s city consumption: %v", window.Name, err)
+	}
+	defer result.Close()
+
+	var aggregates []CityAggregate
+	var points []*write.Point
+	for result.Next() {
+		record := result.Record()
+		city, _ := record.ValueByKey("city").(string)
+		value, ok := record.Value().(float64)
+		if !ok {
+			continue
+		}
+		aggregate := CityAggregate{City: city, Window: window.Name, Start: record.Time(), Value: value}
+		aggregates = append(aggregates, aggregate)
+		points = append(points, influxdb2.NewPoint(
+			cityAggregateMeasurement,
+			map[string]string{
+				"city":   city,
+				"window": window.Name,
+			},
+			map[string]interface{}{
+				"value": value,
+			},
+			aggregate.Start,
+		))
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("failed to read %s city consumption: %v", window.Name, result.Err())
+	}
+	if len(points) == 0 {
+		return nil, nil
+	}
+	if err := a.writeAPI.WritePoint(ctx, points...); err != nil {
+		return nil, fmt.Errorf("failed to write %s city aggregates: %v", window.Name, err)
+	}
+	return aggregates, nil
+}
+
+// runAggregate implements the aggregate subcommand, which recomputes the
+// city aggregates of readings stored before the aggregator ran:
+//
+//	measurement-consumer aggregate -from 2024-01-01T00:00:00Z [-to time] [-window 1h]
+func runAggregate(args []string) {
+	flags := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	from := flags.String("from", "", "first reading to include, RFC3339")
+	to := flags.String("to", "", "end of the range, RFC3339, default now")
+	only := flags.String("window", "", "recompute only this window size, default all")
+	flags.Parse(args)
+
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("invalid -from: %v", err)
+	}
+	stop := time.Now()
+	if *to != "" {
+		stop, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("invalid -to: %v", err)
+		}
+	}
+
+	influxClient := influxdb2.NewClient(os.Getenv("INFLUX_URI"), os.Getenv("INFLUX_TOKEN"))
+	defer influxClient.Close()
+	aggregator := NewCityAggregator(nil, influxClient)
+
+	ctx := context.Background()
+	for _, window := range aggregateWindows {
+		if *only != "" && window.Name != *only {
+			continue
+		}
+		total := 0
+		for day := start.Truncate(aggregateBackfillStep); day.Before(stop); day = day.Add(aggregateBackfillStep) {
+			aggregates, err := aggregator.Compute(ctx, window, day, day.Add(aggregateBackfillStep))
+			if err != nil {
+				log.Fatal(err)
+			}
+			total += len(aggregates)
+		}
+		log.Printf("Recomputed %d %s city aggregates", total, window.Name)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWindowSpans(t *testing.T) {
+	base := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name   string
+		starts []time.Time
+		spans  [][2]time.Time
+	}{
+		{"single", []time.Time{at(0)}, [][2]time.Time{{at(0), at(5)}}},
+		{"adjacent", []time.Time{at(0), at(5), at(10)}, [][2]time.Time{{at(0), at(15)}}},
+		{"overlapping", []time.Time{at(0), at(2), at(2)}, [][2]time.Time{{at(0), at(7)}}},
+		{"disjoint", []time.Time{at(0), at(15)}, [][2]time.Time{{at(0), at(5)}, {at(15), at(20)}}},
+		{"unsorted", []time.Time{at(20), at(0), at(5), at(30)}, [][2]time.Time{{at(0), at(10)}, {at(20), at(25)}, {at(30), at(35)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spans := windowSpans(test.starts, 5*time.Minute)
+			if !slices.Equal(spans, test.spans) {
+				t.Errorf("got %v, want %v", spans, test.spans)
+			}
+		})
+	}
+}
+
+func TestLatestClosed(t *testing.T) {
+	base := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	aggregate := func(city string, minutes int, value float64) CityAggregate {
+		return CityAggregate{City: city, Window: "5m", Start: base.Add(time.Duration(minutes) * time.Minute), Value: value}
+	}
+	// The window starting at 10 is still open at 12:12
+	now := base.Add(12 * time.Minute)
+
+	tests := []struct {
+		name       string
+		aggregates []CityAggregate
+		closed     []CityAggregate
+	}{
+		{"open window", []CityAggregate{aggregate("Novi Sad", 5, 1), aggregate("Novi Sad", 10, 2)}, []CityAggregate{aggregate("Novi Sad", 5, 1)}},
+		{"only open window", []CityAggregate{aggregate("Novi Sad", 10, 2)}, nil},
+		{"several cities", []CityAggregate{aggregate("Novi Sad", 0, 1), aggregate("Beograd", 5, 3), aggregate("Novi Sad", 5, 2)},
+			[]CityAggregate{aggregate("Novi Sad", 5, 2), aggregate("Beograd", 5, 3)}},
+		{"out of order", []CityAggregate{aggregate("Novi Sad", 5, 2), aggregate("Novi Sad", 0, 1), aggregate("Novi Sad", -5, 4)},
+			[]CityAggregate{aggregate("Novi Sad", 5, 2)}},
+		{"window ending now", []CityAggregate{aggregate("Novi Sad", 7, 5)}, []CityAggregate{aggregate("Novi Sad", 7, 5)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			closed := latestClosed(test.aggregates, 5*time.Minute, now)
+			if !slices.Equal(closed, test.closed) {
+				t.Errorf("got %v, want %v", closed, test.closed)
+			}
+		})
+	}
+}
+
+func TestClearDirtyKeepsWindowsMarkedDuringPass(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	aggregator := &CityAggregator{redisClient: client}
+	base := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	reading := func(minutes int) Measurement {
+		return Measurement{DeviceID: "device-1", Value: 1, Timestamp: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	if err := aggregator.MarkDirty(ctx, []Measurement{reading(1), reading(6)}); err != nil {
+		t.Fatal(err)
+	}
+	passStart := time.Now().UnixMilli()
+	time.Sleep(5 * time.Millisecond)
+	// A reading stored while the pass computes the window at 12:05
+	if err := aggregator.MarkDirty(ctx, []Measurement{reading(7)}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := dirtyWindowsKeyPrefix + "5m"
+	first := strconv.FormatInt(base.Unix(), 10)
+	second := strconv.FormatInt(base.Add(5*time.Minute).Unix(), 10)
+	cleared, err := clearDirtyScript.Run(ctx, client, []string{key}, passStart, first, second).Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty, err := client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleared != 1 || fmt.Sprint(dirty) != fmt.Sprintf("[%s]", second) {
+		t.Fatalf("cleared %d leaving %v, want 1 leaving the window at %s", cleared, dirty, second)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// alertsQueue carries the household alerts the server fires, they are pushed
+// to the followers of the household's device.
+const alertsQueue = "alerts_queue"
+
+// alertNotification is the part of a fired alert the consumer routes by, the
+// rest of the message is forwarded as is.
+type alertNotification struct {
+	DeviceID string
+}
+
+func (c *Consumer) processAlerts(ctx context.Context) {
+	defer c.wg.Done()
+
+	var msgs <-chan amqp.Delivery
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msgs = <-c.alertFeed:
+		case msg, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			// The server already mailed the owner, a lost push is not retried
+			c.ack(msg)
+			c.stats.Alerts.Add(1)
+			var alert alertNotification
+			if err := json.Unmarshal(msg.Body, &alert); err != nil || alert.DeviceID == "" {
+				log.Printf("Dropping malformed alert: %v", err)
+				continue
+			}
+			c.broadcast(alert.DeviceID, msg.Body, connTypeAlert)
+		}
+	}
+}
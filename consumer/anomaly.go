@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// baselineKeyPrefix starts the hash of a device's baseline, with a mean,
+	// variance and sample count per hour of the week
+	baselineKeyPrefix = "anomaly:baseline:"
+	// zeroStreakKey maps devices reporting nothing but zeros to the time of
+	// the first zero reading, or zeroFlagged once the streak was reported
+	zeroStreakKey = "anomaly:zero"
+	zeroFlagged   = "flagged"
+	// baselineTTL drops the baseline of devices that stopped reporting
+	baselineTTL = 5 * 7 * 24 * time.Hour
+	// allAnomalies is the WebSocket target of admins following every device
+	allAnomalies = "all"
+
+	defaultAnomalyAlpha      = 0.1
+	defaultAnomalyThreshold  = 4.0
+	defaultAnomalyMinSamples = 20
+	defaultAnomalyZeroAfter  = 6 * time.Hour
+)
+
+// Anomaly kinds.
+const (
+	AnomalySpike    = "spike"
+	AnomalyZero     = "zero"
+	AnomalyNegative = "negative"
+	AnomalyRollback = "rollback"
+)
+
+// AnomalyConfig tunes the baselines. Alpha weighs a new reading in the
+// moving mean and variance, a reading is a spike once it is Threshold
+// standard deviations above the mean of its hour of the week, which takes
+// MinSamples readings of that hour to learn. Zero readings are flagged after
+// ZeroAfter without anything else.
+type AnomalyConfig struct {
+	Alpha      float64
+	Threshold  float64
+	MinSamples int
+	ZeroAfter  time.Duration
+}
+
+// anomalyConfigFromEnv reads ANOMALY_ALPHA, ANOMALY_THRESHOLD,
+// ANOMALY_MIN_SAMPLES and ANOMALY_ZERO_AFTER.
+func anomalyConfigFromEnv() (AnomalyConfig, error) {
+	config := AnomalyConfig{
+		Alpha:      defaultAnomalyAlpha,
+		Threshold:  defaultAnomalyThreshold,
+		MinSamples: envInt("ANOMALY_MIN_SAMPLES", defaultAnomalyMinSamples),
+		ZeroAfter:  defaultAnomalyZeroAfter,
+	}
+	if value := os.Getenv("ANOMALY_ALPHA"); value != "" {
+		alpha, err := strconv.ParseFloat(value, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return config, fmt.Errorf("invalid ANOMALY_ALPHA %q, must be in (0, 1]", value)
+		}
+		config.Alpha = alpha
+	}
+	if value := os.Getenv("ANOMALY_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 {
+			return config, fmt.Errorf("invalid ANOMALY_THRESHOLD %q", value)
+		}
+		config.Threshold = threshold
+	}
+	if value := os.Getenv("ANOMALY_ZERO_AFTER"); value != "" {
+		zeroAfter, err := time.ParseDuration(value)
+		if err != nil || zeroAfter <= 0 {
+			return config, fmt.Errorf("invalid ANOMALY_ZERO_AFTER %q", value)
+		}
+		config.ZeroAfter = zeroAfter
+	}
+	return config, nil
+}
+
+// Anomaly is an implausible reading. Value and Expected are average power
+// over the reading's interval in kW, so readings of any interval compare.
+type Anomaly struct {
+	DeviceId  string
+	City      string
+	Kind      string
+	Value     float64
+	Expected  float64
+	Score     float64
+	Timestamp time.Time
+}
+
+// AnomalyStats counts the anomalies found since the consumer started.
+type AnomalyStats struct {
+	Spikes    atomic.Int64
+	Zeros     atomic.Int64
+	Negatives atomic.Int64
+	Rollbacks atomic.Int64
+}
+
+// hourBaseline is the moving mean and variance of a device's average power
+// in one hour of the week, learned from N readings.
+type hourBaseline struct {
+	Mean float64
+	Var  float64
+	N    int
+}
+
+// judge scores a rate against the baseline and returns the baseline with the
+// rate added. The score is the distance from the mean in standard
+// deviations, it stays zero until the baseline has MinSamples readings.
+func (config AnomalyConfig) judge(baseline hourBaseline, rate float64) (bool, float64, float64, hourBaseline) {
+	if baseline.N == 0 {
+		return false, 0, 0, hourBaseline{Mean: rate, N: 1}
+	}
+
+	spike := false
+	score, expected := 0.0, 0.0
+	if baseline.N >= config.MinSamples {
+		// A flat baseline would make any change a spike
+		std := max(math.Sqrt(baseline.Var), 0.1*math.Abs(baseline.Mean), 0.001)
+		score = (rate - baseline.Mean) / std
+		expected = baseline.Mean
+		spike = score >= config.Threshold
+	}
+	diff := rate - baseline.Mean
+	incr := config.Alpha * diff
+	next := hourBaseline{
+		Mean: baseline.Mean + incr,
+		Var:  (1 - config.Alpha) * (baseline.Var + diff*incr),
+		N:    baseline.N + 1,
+	}
+	return spike, score, expected, next
+}
+
+// zeroStreak follows the run of zero readings of a device. since is the
+// stored start of the run in unix ms, "flagged" once it was reported, or
+// empty without a run. It returns what to store, empty to clear it, and
+// whether the run is to be reported now.
+func (config AnomalyConfig) zeroStreak(since string, rate float64, at time.Time) (string, bool) {
+	if rate != 0 {
+		return "", false
+	}
+	if since == "" {
+		return strconv.FormatInt(at.UnixMilli(), 10), false
+	}
+	if since == zeroFlagged {
+		return since, false
+	}
+	started, err := strconv.ParseInt(since, 10, 64)
+	if err != nil {
+		return strconv.FormatInt(at.UnixMilli(), 10), false
+	}
+	if at.Sub(time.UnixMilli(started)) >= config.ZeroAfter {
+		return zeroFlagged, true
+	}
+	return since, false
+}
+
+// AnomalyDetector learns a baseline per device and hour of the week from the
+// stored readings and flags spikes, long runs of zero readings (a dead or
+// tampered meter) and negative readings. Every device is handled by a single
+// consumer, the one owning its shard, and there by a single follow-up
+// worker, so its baseline is read and written back without a lock.
+type AnomalyDetector struct {
+	redisClient *redis.Client
+	writeAPI    api.WriteAPI
+	config      AnomalyConfig
+	stats       AnomalyStats
+}
+
+func NewAnomalyDetector(redisClient *redis.Client, writeAPI api.WriteAPI, config AnomalyConfig) *AnomalyDetector {
+	go func() {
+		for err := range writeAPI.Errors() {
+			log.Printf("Failed to record anomaly: %v", err)
+		}
+	}()
+	return &AnomalyDetector{
+		redisClient: redisClient,
+		writeAPI:    writeAPI,
+		config:      config,
+	}
+}
+
+// hourOfWeek numbers the hours from Monday 00:00 UTC.
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return (int(t.Weekday())+6)%7*24 + t.Hour()
+}
+
+// Check judges a reading and adds it to the baseline. Negative readings are
+// flagged without touching the baseline.
+func (d *AnomalyDetector) Check(ctx context.Context, reading *Measurement) ([]Anomaly, error) {
+	rate := reading.Value / reading.interval().Hours()
+	anomaly := func(kind string, expected float64, score float64) Anomaly {
+		return Anomaly{
+			DeviceId:  reading.DeviceID,
+			City:      reading.Address.City,
+			Kind:      kind,
+			Value:     rate,
+			Expected:  expected,
+			Score:     score,
+			Timestamp: reading.Timestamp,
+		}
+	}
+	if rate < 0 {
+		d.stats.Negatives.Add(1)
+		return []Anomaly{anomaly(AnomalyNegative, 0, 0)}, nil
+	}
+
+	baselineKey := baselineKeyPrefix + reading.DeviceID
+	hour := strconv.Itoa(hourOfWeek(reading.Timestamp))
+	fields := []string{hour + ":mean", hour + ":var", hour + ":n"}
+
+	pipe := d.redisClient.Pipeline()
+	stored := pipe.HMGet(ctx, baselineKey, fields...)
+	streak := pipe.HGet(ctx, zeroStreakKey, reading.DeviceID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to load baseline of %s: %v", reading.DeviceID, err)
+	}
+	baseline, err := parseBaseline(stored.Val())
+	if err != nil {
+		log.Printf("Resetting baseline of %s: %v", reading.DeviceID, err)
+		baseline = hourBaseline{}
+	}
+
+	spike, score, expected, next := d.config.judge(baseline, rate)
+	since, flagZero := d.config.zeroStreak(streak.Val(), rate, reading.Timestamp)
+
+	pipe = d.redisClient.Pipeline()
+	pipe.HSet(ctx, baselineKey,
+		fields[0], strconv.FormatFloat(next.Mean, 'g', -1, 64),
+		fields[1], strconv.FormatFloat(next.Var, 'g', -1, 64),
+		fields[2], next.N)
+	pipe.Expire(ctx, baselineKey, baselineTTL)
+	if since == "" {
+		pipe.HDel(ctx, zeroStreakKey, reading.DeviceID)
+	} else if since != streak.Val() {
+		pipe.HSet(ctx, zeroStreakKey, reading.DeviceID, since)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to save baseline of %s: %v", reading.DeviceID, err)
+	}
+
+	var anomalies []Anomaly
+	if spike {
+		d.stats.Spikes.Add(1)
+		anomalies = append(anomalies, anomaly(AnomalySpike, expected, score))
+	}
+	if flagZero {
+		d.stats.Zeros.Add(1)
+		anomalies = append(anomalies, anomaly(AnomalyZero, 0, 0))
+	}
+	return anomalies, nil
+}
+
+// parseBaseline reads the mean, variance and count fields of an hour, all
+// missing for an hour without readings.
+func parseBaseline(values []interface{}) (hourBaseline, error) {
+	if len(values) != 3 || values[2] == nil {
+		return hourBaseline{}, nil
+	}
+	var baseline hourBaseline
+	var err error
+	if baseline.Mean, err = strconv.ParseFloat(fmt.Sprint(values[0]), 64); err != nil {
+		return hourBaseline{}, fmt.Errorf("invalid mean: %v", err)
+	}
+	if baseline.Var, err = strconv.ParseFloat(fmt.Sprint(values[1]), 64); err != nil {
+		return hourBaseline{}, fmt.Errorf("invalid variance: %v", err)
+	}
+	if baseline.N, err = strconv.Atoi(fmt.Sprint(values[2])); err != nil {
+		return hourBaseline{}, fmt.Errorf("invalid sample count: %v", err)
+	}
+	return baseline, nil
+}
+
+// Record queues an anomaly for the anomaly measurement, it is written in the
+// background.
+func (d *AnomalyDetector) Record(anomaly Anomaly) {
+	point := influxdb2.NewPoint(
+		"anomaly",
+		map[string]string{
+			"device_id": anomaly.DeviceId,
+			"city":      anomaly.City,
+			"kind":      anomaly.Kind,
+		},
+		map[string]interface{}{
+			"value":    anomaly.Value,
+			"expected": anomaly.Expected,
+			"score":    anomaly.Score,
+		},
+		anomaly.Timestamp,
+	)
+	d.writeAPI.WritePoint(point)
+}
+
+// Rollback flags a reading whose registers went back, it is not judged
+// against the baseline since it carries no consumption.
+func (d *AnomalyDetector) Rollback(reading *Measurement) Anomaly {
+	d.stats.Rollbacks.Add(1)
+	return Anomaly{
+		DeviceId:  reading.DeviceID,
+		City:      reading.Address.City,
+		Kind:      AnomalyRollback,
+		Timestamp: reading.Timestamp,
+	}
+}
+
+func (d *AnomalyDetector) Stats() *AnomalyStats {
+	return &d.stats
+}
+
+// checkAnomalies runs the stored readings of a delivery through the
+// detector, readings the consumer estimated are not judged.
+func (c *Consumer) checkAnomalies(ctx context.Context, readings []Measurement) {
+	for i := range readings {
+		if readings[i].Estimated {
+			continue
+		}
+		if readings[i].RegisterRollback {
+			c.reportAnomaly(ctx, c.anomalies.Rollback(&readings[i]))
+			continue
+		}
+		anomalies, err := c.anomalies.Check(ctx, &readings[i])
+		if err != nil {
+			log.Printf("Failed to check for anomalies: %v", err)
+			continue
+		}
+		for _, anomaly := range anomalies {
+			c.reportAnomaly(ctx, anomaly)
+		}
+	}
+}
+
+// reportAnomaly stores an anomaly and pushes it to the device's followers
+// and to admins following all devices.
+func (c *Consumer) reportAnomaly(ctx context.Context, anomaly Anomaly) {
+	log.Printf("Device %s reported a %s reading: %f kW, expected %f kW", anomaly.DeviceId, anomaly.Kind, anomaly.Value, anomaly.Expected)
+	c.anomalies.Record(anomaly)
+	msg, err := json.Marshal(anomaly)
+	if err != nil {
+		log.Printf("Failed marshalling anomaly to json: %v", err)
+		return
+	}
+	c.broadcast(anomaly.DeviceId, msg, connTypeAnomaly)
+	c.broadcast(allAnomalies, msg, connTypeAnomaly)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testAnomalyConfig = AnomalyConfig{
+	Alpha:      0.1,
+	Threshold:  4,
+	MinSamples: 20,
+	ZeroAfter:  6 * time.Hour,
+}
+
+func TestJudgeScoresSpikes(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseline hourBaseline
+		rate     float64
+		spike    bool
+		score    float64
+	}{
+		{"above threshold", hourBaseline{Mean: 1, Var: 0.04, N: 30}, 2, true, 5},
+		{"at threshold", hourBaseline{Mean: 1, Var: 0.04, N: 30}, 1.8, true, 4},
+		{"below threshold", hourBaseline{Mean: 1, Var: 0.04, N: 30}, 1.5, false, 2.5},
+		{"below mean", hourBaseline{Mean: 1, Var: 0.04, N: 30}, 0.5, false, -2.5},
+		// The deviation is floored at a tenth of the mean
+		{"flat baseline", hourBaseline{Mean: 1, Var: 0, N: 30}, 1.3, false, 3},
+		{"flat baseline spike", hourBaseline{Mean: 1, Var: 0, N: 30}, 1.5, true, 5},
+		// And at 0.001 for a baseline of zeros
+		{"zero baseline", hourBaseline{Mean: 0, Var: 0, N: 30}, 0.01, true, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spike, score, expected, _ := testAnomalyConfig.judge(test.baseline, test.rate)
+			if spike != test.spike {
+				t.Errorf("spike = %v, want %v", spike, test.spike)
+			}
+			if math.Abs(score-test.score) > 1e-9 {
+				t.Errorf("score = %f, want %f", score, test.score)
+			}
+			if expected != test.baseline.Mean {
+				t.Errorf("expected = %f, want the mean %f", expected, test.baseline.Mean)
+			}
+		})
+	}
+}
+
+func TestJudgeWaitsForMinSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+		scored  bool
+	}{
+		{"empty", 0, false},
+		{"one short", 19, false},
+		{"enough", 20, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseline := hourBaseline{Mean: 1, Var: 0.04, N: test.samples}
+			spike, score, _, next := testAnomalyConfig.judge(baseline, 100)
+			if spike != test.scored || (score != 0) != test.scored {
+				t.Errorf("spike = %v, score = %f, want scored %v", spike, score, test.scored)
+			}
+			if next.N != test.samples+1 {
+				t.Errorf("samples = %d, want %d", next.N, test.samples+1)
+			}
+		})
+	}
+}
+
+func TestJudgeUpdatesBaseline(t *testing.T) {
+	_, _, _, first := testAnomalyConfig.judge(hourBaseline{}, 2)
+	if first != (hourBaseline{Mean: 2, N: 1}) {
+		t.Fatalf("first reading gave %+v, want its own mean", first)
+	}
+
+	_, _, _, next := testAnomalyConfig.judge(hourBaseline{Mean: 1, Var: 0, N: 5}, 2)
+	if math.Abs(next.Mean-1.1) > 1e-9 || math.Abs(next.Var-0.09) > 1e-9 || next.N != 6 {
+		t.Fatalf("baseline = %+v, want mean 1.1, variance 0.09 and 6 samples", next)
+	}
+}
+
+func TestZeroStreak(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	ms := func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) }
+
+	tests := []struct {
+		name    string
+		since   string
+		rate    float64
+		next    string
+		flagged bool
+	}{
+		{"no streak, reading", "", 1.5, "", false},
+		{"first zero", "", 0, ms(now), false},
+		{"short streak", ms(now.Add(-5 * time.Hour)), 0, ms(now.Add(-5 * time.Hour)), false},
+		{"long streak", ms(now.Add(-6 * time.Hour)), 0, zeroFlagged, true},
+		{"already flagged", zeroFlagged, 0, zeroFlagged, false},
+		{"streak ends", ms(now.Add(-5 * time.Hour)), 0.2, "", false},
+		{"flagged streak ends", zeroFlagged, 0.2, "", false},
+		{"unreadable start", "garbage", 0, ms(now), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next, flagged := testAnomalyConfig.zeroStreak(test.since, test.rate, now)
+			if next != test.next || flagged != test.flagged {
+				t.Errorf("got (%q, %v), want (%q, %v)", next, flagged, test.next, test.flagged)
+			}
+		})
+	}
+}
+
+func TestHourOfWeek(t *testing.T) {
+	belgrade := time.FixedZone("CET", 3600)
+	tests := []struct {
+		at   time.Time
+		hour int
+	}{
+		{time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2024, 3, 4, 13, 59, 0, 0, time.UTC), 13},
+		{time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC), 167},
+		// Monday 00:30 in Belgrade is still Sunday in UTC
+		{time.Date(2024, 3, 11, 0, 30, 0, 0, belgrade), 167},
+	}
+	for _, test := range tests {
+		if hour := hourOfWeek(test.at); hour != test.hour {
+			t.Errorf("hourOfWeek(%v) = %d, want %d", test.at, hour, test.hour)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultMaxPending    = 5000
+	// flushTimeout bounds a single write request to InfluxDB
+	flushTimeout = 30 * time.Second
+)
+
+var errWriterClosed = errors.New("batch writer is closed")
+
+// pointWriter is the part of api.WriteAPIBlocking the batch writer needs.
+type pointWriter interface {
+	WritePoint(ctx context.Context, point ...*write.Point) error
+}
+
+// batchEntry holds the points of one delivery and is told the outcome once
+// they were written or given up on.
+type batchEntry struct {
+	points []*write.Point
+	done   func(attempts int, err error)
+}
+
+// BatchWriterStats counts the work of the batch writer since it started.
+type BatchWriterStats struct {
+	Batches       atomic.Int64
+	Points        atomic.Int64
+	SizeFlushes   atomic.Int64
+	TimerFlushes  atomic.Int64
+	FailedBatches atomic.Int64
+	// WriteErrors counts failed write requests, WriteLatency times all of
+	// them
+	WriteErrors  atomic.Int64
+	WriteLatency LatencyHistogram
+}
+
+// BatchWriter collects points of many deliveries and writes them to InfluxDB
+// in one request when batchSize points are waiting or flushInterval passed.
+// At most maxPending deliveries wait for a flush, Write blocks beyond that,
+// which stops the consumer from taking deliveries and lets unacknowledged
+// messages pile up at the broker up to the prefetch instead.
+type BatchWriter struct {
+	writer        pointWriter
+	batchSize     int
+	flushInterval time.Duration
+	retry         RetryPolicy
+	entries       chan batchEntry
+	finished      chan struct{}
+	stopRetries   chan struct{}
+	closing       atomic.Bool
+	mu            sync.RWMutex
+	closed        bool
+	stats         BatchWriterStats
+}
+
+func NewBatchWriter(writer pointWriter, batchSize int, flushInterval time.Duration, maxPending int, retry RetryPolicy) *BatchWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+	if maxPending < 1 {
+		maxPending = 1
+	}
+	w := &BatchWriter{
+		writer:        writer,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		retry:         retry,
+		entries:       make(chan batchEntry, maxPending),
+		finished:      make(chan struct{}),
+		stopRetries:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// batchWriterFromEnv reads INFLUX_BATCH_SIZE, INFLUX_FLUSH_INTERVAL and
+// INFLUX_MAX_PENDING.
+func batchWriterFromEnv(writer pointWriter, retry RetryPolicy) *BatchWriter {
+	flushInterval := defaultFlushInterval
+	if value := os.Getenv("INFLUX_FLUSH_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid INFLUX_FLUSH_INTERVAL %q, using %s", value, defaultFlushInterval)
+		} else {
+			flushInterval = parsed
+		}
+	}
+	return NewBatchWriter(writer,
+		envInt("INFLUX_BATCH_SIZE", defaultBatchSize),
+		flushInterval,
+		envInt("INFLUX_MAX_PENDING", defaultMaxPending),
+		retry)
+}
+
+// Write queues the points of a delivery, done is called from the writer's
+// goroutine once they are stored or failed. It blocks while the writer is
+// full and returns an error when ctx ends first or the writer is closed.
+func (w *BatchWriter) Write(ctx context.Context, points []*write.Point, done func(attempts int, err error)) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return errWriterClosed
+	}
+	select {
+	case w.entries <- batchEntry{points: points, done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.finished)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	var batch []batchEntry
+	size := 0
+	for {
+		select {
+		case entry, ok := <-w.entries:
+			if !ok {
+				if len(batch) > 0 {
+					w.flush(batch, size)
+				}
+				return
+			}
+			batch = append(batch, entry)
+			size += len(entry.points)
+			if size >= w.batchSize {
+				w.stats.SizeFlushes.Add(1)
+				w.flush(batch, size)
+				batch, size = nil, 0
+				ticker.Reset(w.flushInterval)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.stats.TimerFlushes.Add(1)
+				w.flush(batch, size)
+				batch, size = nil, 0
+			}
+		}
+	}
+}
+
+// flush writes the batch, retrying until it is stored. When InfluxDB
+// rejects it, its entries are written one by one, so a single poison point
+// does not take the whole batch to the dead-letter queue. Any other failure
+// is an outage, the writer keeps retrying and Write blocks meanwhile.
+func (w *BatchWriter) flush(batch []batchEntry, size int) {
+	points := make([]*write.Point, 0, size)
+	for _, entry := range batch {
+		points = append(points, entry.points...)
+	}
+
+	attempts, err := w.writeWithRetry(points)
+	w.stats.Batches.Add(1)
+	if err == nil {
+		w.stats.Points.Add(int64(len(points)))
+		for _, entry := range batch {
+			entry.done(attempts, nil)
+		}
+		return
+	}
+	w.stats.FailedBatches.Add(1)
+	if !rejectedWrite(err) || len(batch) == 1 {
+		for _, entry := range batch {
+			entry.done(attempts, err)
+		}
+		return
+	}
+	log.Printf("InfluxDB rejected a batch of %d points, writing its %d deliveries one by one: %v", len(points), len(batch), err)
+
+	for _, entry := range batch {
+		entryAttempts, err := w.writeWithRetry(entry.points)
+		if err != nil {
+			entry.done(attempts+entryAttempts, err)
+			continue
+		}
+		w.stats.Points.Add(int64(len(entry.points)))
+		entry.done(attempts+entryAttempts, nil)
+	}
+}
+
+// rejectedWrite tells whether InfluxDB refused the points themselves, e.g.
+// for a field type conflict or malformed line protocol, which no retry
+// fixes. Network errors, 5xx, throttling and auth failures are retried.
+func rejectedWrite(err error) bool {
+	var httpErr *influxhttp.Error
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+func (w *BatchWriter) writePoints(points []*write.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	started := time.Now()
+	err := w.writer.WritePoint(ctx, points...)
+	w.stats.WriteLatency.Observe(time.Since(started))
+	if err != nil {
+		w.stats.WriteErrors.Add(1)
+	}
+	return err
+}
+
+// writeWithRetry returns how many attempts it took. It retries until the
+// points are stored or rejected. Once the writer is closing it gives up after
+// the current attempt and reports errWriterClosed, so shutdown requeues the
+// deliveries instead of waiting out the outage.
+func (w *BatchWriter) writeWithRetry(points []*write.Point) (int, error) {
+	attempt := 1
+	for {
+		err := w.writePoints(points)
+		if err == nil {
+			return attempt, nil
+		}
+		if rejectedWrite(err) {
+			return attempt, err
+		}
+		if w.closing.Load() {
+			return attempt, errors.Join(errWriterClosed, err)
+		}
+		delay := w.retry.delay(attempt)
+		log.Printf("Failed to write %d points to InfluxDB (attempt %d), retrying in %s: %v", len(points), attempt, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-w.stopRetries:
+		}
+		attempt++
+	}
+}
+
+// Close flushes every queued delivery and stops the writer.
+func (w *BatchWriter) Close() {
+	if w.closing.CompareAndSwap(false, true) {
+		close(w.stopRetries)
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.entries)
+	}
+	w.mu.Unlock()
+	<-w.finished
+}
+
+func (w *BatchWriter) Stats() *BatchWriterStats {
+	return &w.stats
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// fakeInflux stands in for the InfluxDB write endpoint. Every request costs
+// a fixed round trip, which is what dominates one-point-per-request writes.
+type fakeInflux struct {
+	roundTrip time.Duration
+	requests  atomic.Int64
+	points    atomic.Int64
+	// reject fails every request that contains the point
+	reject *write.Point
+	// outage fails that many requests before InfluxDB is back
+	outage atomic.Int64
+}
+
+func (f *fakeInflux) WritePoint(ctx context.Context, points ...*write.Point) error {
+	f.requests.Add(1)
+	if f.roundTrip > 0 {
+		time.Sleep(f.roundTrip)
+	}
+	if f.outage.Add(-1) >= 0 {
+		return &influxhttp.Error{StatusCode: http.StatusServiceUnavailable, Message: "service unavailable"}
+	}
+	for _, point := range points {
+		if point == f.reject {
+			return &influxhttp.Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: "field type conflict"}
+		}
+	}
+	f.points.Add(int64(len(points)))
+	return nil
+}
+
+func testPoint(i int) *write.Point {
+	return influxdb2.NewPoint(
+		"power_consumption",
+		map[string]string{"device_id": "device", "city": "Novi Sad"},
+		map[string]interface{}{"value": float64(i)},
+		time.Unix(int64(i), 0),
+	)
+}
+
+func TestBatchWriterFlushesOnClose(t *testing.T) {
+	influx := &fakeInflux{}
+	writer := NewBatchWriter(influx, 100, time.Hour, 100, RetryPolicy{})
+
+	var acked atomic.Int64
+	for i := 0; i < 10; i++ {
+		err := writer.Write(context.Background(), []*write.Point{testPoint(i)}, func(attempts int, err error) {
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			acked.Add(1)
+		})
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	writer.Close()
+
+	if acked.Load() != 10 {
+		t.Errorf("got %d completed entries, want 10", acked.Load())
+	}
+	if influx.requests.Load() != 1 {
+		t.Errorf("got %d requests, want a single batch", influx.requests.Load())
+	}
+	if err := writer.Write(context.Background(), nil, nil); !errors.Is(err, errWriterClosed) {
+		t.Errorf("Write after Close returned %v, want %v", err, errWriterClosed)
+	}
+}
+
+func TestBatchWriterIsolatesPoisonEntry(t *testing.T) {
+	poison := testPoint(3)
+	influx := &fakeInflux{reject: poison}
+	writer := NewBatchWriter(influx, 5, time.Hour, 10, RetryPolicy{Backoff: time.Millisecond})
+
+	var mu sync.Mutex
+	failed := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		point := testPoint(i)
+		if i == 3 {
+			point = poison
+		}
+		wg.Add(1)
+		writer.Write(context.Background(), []*write.Point{point}, func(attempts int, err error) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			failed[i] = err != nil
+		})
+	}
+	wg.Wait()
+	writer.Close()
+
+	for i := 0; i < 5; i++ {
+		if failed[i] != (i == 3) {
+			t.Errorf("entry %d failed = %v", i, failed[i])
+		}
+	}
+	if influx.points.Load() != 4 {
+		t.Errorf("got %d stored points, want 4", influx.points.Load())
+	}
+}
+
+func TestBatchWriterWaitsOutOutage(t *testing.T) {
+	influx := &fakeInflux{}
+	influx.outage.Store(5)
+	writer := NewBatchWriter(influx, 5, time.Hour, 10, RetryPolicy{Backoff: time.Millisecond})
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		writer.Write(context.Background(), []*write.Point{testPoint(i)}, func(attempts int, err error) {
+			defer wg.Done()
+			if err != nil {
+				failed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	writer.Close()
+
+	if failed.Load() != 0 {
+		t.Errorf("%d entries failed during an outage, want them retried", failed.Load())
+	}
+	if influx.points.Load() != 5 {
+		t.Errorf("got %d stored points, want 5", influx.points.Load())
+	}
+	// The batch is retried as a whole, not written one by one
+	if got := influx.requests.Load(); got != 6 {
+		t.Errorf("got %d requests, want 6", got)
+	}
+}
+
+// benchmarkRoundTrip is a modest LAN latency to InfluxDB.
+const benchmarkRoundTrip = 200 * time.Microsecond
+
+// BenchmarkBlockingWrites is the path the consumer used before batching, one
+// request per delivery.
+func BenchmarkBlockingWrites(b *testing.B) {
+	influx := &fakeInflux{roundTrip: benchmarkRoundTrip}
+	ctx := context.Background()
+	points := make([]*write.Point, b.N)
+	for i := range points {
+		points[i] = testPoint(i)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := influx.WritePoint(ctx, points[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "points/s")
+	b.ReportMetric(float64(influx.requests.Load()), "requests")
+}
+
+func BenchmarkBatchWriter(b *testing.B) {
+	influx := &fakeInflux{roundTrip: benchmarkRoundTrip}
+	writer := NewBatchWriter(influx, defaultBatchSize, 10*time.Millisecond, defaultMaxPending, RetryPolicy{})
+	ctx := context.Background()
+	points := make([]*write.Point, b.N)
+	for i := range points {
+		points[i] = testPoint(i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	done := func(attempts int, err error) {
+		if err != nil {
+			b.Error(err)
+		}
+		wg.Done()
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := writer.Write(ctx, points[i:i+1], done); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writer.Close()
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "points/s")
+	b.ReportMetric(float64(influx.requests.Load()), "requests")
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultReconnectBackoff    = time.Second
+	defaultMaxReconnectBackoff = time.Minute
+)
+
+var errBrokerDown = errors.New("not connected to RabbitMQ")
+
+// ConnState is a state of the broker connection supervisor. It starts
+// connecting, is ready once the connection, its channel and the consumers
+// are set up, and backs off after a failed attempt. A lost connection goes
+// straight back to connecting. Stopped is final.
+type ConnState string
+
+const (
+	ConnConnecting ConnState = "connecting"
+	ConnReady      ConnState = "ready"
+	ConnBackoff    ConnState = "backoff"
+	ConnStopped    ConnState = "stopped"
+)
+
+// brokerSession is one connection to the broker together with the channel
+// the consumer works on.
+type brokerSession interface {
+	// Closed delivers why the connection or its channel went away, or is
+	// closed without a reason when it was closed on purpose
+	Closed() <-chan error
+	Close() error
+}
+
+// amqpSession is a brokerSession on a RabbitMQ connection.
+type amqpSession struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	closed  chan error
+}
+
+func dialAMQP(uri string) (*amqpSession, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open channel: %v", err)
+	}
+
+	session := &amqpSession{
+		conn:    conn,
+		channel: channel,
+		closed:  make(chan error, 1),
+	}
+	// Registered once per session, amqp closes both when they go away
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-channelClosed:
+		}
+		if reason != nil {
+			session.closed <- reason
+		}
+		close(session.closed)
+	}()
+	return session, nil
+}
+
+func (s *amqpSession) Closed() <-chan error {
+	return s.closed
+}
+
+func (s *amqpSession) Close() error {
+	if err := s.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		log.Printf("Error closing channel: %v", err)
+	}
+	if err := s.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("failed to close connection: %v", err)
+	}
+	return nil
+}
+
+// ReconnectPolicy spaces out connection attempts, the delay doubles after
+// every failure up to Max.
+type ReconnectPolicy struct {
+	Backoff time.Duration
+	Max     time.Duration
+}
+
+// reconnectPolicyFromEnv reads AMQP_RECONNECT_BACKOFF and
+// AMQP_RECONNECT_MAX_BACKOFF.
+func reconnectPolicyFromEnv() ReconnectPolicy {
+	return ReconnectPolicy{
+		Backoff: envDuration("AMQP_RECONNECT_BACKOFF", defaultReconnectBackoff),
+		Max:     envDuration("AMQP_RECONNECT_MAX_BACKOFF", defaultMaxReconnectBackoff),
+	}
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// delay returns how long to wait after the given number of failed attempts
+// in a row.
+func (p ReconnectPolicy) delay(failures int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < failures && delay < p.Max; i++ {
+		delay *= 2
+	}
+	return min(delay, p.Max)
+}
+
+// BrokerSupervisor owns the connection to the broker. It dials, lets setup
+// declare the topology and start the consumers on the new session, and
+// starts over with backoff whenever the connection is lost or an attempt
+// fails. Nothing else closes or redials the connection.
+type BrokerSupervisor struct {
+	dial   func() (brokerSession, error)
+	setup  func(brokerSession) error
+	policy ReconnectPolicy
+
+	mu         sync.RWMutex
+	state      ConnState
+	session    brokerSession
+	readySince time.Time
+	watchers   []chan ConnState
+	stop       chan struct{}
+
+	// Connects counts sessions that were set up, the first one included
+	Connects atomic.Int64
+}
+
+func NewBrokerSupervisor(dial func() (brokerSession, error), setup func(brokerSession) error, policy ReconnectPolicy) *BrokerSupervisor {
+	if policy.Backoff <= 0 {
+		policy.Backoff = defaultReconnectBackoff
+	}
+	if policy.Max < policy.Backoff {
+		policy.Max = policy.Backoff
+	}
+	return &BrokerSupervisor{
+		dial:   dial,
+		setup:  setup,
+		policy: policy,
+		state:  ConnConnecting,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Run keeps the broker connected until ctx ends or the supervisor is
+// closed. The session stays open when ctx ends, deliveries in flight are
+// still acknowledged on it until Close.
+func (s *BrokerSupervisor) Run(ctx context.Context) {
+	failures := 0
+	for {
+		if !s.transition(ConnConnecting) {
+			return
+		}
+		session, err := s.connect()
+		if err != nil {
+			failures++
+			delay := s.policy.delay(failures)
+			log.Printf("Failed to connect to RabbitMQ (attempt %d), retrying in %s: %v", failures, delay, err)
+			if !s.transition(ConnBackoff) {
+				return
+			}
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return
+			case <-s.stop:
+				return
+			}
+		}
+		failures = 0
+
+		if !s.ready(session) {
+			session.Close()
+			return
+		}
+		log.Println("Connected to RabbitMQ")
+		select {
+		case err, ok := <-session.Closed():
+			// A channel exception leaves the connection up, it has to be
+			// closed before the next one is dialed
+			if closeErr := session.Close(); closeErr != nil {
+				log.Printf("Failed to close lost RabbitMQ session: %v", closeErr)
+			}
+			if !s.lost(session) {
+				return
+			}
+			if ok {
+				log.Printf("Connection to RabbitMQ lost, reconnecting: %v", err)
+			} else {
+				log.Println("Connection to RabbitMQ closed, reconnecting")
+			}
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *BrokerSupervisor) connect() (brokerSession, error) {
+	session, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setup(session); err != nil {
+		session.Close()
+		return nil, err
+	}
+	s.Connects.Add(1)
+	return session, nil
+}
+
+// transition moves to state unless the supervisor was closed.
+func (s *BrokerSupervisor) transition(state ConnState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == ConnStopped {
+		return false
+	}
+	s.setState(state)
+	return true
+}
+
+func (s *BrokerSupervisor) ready(session brokerSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == ConnStopped {
+		return false
+	}
+	s.session = session
+	s.readySince = time.Now()
+	s.setState(ConnReady)
+	return true
+}
+
+// lost forgets a session that went away and reports whether to reconnect.
+func (s *BrokerSupervisor) lost(session brokerSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session == session {
+		s.session = nil
+		s.readySince = time.Time{}
+	}
+	return s.state != ConnStopped
+}
+
+// setState expects the lock to be held.
+func (s *BrokerSupervisor) setState(state ConnState) {
+	if s.state == state {
+		return
+	}
+	s.state = state
+	for _, watcher := range s.watchers {
+		select {
+		case watcher <- state:
+		default:
+		}
+	}
+}
+
+func (s *BrokerSupervisor) State() ConnState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// ReadySince returns when the current session was set up, zero while not
+// connected.
+func (s *BrokerSupervisor) ReadySince() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readySince
+}
+
+// Session returns the current session, nil while not connected.
+func (s *BrokerSupervisor) Session() brokerSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.session
+}
+
+// NotifyState registers a channel that receives every state change. Changes
+// are dropped while the channel is full, so it should be buffered.
+func (s *BrokerSupervisor) NotifyState(watcher chan ConnState) chan ConnState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, watcher)
+	return watcher
+}
+
+// Close stops reconnecting and closes the current session.
+func (s *BrokerSupervisor) Close() error {
+	s.mu.Lock()
+	if s.state == ConnStopped {
+		s.mu.Unlock()
+		return nil
+	}
+	session := s.session
+	s.session = nil
+	s.readySince = time.Time{}
+	s.setState(ConnStopped)
+	close(s.stop)
+	s.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+	return session.Close()
+}
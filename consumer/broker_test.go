@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBroker stands in for RabbitMQ. Killing it drops every open session
+// like a broker restart does and refuses new connections until it is
+// started again.
+type fakeBroker struct {
+	mu       sync.Mutex
+	up       bool
+	dials    int
+	sessions []*fakeSession
+}
+
+// fakeSession streams the numbers published while it is open.
+type fakeSession struct {
+	deliveries chan int
+	closed     chan error
+	once       sync.Once
+	// closeCalls counts Close calls, dropping the session is not one
+	closeCalls atomic.Int32
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{up: true}
+}
+
+func (b *fakeBroker) dial() (brokerSession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.dials++
+	if !b.up {
+		return nil, errors.New("connection refused")
+	}
+	session := &fakeSession{
+		deliveries: make(chan int, 100),
+		closed:     make(chan error, 1),
+	}
+	b.sessions = append(b.sessions, session)
+	return session, nil
+}
+
+// publish delivers n to the open sessions and reports whether any took it.
+func (b *fakeBroker) publish(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delivered := false
+	for _, session := range b.sessions {
+		select {
+		case <-session.closed:
+			continue
+		default:
+		}
+		session.deliveries <- n
+		delivered = true
+	}
+	return delivered
+}
+
+func (b *fakeBroker) kill() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.up = false
+	for _, session := range b.sessions {
+		session.drop(errors.New("connection reset by peer"))
+	}
+	b.sessions = nil
+}
+
+func (b *fakeBroker) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.up = true
+}
+
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+func (s *fakeSession) drop(reason error) {
+	s.once.Do(func() {
+		if reason != nil {
+			s.closed <- reason
+		}
+		close(s.closed)
+		close(s.deliveries)
+	})
+}
+
+func (s *fakeSession) Closed() <-chan error {
+	return s.closed
+}
+
+func (s *fakeSession) Close() error {
+	s.closeCalls.Add(1)
+	s.drop(nil)
+	return nil
+}
+
+// fakeConsumer is set up on every session like the consumer is, it keeps
+// reading the deliveries of the newest session.
+type fakeConsumer struct {
+	feed     chan chan int
+	received chan int
+	setups   int
+	mu       sync.Mutex
+}
+
+func newFakeConsumer() *fakeConsumer {
+	return &fakeConsumer{
+		feed:     make(chan chan int, 1),
+		received: make(chan int, 100),
+	}
+}
+
+func (c *fakeConsumer) setup(session brokerSession) error {
+	c.mu.Lock()
+	c.setups++
+	c.mu.Unlock()
+	select {
+	case <-c.feed:
+	default:
+	}
+	c.feed <- session.(*fakeSession).deliveries
+	return nil
+}
+
+func (c *fakeConsumer) setupCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setups
+}
+
+func (c *fakeConsumer) run(ctx context.Context) {
+	var deliveries chan int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case deliveries = <-c.feed:
+		case n, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			c.received <- n
+		}
+	}
+}
+
+func waitForState(t *testing.T, states <-chan ConnState, want ConnState) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %s", want)
+		}
+	}
+}
+
+func waitForDelivery(t *testing.T, received <-chan int, want int) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case n := <-received:
+			if n == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for delivery %d", want)
+		}
+	}
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{Backoff: time.Second, Max: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, expected := range want {
+		if got := policy.delay(i + 1); got != expected {
+			t.Errorf("delay after %d failures = %s, want %s", i+1, got, expected)
+		}
+	}
+}
+
+func TestSupervisorReconnectsAfterBrokerDies(t *testing.T) {
+	broker := newFakeBroker()
+	consumer := newFakeConsumer()
+	supervisor := NewBrokerSupervisor(broker.dial, consumer.setup, ReconnectPolicy{Backoff: time.Millisecond, Max: 4 * time.Millisecond})
+	states := supervisor.NotifyState(make(chan ConnState, 1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.run(ctx)
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx)
+		close(done)
+	}()
+
+	waitForState(t, states, ConnReady)
+	broker.publish(1)
+	waitForDelivery(t, consumer.received, 1)
+
+	// Kill the broker mid-stream, the supervisor keeps backing off while it
+	// is down
+	broker.publish(2)
+	broker.kill()
+	waitForState(t, states, ConnConnecting)
+	waitForState(t, states, ConnBackoff)
+	if supervisor.Session() != nil {
+		t.Error("Session returned the lost session")
+	}
+	if !supervisor.ReadySince().IsZero() {
+		t.Error("ReadySince is set while disconnected")
+	}
+	for broker.dialCount() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	if broker.publish(3) {
+		t.Fatal("a dead broker delivered a message")
+	}
+
+	broker.start()
+	waitForState(t, states, ConnReady)
+	if got := consumer.setupCount(); got != 2 {
+		t.Errorf("consumers were set up %d times, want 2", got)
+	}
+	if got := supervisor.Connects.Load(); got != 2 {
+		t.Errorf("Connects = %d, want 2", got)
+	}
+	// The consumer reads the fresh delivery channel of the new session
+	broker.publish(4)
+	waitForDelivery(t, consumer.received, 4)
+
+	if err := supervisor.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if state := supervisor.State(); state != ConnStopped {
+		t.Errorf("state after Close = %s, want %s", state, ConnStopped)
+	}
+}
+
+func TestSupervisorClosesSessionAfterChannelError(t *testing.T) {
+	broker := newFakeBroker()
+	consumer := newFakeConsumer()
+	supervisor := NewBrokerSupervisor(broker.dial, consumer.setup, ReconnectPolicy{Backoff: time.Millisecond, Max: time.Millisecond})
+	states := supervisor.NotifyState(make(chan ConnState, 1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go supervisor.Run(ctx)
+	defer supervisor.Close()
+
+	waitForState(t, states, ConnReady)
+	first := supervisor.Session().(*fakeSession)
+	// Only the channel fails, the connection behind it would stay open
+	first.drop(errors.New("PRECONDITION_FAILED - unknown delivery tag 42"))
+	waitForState(t, states, ConnConnecting)
+	waitForState(t, states, ConnReady)
+
+	if first.closeCalls.Load() == 0 {
+		t.Error("the session of the failed channel was not closed")
+	}
+	if supervisor.Session() == first {
+		t.Error("Session still returns the failed session")
+	}
+}
+
+func TestSupervisorRetriesFailedSetup(t *testing.T) {
+	broker := newFakeBroker()
+	failures := 2
+	var sessions []*fakeSession
+	setup := func(session brokerSession) error {
+		sessions = append(sessions, session.(*fakeSession))
+		if failures > 0 {
+			failures--
+			return errors.New("PRECONDITION_FAILED - inequivalent arg 'durable'")
+		}
+		return nil
+	}
+	supervisor := NewBrokerSupervisor(broker.dial, setup, ReconnectPolicy{Backoff: time.Millisecond, Max: time.Millisecond})
+	states := supervisor.NotifyState(make(chan ConnState, 1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go supervisor.Run(ctx)
+	defer supervisor.Close()
+
+	waitForState(t, states, ConnReady)
+	if len(sessions) != 3 {
+		t.Fatalf("setup ran %d times, want 3", len(sessions))
+	}
+	// Sessions whose setup failed must not leak
+	for i, session := range sessions[:2] {
+		select {
+		case <-session.Closed():
+		default:
+			t.Errorf("session %d was left open after its setup failed", i)
+		}
+	}
+	if supervisor.Session() != sessions[2] {
+		t.Error("Session is not the one that was set up")
+	}
+}
+
+func TestSupervisorStopsReconnectingWhenClosed(t *testing.T) {
+	broker := newFakeBroker()
+	broker.kill()
+	supervisor := NewBrokerSupervisor(broker.dial, newFakeConsumer().setup, ReconnectPolicy{Backoff: time.Hour, Max: time.Hour})
+	states := supervisor.NotifyState(make(chan ConnState, 1000))
+
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(context.Background())
+		close(done)
+	}()
+	waitForState(t, states, ConnBackoff)
+
+	// Close must not wait out the backoff
+	supervisor.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if dials := broker.dialCount(); dials != 1 {
+		t.Errorf("dialed %d times, want 1", dials)
+	}
+}
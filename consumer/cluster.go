@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// measurementsHashExchange spreads measurements over the shard queues by
+	// hashing the device_id header, so every device keeps its order on one
+	// shard while the devices of a city spread out. It needs the
+	// rabbitmq_consistent_hash_exchange plugin.
+	measurementsHashExchange = "watt-flow.measurements.by-device"
+	// legacyHashExchange hashed the routing key, arguments of an existing
+	// exchange cannot change so it is replaced
+	legacyHashExchange = "watt-flow.measurements"
+	deviceIDHeader     = "device_id"
+	shardQueuePrefix   = "measurements.shard."
+
+	leaderKey      = "consumer:leader"
+	leaderTTL      = 15 * time.Second
+	broadcastTopic = "consumer:ws"
+	// membersKey is the sorted set of replicas sharing the shards, scored by
+	// when their membership expires (unix ms)
+	membersKey = "consumer:members"
+	memberTTL  = leaderTTL
+	// shardLeasePrefix starts the lease key of a shard, held by the replica
+	// consuming it with a TTL of memberTTL
+	shardLeasePrefix = "consumer:shard:"
+	// shardHandoverTimeout bounds how long a shard given up waits for its
+	// deliveries to settle before the next owner may take it
+	shardHandoverTimeout = 2 * time.Minute
+)
+
+// ShardConfig tells a replica how many measurement shards exist and which of
+// them it consumes. With a single shard the consumer keeps the original
+// measurements_queue and runs without coordination. Auto replicas share the
+// shards among themselves, Owned is then picked by the ShardBalancer.
+type ShardConfig struct {
+	Count      int
+	Owned      []int
+	Auto       bool
+	InstanceID string
+}
+
+// shardConfigFromEnv reads CONSUMER_SHARDS, CONSUMER_SHARD_IDS (a comma
+// separated list, default shared automatically with the other replicas) and
+// CONSUMER_ID (default the hostname). Pinned and automatic replicas do not
+// see each other, set CONSUMER_SHARD_IDS on all of them or none.
+func shardConfigFromEnv() (ShardConfig, error) {
+	config := ShardConfig{
+		Count:      envInt("CONSUMER_SHARDS", 1),
+		InstanceID: os.Getenv("CONSUMER_ID"),
+	}
+	if config.Count < 1 {
+		return config, fmt.Errorf("CONSUMER_SHARDS must be at least 1, got %d", config.Count)
+	}
+	if config.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return config, fmt.Errorf("failed to read hostname, set CONSUMER_ID: %v", err)
+		}
+		config.InstanceID = hostname
+	}
+
+	ids := os.Getenv("CONSUMER_SHARD_IDS")
+	if ids == "" {
+		config.Auto = config.Clustered()
+		return config, nil
+	}
+	for _, id := range strings.Split(ids, ",") {
+		shard, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil || shard < 0 || shard >= config.Count {
+			return config, fmt.Errorf("invalid shard %q in CONSUMER_SHARD_IDS", id)
+		}
+		config.Owned = append(config.Owned, shard)
+	}
+	return config, nil
+}
+
+// Clustered reports whether replicas have to coordinate.
+func (s ShardConfig) Clustered() bool {
+	return s.Count > 1
+}
+
+func shardLeaseKey(shard int) string {
+	return shardLeasePrefix + strconv.Itoa(shard)
+}
+
+func shardQueue(shard int) string {
+	return shardQueuePrefix + strconv.Itoa(shard)
+}
+
+// assignShards picks the shards of instance by rendezvous hashing, every
+// shard goes to the member with the highest hash of the pair. A member
+// joining or leaving only moves the shards it gains or loses.
+func assignShards(members []string, count int, instance string) []int {
+	var owned []int
+	for shard := 0; shard < count; shard++ {
+		var owner string
+		var best uint64
+		for _, member := range members {
+			if score := rendezvousScore(member, shard); owner == "" || score > best || (score == best && member < owner) {
+				owner, best = member, score
+			}
+		}
+		if owner == instance {
+			owned = append(owned, shard)
+		}
+	}
+	return owned
+}
+
+// rendezvousScore hashes a member and shard pair. FNV alone barely mixes
+// names that differ in their last characters, the splitmix64 finalizer
+// spreads them over the whole range.
+func rendezvousScore(member string, shard int) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(member + ":" + strconv.Itoa(shard)))
+	score := hash.Sum64()
+	score ^= score >> 30
+	score *= 0xbf58476d1ce4e5b9
+	score ^= score >> 27
+	score *= 0x94d049bb133111eb
+	score ^= score >> 31
+	return score
+}
+
+// ShardBalancer keeps the replica registered in Redis and its share of the
+// shards subscribed on the current broker session. A shard is consumed under
+// a lease in Redis. An owner giving a shard up keeps its lease until the
+// deliveries it took from the shard are settled, so the register states
+// they derived are committed before the next owner reads them.
+type ShardBalancer struct {
+	redisClient *redis.Client
+	config      ShardConfig
+	inflight    *shardInflight
+
+	mu    sync.Mutex
+	owned []int
+	// draining are shards given up whose deliveries are still settling
+	draining map[int]bool
+	subs     *shardSubscriptions
+}
+
+func NewShardBalancer(redisClient *redis.Client, config ShardConfig) *ShardBalancer {
+	return &ShardBalancer{
+		redisClient: redisClient,
+		config:      config,
+		inflight:    &shardInflight{counts: make(map[int]int)},
+		owned:       config.Owned,
+		draining:    make(map[int]bool),
+	}
+}
+
+// Run renews the membership a few times per TTL and follows the assignment
+// until ctx ends, then leaves so the others take over right away.
+func (b *ShardBalancer) Run(ctx context.Context) {
+	if !b.config.Auto {
+		return
+	}
+	ticker := time.NewTicker(memberTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		b.rebalance(ctx)
+		select {
+		case <-ctx.Done():
+			b.leave()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *ShardBalancer) rebalance(ctx context.Context) {
+	now := time.Now()
+	var members *redis.StringSliceCmd
+	_, err := b.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, membersKey, redis.Z{Score: float64(now.Add(memberTTL).UnixMilli()), Member: b.config.InstanceID})
+		pipe.ZRemRangeByScore(ctx, membersKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		members = pipe.ZRange(ctx, membersKey, 0, -1)
+		return nil
+	})
+	if err != nil {
+		// Keep the current shards, the others keep theirs as well
+		log.Printf("Failed to renew shard membership: %v", err)
+		return
+	}
+	assigned := assignShards(members.Val(), b.config.Count, b.config.InstanceID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Shards still draining are taken up again once they are handed over
+	var owned []int
+	for _, shard := range assigned {
+		if !b.draining[shard] && b.lease(ctx, shard) {
+			owned = append(owned, shard)
+		}
+	}
+	for shard := range b.draining {
+		b.lease(ctx, shard)
+	}
+
+	// Applied every time, a shard that failed to subscribe is retried
+	if b.subs != nil {
+		if err := b.subs.set(owned); err != nil {
+			log.Printf("Failed to follow shard assignment: %v", err)
+		}
+	}
+	for _, shard := range b.owned {
+		if slices.Contains(owned, shard) {
+			continue
+		}
+		if b.subs != nil && b.subs.consuming(shard) {
+			// Its consumer could not be cancelled, it stays ours
+			owned = append(owned, shard)
+			continue
+		}
+		b.draining[shard] = true
+		var stopped <-chan struct{}
+		if b.subs != nil {
+			stopped = b.subs.stopped(shard)
+		}
+		go b.handover(shard, stopped)
+	}
+	slices.Sort(owned)
+	if !slices.Equal(owned, b.owned) {
+		log.Printf("Instance %s now owns measurement shards %v of %d (%d replicas)", b.config.InstanceID, owned, b.config.Count, len(members.Val()))
+		b.owned = owned
+	}
+}
+
+// lease takes or renews the lease of a shard, it reports false while another
+// replica holds it. A shard already owned is kept when Redis fails.
+func (b *ShardBalancer) lease(ctx context.Context, shard int) bool {
+	leased, err := leaseShardScript.Run(ctx, b.redisClient, []string{shardLeaseKey(shard)},
+		b.config.InstanceID, memberTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("Failed to lease measurement shard %d: %v", shard, err)
+		return slices.Contains(b.owned, shard)
+	}
+	return leased == 1
+}
+
+// handover releases the lease of a shard given up once the deliveries taken
+// from it are settled, or after shardHandoverTimeout.
+func (b *ShardBalancer) handover(shard int, stopped <-chan struct{}) {
+	deadline := time.NewTimer(shardHandoverTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	// Deliveries still buffered on the consumer are forwarded until it stops
+	if stopped != nil {
+		select {
+		case <-stopped:
+		case <-deadline.C:
+		}
+	}
+	for pending := b.inflight.count(shard); pending > 0; pending = b.inflight.count(shard) {
+		select {
+		case <-ticker.C:
+			continue
+		case <-deadline.C:
+			log.Printf("Handing over measurement shard %d with %d deliveries still unsettled", shard, pending)
+		}
+		break
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.release(shard)
+	delete(b.draining, shard)
+}
+
+func (b *ShardBalancer) release(shard int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLeaseScript.Run(ctx, b.redisClient, []string{shardLeaseKey(shard)}, b.config.InstanceID).Err(); err != nil {
+		log.Printf("Failed to release measurement shard %d: %v", shard, err)
+	}
+}
+
+// settle marks a delivery as done with, register states it derived are
+// committed or released.
+func (b *ShardBalancer) settle(msg amqp.Delivery) {
+	if shard, ok := shardOfTag(b.config.InstanceID, msg.ConsumerTag); ok {
+		b.inflight.done(shard)
+	}
+}
+
+func (b *ShardBalancer) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.redisClient.ZRem(ctx, membersKey, b.config.InstanceID).Err(); err != nil {
+		log.Printf("Failed to leave shard membership: %v", err)
+	}
+}
+
+// releaseAll hands over every leased shard, once the consumer settled all its
+// deliveries on shutdown.
+func (b *ShardBalancer) releaseAll() {
+	if !b.config.Auto {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, shard := range b.owned {
+		b.release(shard)
+	}
+	b.owned = nil
+}
+
+// attach subscribes the shards owned now on a new session, later changes
+// follow on it.
+func (b *ShardBalancer) attach(subs *shardSubscriptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = subs
+	log.Printf("Consuming measurement shards %v of %d as %s", b.owned, b.config.Count, b.config.InstanceID)
+	return subs.set(b.owned)
+}
+
+// shardInflight counts the deliveries taken from each shard that are not
+// settled yet.
+type shardInflight struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+func (f *shardInflight) add(shard int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[shard]++
+}
+
+func (f *shardInflight) done(shard int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts[shard]--; f.counts[shard] <= 0 {
+		delete(f.counts, shard)
+	}
+}
+
+func (f *shardInflight) count(shard int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[shard]
+}
+
+// shardOfTag returns the shard a consumer tag of instance was made for.
+func shardOfTag(instance string, tag string) (int, bool) {
+	suffix, ok := strings.CutPrefix(tag, instance+"-")
+	if !ok {
+		return 0, false
+	}
+	shard, err := strconv.Atoi(suffix)
+	return shard, err == nil
+}
+
+// shardSubscriptions are the shard consumers of one channel merged into a
+// single delivery channel, closed once the AMQP channel is.
+type shardSubscriptions struct {
+	channel  *amqp.Channel
+	instance string
+	inflight *shardInflight
+	merged   chan amqp.Delivery
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu   sync.Mutex
+	tags map[int]string
+	// forwarding is closed once the consumer of a shard forwarded its last
+	// delivery
+	forwarding map[int]chan struct{}
+	closed     bool
+}
+
+func newShardSubscriptions(channel *amqp.Channel, instance string, inflight *shardInflight) *shardSubscriptions {
+	subs := &shardSubscriptions{
+		channel:    channel,
+		instance:   instance,
+		inflight:   inflight,
+		merged:     make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+		tags:       make(map[int]string),
+		forwarding: make(map[int]chan struct{}),
+	}
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+		subs.mu.Lock()
+		subs.closed = true
+		subs.mu.Unlock()
+		close(subs.done)
+		subs.wg.Wait()
+		close(subs.merged)
+	}()
+	return subs
+}
+
+// consuming reports whether a consumer of the shard is running.
+func (s *shardSubscriptions) consuming(shard int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tags[shard]
+	return ok
+}
+
+// stopped returns a channel closed once the last consumer of the shard
+// stopped forwarding deliveries, nil when there never was one.
+func (s *shardSubscriptions) stopped(shard int) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwarding[shard]
+}
+
+// set consumes exactly the given shards, cancelling the consumers of the
+// others. Each shard keeps its own order in the merged deliveries.
+func (s *shardSubscriptions) set(shards []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	var errs []error
+	for shard, tag := range s.tags {
+		if slices.Contains(shards, shard) {
+			continue
+		}
+		if err := s.channel.Cancel(tag, false); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop consumer of shard %d: %v", shard, err))
+			continue
+		}
+		delete(s.tags, shard)
+	}
+	for _, shard := range shards {
+		if _, ok := s.tags[shard]; ok {
+			continue
+		}
+		tag := s.instance + "-" + strconv.Itoa(shard)
+		msgs, err := s.channel.Consume(
+			shardQueue(shard),
+			tag,
+			false,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to start consumer of shard %d: %v", shard, err))
+			continue
+		}
+		s.tags[shard] = tag
+		forwarding := make(chan struct{})
+		s.forwarding[shard] = forwarding
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer close(forwarding)
+			// Ends when the consumer is cancelled or the channel closes,
+			// a delivery dropped then is redelivered
+			for msg := range msgs {
+				s.inflight.add(shard)
+				select {
+				case s.merged <- msg:
+				case <-s.done:
+					s.inflight.done(shard)
+					return
+				}
+			}
+		}()
+	}
+	return errors.Join(errs...)
+}
+
+// renewLeaderScript extends the lease only while this instance holds it.
+var renewLeaderScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// leaseShardScript takes the lease of a shard for ARGV[1] or renews it, it
+// returns 0 while another instance holds it.
+var leaseShardScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// releaseLeaseScript drops a lease only while this instance holds it.
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// LeaderElector holds a lease in Redis, so only one replica runs the
+// heartbeat scan and the city aggregation. Without clustering the single
+// instance is always the leader.
+type LeaderElector struct {
+	redisClient *redis.Client
+	instanceID  string
+	clustered   bool
+	leader      atomic.Bool
+}
+
+func NewLeaderElector(redisClient *redis.Client, shards ShardConfig) *LeaderElector {
+	elector := &LeaderElector{
+		redisClient: redisClient,
+		instanceID:  shards.InstanceID,
+		clustered:   shards.Clustered(),
+	}
+	elector.leader.Store(!elector.clustered)
+	return elector
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns for the lease and renews it a few times per TTL until ctx
+// ends, then hands it over.
+func (e *LeaderElector) Run(ctx context.Context) {
+	if !e.clustered {
+		return
+	}
+	ticker := time.NewTicker(leaderTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.Resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaderElector) campaign(ctx context.Context) {
+	var leader bool
+	if e.leader.Load() {
+		renewed, err := renewLeaderScript.Run(ctx, e.redisClient, []string{leaderKey}, e.instanceID, leaderTTL.Milliseconds()).Int()
+		if err != nil {
+			log.Printf("Failed to renew leadership: %v", err)
+		}
+		leader = err == nil && renewed == 1
+	} else {
+		acquired, err := e.redisClient.SetNX(ctx, leaderKey, e.instanceID, leaderTTL).Result()
+		if err != nil {
+			log.Printf("Failed to campaign for leadership: %v", err)
+		}
+		leader = err == nil && acquired
+	}
+	if leader != e.leader.Load() {
+		e.leader.Store(leader)
+		if leader {
+			log.Printf("Instance %s is now the leader", e.instanceID)
+		} else {
+			log.Printf("Instance %s lost leadership", e.instanceID)
+		}
+	}
+}
+
+// Resign gives up the lease so another replica can take over right away.
+func (e *LeaderElector) Resign() {
+	if !e.clustered || !e.leader.Swap(false) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLeaseScript.Run(ctx, e.redisClient, []string{leaderKey}, e.instanceID).Err(); err != nil {
+		log.Printf("Failed to release leadership: %v", err)
+	}
+}
+
+// broadcastMessage is a WebSocket message relayed to every replica, the
+// clients it is meant for may be connected to any of them.
+type broadcastMessage struct {
+	Target   string
+	ConnType string
+	Payload  []byte
+}
+
+// broadcast sends a WebSocket message to the matching clients of every
+// replica and keeps it for replay to later subscribers.
+func (c *Consumer) broadcast(target string, msg []byte, connType string) {
+	topic := topicOf(connType, target)
+	if err := c.replay.Record(context.Background(), topic, msg, time.Now()); err != nil {
+		log.Printf("Failed to keep message for replay: %v", err)
+	}
+	if !c.shards.Clustered() {
+		c.wsServer.SendMessage(target, msg, connType)
+		return
+	}
+	data, err := json.Marshal(broadcastMessage{Target: target, ConnType: connType, Payload: msg})
+	if err != nil {
+		log.Printf("Failed to marshal broadcast: %v", err)
+		return
+	}
+	if err := c.redisClient.Publish(context.Background(), broadcastTopic, data).Err(); err != nil {
+		log.Printf("Failed to publish broadcast, sending to local clients only: %v", err)
+		c.wsServer.SendMessage(target, msg, connType)
+	}
+}
+
+// relayBroadcasts delivers the broadcasts of all replicas to local clients.
+func (c *Consumer) relayBroadcasts(ctx context.Context) {
+	if !c.shards.Clustered() {
+		return
+	}
+	pubsub := c.redisClient.Subscribe(ctx, broadcastTopic)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			var relayed broadcastMessage
+			if err := json.Unmarshal([]byte(message.Payload), &relayed); err != nil {
+				log.Printf("Failed to unmarshal broadcast: %v", err)
+				continue
+			}
+			c.wsServer.SendMessage(relayed.Target, relayed.Payload, relayed.ConnType)
+		}
+	}
+}
+
+// declareShardQueues sets up the consistent hash exchange behind the topic
+// exchange and one queue per shard. A shard is consumed by one replica at a
+// time, others standing by take over when it goes away.
+func (c *Consumer) declareShardQueues(channel *amqp.Channel) error {
+	// Deleting an exchange that does not exist succeeds
+	if err := channel.ExchangeDelete(legacyHashExchange, false, false); err != nil {
+		return fmt.Errorf("failed to delete legacy measurement hash exchange: %v", err)
+	}
+	err := channel.ExchangeDeclare(
+		measurementsHashExchange,
+		"x-consistent-hash",
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{"hash-header": deviceIDHeader},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare measurement hash exchange: %v", err)
+	}
+	err = channel.ExchangeBind(
+		measurementsHashExchange,
+		"measurement.*",
+		exchangeName,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to bind measurement hash exchange: %v", err)
+	}
+
+	for shard := 0; shard < c.shards.Count; shard++ {
+		queue, err := channel.QueueDeclare(
+			shardQueue(shard),
+			true,
+			false,
+			false,
+			false,
+			amqp.Table{"x-single-active-consumer": true},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare shard queue %d: %v", shard, err)
+		}
+		// The binding key is the weight of the queue on the hash ring
+		err = channel.QueueBind(
+			queue.Name,
+			"1",
+			measurementsHashExchange,
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind shard queue %d: %v", shard, err)
+		}
+	}
+	return nil
+}
+
+// consumeMeasurements subscribes to the measurement queues of this replica,
+// in a cluster those of the shards the balancer hands it.
+func (c *Consumer) consumeMeasurements(channel *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if !c.shards.Clustered() {
+		msgs, err := channel.Consume(
+			"measurements_queue",
+			"",
+			false,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start measurement consumer: %v", err)
+		}
+		return msgs, nil
+	}
+
+	subs := newShardSubscriptions(channel, c.shards.InstanceID, c.balancer.inflight)
+	if err := c.balancer.attach(subs); err != nil {
+		return nil, err
+	}
+	return subs.merged, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAssignShardsCoversEveryShardOnce(t *testing.T) {
+	members := []string{"consumer-a", "consumer-b", "consumer-c"}
+	reversed := []string{"consumer-c", "consumer-b", "consumer-a"}
+
+	owners := make(map[int]string)
+	for _, member := range members {
+		owned := assignShards(members, 32, member)
+		if !slices.Equal(owned, assignShards(reversed, 32, member)) {
+			t.Fatalf("%s got different shards depending on member order", member)
+		}
+		if len(owned) == 0 {
+			t.Errorf("%s got no shards of 32", member)
+		}
+		for _, shard := range owned {
+			if owner, ok := owners[shard]; ok {
+				t.Fatalf("shard %d assigned to %s and %s", shard, owner, member)
+			}
+			owners[shard] = member
+		}
+	}
+	if len(owners) != 32 {
+		t.Fatalf("%d of 32 shards assigned", len(owners))
+	}
+}
+
+func TestAssignShardsOnlyMovesToNewMember(t *testing.T) {
+	var members []string
+	for i := 0; i < 4; i++ {
+		members = append(members, fmt.Sprintf("consumer-%d", i))
+	}
+	before := make(map[string][]int)
+	for _, member := range members {
+		before[member] = assignShards(members, 64, member)
+	}
+
+	grown := append(slices.Clone(members), "consumer-new")
+	for _, member := range members {
+		for _, shard := range assignShards(grown, 64, member) {
+			if !slices.Contains(before[member], shard) {
+				t.Errorf("%s gained shard %d when another member joined", member, shard)
+			}
+		}
+	}
+	if len(assignShards(grown, 64, "consumer-new")) == 0 {
+		t.Error("the new member got no shards")
+	}
+	if len(assignShards(members, 64, "consumer-gone")) != 0 {
+		t.Error("an instance that is not a member got shards")
+	}
+}
+
+// jumpHash is the bucket choice of the consistent hash exchange, which maps
+// the hash of a message onto one bucket per unit of queue weight.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func exchangeShard(hashed string, shards int) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(hashed))
+	return jumpHash(hash.Sum64(), shards)
+}
+
+func TestDeviceHeaderSpreadsCityOverShards(t *testing.T) {
+	const shards = 8
+	const devices = 400
+	byRoutingKey := make(map[int]int)
+	byDevice := make(map[int]int)
+	for i := 0; i < devices; i++ {
+		// Every device of the city shares the routing key
+		byRoutingKey[exchangeShard("measurement.Novi Sad", shards)]++
+		byDevice[exchangeShard(fmt.Sprintf("device-%d", i), shards)]++
+	}
+
+	if len(byRoutingKey) != 1 {
+		t.Fatalf("routing key hashing used %d shards, the model is off", len(byRoutingKey))
+	}
+	if len(byDevice) != shards {
+		t.Fatalf("a city of %d devices landed on %d of %d shards", devices, len(byDevice), shards)
+	}
+	for shard, count := range byDevice {
+		if count < devices/shards/2 || count > devices/shards*2 {
+			t.Errorf("shard %d got %d of %d devices", shard, count, devices)
+		}
+	}
+}
+
+func TestShardHandoverWaitsForUnsettledDeliveries(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	newBalancer := func(instance string) *ShardBalancer {
+		return NewShardBalancer(client, ShardConfig{Count: 8, Auto: true, InstanceID: instance})
+	}
+	eventually := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting until %s", what)
+			}
+		}
+	}
+
+	a := newBalancer("consumer-a")
+	a.rebalance(ctx)
+	if len(a.owned) != 8 {
+		t.Fatalf("a single replica owns %v, want all 8 shards", a.owned)
+	}
+
+	b := newBalancer("consumer-b")
+	b.rebalance(ctx)
+	if len(b.owned) != 0 {
+		t.Fatalf("b took shards %v that a still holds", b.owned)
+	}
+	members := []string{"consumer-a", "consumer-b"}
+	moving := assignShards(members, 8, "consumer-b")
+	if len(moving) < 2 {
+		t.Fatalf("b is assigned %v, the test needs at least 2 shards to move", moving)
+	}
+
+	// a still has a delivery of the first moving shard whose register is not
+	// committed yet
+	a.inflight.add(moving[0])
+	a.rebalance(ctx)
+	if !slices.Equal(a.owned, assignShards(members, 8, "consumer-a")) {
+		t.Fatalf("a owns %v after b joined, want its own share", a.owned)
+	}
+	eventually("b owns the settled shards", func() bool {
+		b.rebalance(ctx)
+		return len(b.owned) == len(moving)-1
+	})
+	if slices.Contains(b.owned, moving[0]) {
+		t.Fatalf("b took shard %d before a settled its delivery", moving[0])
+	}
+
+	a.settle(amqp.Delivery{ConsumerTag: "consumer-a-" + strconv.Itoa(moving[0])})
+	eventually("b owns its whole share", func() bool {
+		b.rebalance(ctx)
+		return slices.Equal(b.owned, moving)
+	})
+}
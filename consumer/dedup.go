@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dedupKeyPrefix     = "dedup:"
+	defaultDedupTTL    = 24 * time.Hour
+	dedupReportEvery   = time.Minute
+	dedupByMessageID   = "message_id"
+	dedupByDeviceStamp = "device_timestamp"
+	dedupStored        = "done"
+	// dedupPendingTTL is how long a delivery holds its keys before its write
+	// succeeded, longer than a batch takes to be written with retries
+	dedupPendingTTL = 10 * time.Minute
+)
+
+// DedupStats counts what the dedup window saw since the consumer started.
+type DedupStats struct {
+	Checked          atomic.Int64
+	DroppedByID      atomic.Int64
+	DroppedByReading atomic.Int64
+}
+
+// Deduplicator remembers the message ids and the (device, timestamp) pairs
+// of processed measurements for a TTL, so redeliveries, simulator retries
+// and replays of a reading are only counted once.
+type Deduplicator struct {
+	redisClient *redis.Client
+	ttl         time.Duration
+	stats       DedupStats
+}
+
+func NewDeduplicator(redisClient *redis.Client, ttl time.Duration) *Deduplicator {
+	if ttl <= 0 {
+		ttl = defaultDedupTTL
+	}
+	return &Deduplicator{
+		redisClient: redisClient,
+		ttl:         ttl,
+	}
+}
+
+// dedupTTLFromEnv reads DEDUP_TTL, e.g. "36h".
+func dedupTTLFromEnv() time.Duration {
+	value := os.Getenv("DEDUP_TTL")
+	if value == "" {
+		return defaultDedupTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid DEDUP_TTL %q, using %s", value, defaultDedupTTL)
+		return defaultDedupTTL
+	}
+	return ttl
+}
+
+func readingKey(measurement *Measurement) string {
+	return dedupKeyPrefix + "reading:" + measurement.DeviceID + ":" + strconv.FormatInt(measurement.Timestamp.UnixNano(), 10)
+}
+
+func messageKey(messageID string) string {
+	return dedupKeyPrefix + "message:" + messageID
+}
+
+// dedupClaimScript claims the keys of a delivery as pending unless one of
+// them is taken. A key is taken once its measurement was stored, or while
+// another delivery holds it pending, unless this one is a redelivery: the
+// broker only redelivers what its consumer never acknowledged, so the holder
+// is gone. Keys of older consumers hold "1" and count as stored.
+// KEYS: the dedup keys. ARGV: pending ttl (ms), takeover (1 or 0).
+// Returns the taken key or an empty string.
+var dedupClaimScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	local state = redis.call("GET", key)
+	if state and (state ~= "pending" or ARGV[2] == "0") then
+		return key
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call("SET", key, "pending", "PX", ARGV[1])
+end
+return ""
+`)
+
+func dedupKeys(messageID string, measurement *Measurement) []string {
+	if messageID == "" {
+		return []string{readingKey(measurement)}
+	}
+	return []string{messageKey(messageID), readingKey(measurement)}
+}
+
+// Seen claims the measurement and reports whether it is a duplicate. The
+// claim is pending until Done, it lapses after dedupPendingTTL, so a consumer
+// dying mid-write does not turn the reading into a duplicate for good.
+func (d *Deduplicator) Seen(ctx context.Context, messageID string, redelivered bool, measurement *Measurement) (bool, error) {
+	d.stats.Checked.Add(1)
+
+	takeover := 0
+	if redelivered {
+		takeover = 1
+	}
+	taken, err := dedupClaimScript.Run(ctx, d.redisClient, dedupKeys(messageID, measurement), dedupPendingTTL.Milliseconds(), takeover).Text()
+	if err != nil {
+		return false, fmt.Errorf("failed to check dedup window: %v", err)
+	}
+
+	switch taken {
+	case "":
+		return false, nil
+	case readingKey(measurement):
+		d.stats.DroppedByReading.Add(1)
+		log.Printf("Dropping duplicate measurement of device %s at %s by %s",
+			measurement.DeviceID, measurement.Timestamp.Format(time.RFC3339), dedupByDeviceStamp)
+	default:
+		d.stats.DroppedByID.Add(1)
+		log.Printf("Dropping duplicate measurement %s by %s", messageID, dedupByMessageID)
+	}
+	return true, nil
+}
+
+// Done marks a claimed measurement as stored for the whole window.
+func (d *Deduplicator) Done(ctx context.Context, messageID string, measurement *Measurement) error {
+	pipe := d.redisClient.Pipeline()
+	for _, key := range dedupKeys(messageID, measurement) {
+		pipe.Set(ctx, key, dedupStored, d.ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to mark measurement as stored: %v", err)
+	}
+	return nil
+}
+
+// Forget releases the keys of a measurement that could not be processed, so
+// a redelivery of it is not mistaken for a duplicate.
+func (d *Deduplicator) Forget(ctx context.Context, messageID string, measurement *Measurement) error {
+	if err := d.redisClient.Del(ctx, dedupKeys(messageID, measurement)...).Err(); err != nil {
+		return fmt.Errorf("failed to release dedup keys: %v", err)
+	}
+	return nil
+}
+
+func (d *Deduplicator) Stats() *DedupStats {
+	return &d.stats
+}
+
+// reportStats logs the dedup counters whenever they changed.
+func (d *Deduplicator) reportStats(ctx context.Context) {
+	ticker := time.NewTicker(dedupReportEvery)
+	defer ticker.Stop()
+
+	var lastChecked int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checked := d.stats.Checked.Load()
+			if checked == lastChecked {
+				continue
+			}
+			lastChecked = checked
+			log.Printf("Dedup window (%s): %d measurements checked, %d duplicates dropped by message id, %d by device and timestamp",
+				d.ttl, checked, d.stats.DroppedByID.Load(), d.stats.DroppedByReading.Load())
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDedupTakesOverPendingClaimOnRedelivery(t *testing.T) {
+	server, client := newTestRedis(t)
+	ctx := context.Background()
+	dedup := NewDeduplicator(client, time.Hour)
+	reading := &Measurement{DeviceID: "device-1", Value: 0.3, Timestamp: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)}
+
+	steps := []struct {
+		name        string
+		messageID   string
+		redelivered bool
+		duplicate   bool
+		after       func()
+	}{
+		{"first delivery", "m-1", false, false, nil},
+		// The simulator resent the reading while the first is being written
+		{"resent while pending", "m-2", false, true, nil},
+		// The consumer holding it died, the broker hands it to another one
+		{"redelivered while pending", "m-1", true, false, func() {
+			if err := dedup.Done(ctx, "m-1", reading); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"redelivered once stored", "m-1", true, true, nil},
+		{"resent once stored", "m-3", false, true, func() {
+			if err := dedup.Forget(ctx, "m-1", reading); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"delivered after forget", "m-1", false, false, func() {
+			server.FastForward(dedupPendingTTL)
+		}},
+		// A pending claim lapses when its holder never finishes
+		{"delivered after the claim lapsed", "m-4", false, false, nil},
+	}
+	for _, step := range steps {
+		duplicate, err := dedup.Seen(ctx, step.messageID, step.redelivered, reading)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if duplicate != step.duplicate {
+			t.Fatalf("%s: duplicate = %v, want %v", step.name, duplicate, step.duplicate)
+		}
+		if step.after != nil {
+			step.after()
+		}
+	}
+}
+
+func TestDedupTreatsLegacyKeysAsStored(t *testing.T) {
+	server, client := newTestRedis(t)
+	ctx := context.Background()
+	dedup := NewDeduplicator(client, time.Hour)
+	reading := &Measurement{DeviceID: "device-1", Timestamp: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)}
+	server.Set(readingKey(reading), "1")
+
+	duplicate, err := dedup.Seen(ctx, "m-1", true, reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !duplicate {
+		t.Fatal("a reading stored by an older consumer was taken over")
+	}
+}
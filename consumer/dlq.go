@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	measurementsDLQ = "measurements.dlq"
+
+	// defaultPrefetch keeps two default batches in flight
+	defaultPrefetch     = 1000
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = 30 * time.Second
+
+	// Headers added to dead-lettered messages
+	dlqReasonHeader     = "x-dlq-reason"
+	dlqAttemptsHeader   = "x-dlq-attempts"
+	dlqFailedAtHeader   = "x-dlq-failed-at"
+	dlqRoutingKeyHeader = "x-dlq-routing-key"
+	dlqRedrivesHeader   = "x-dlq-redrives"
+)
+
+// RetryPolicy decides how patiently a failed Influx write is retried. Writes
+// are retried until InfluxDB is back, only points it rejects are
+// dead-lettered.
+type RetryPolicy struct {
+	Backoff time.Duration
+}
+
+// retryPolicyFromEnv reads MEASUREMENT_RETRY_BACKOFF.
+func retryPolicyFromEnv() RetryPolicy {
+	policy := RetryPolicy{
+		Backoff: defaultRetryBackoff,
+	}
+	if value := os.Getenv("MEASUREMENT_RETRY_BACKOFF"); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			log.Printf("Invalid MEASUREMENT_RETRY_BACKOFF %q, using %s", value, defaultRetryBackoff)
+		} else {
+			policy.Backoff = backoff
+		}
+	}
+	return policy
+}
+
+// delay is the wait before the given retry, doubling up to maxRetryBackoff.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// dlqPublisher is the part of *amqp.Channel dead-lettering uses.
+type dlqPublisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// deadLetter moves a delivery to measurements.dlq, keeping its body, id and
+// headers and recording why it failed.
+func (c *Consumer) deadLetter(ctx context.Context, msg amqp.Delivery, reason error, attempts int) error {
+	channel, err := c.brokerChannel()
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", measurementsDLQ, err)
+	}
+	return publishDeadLetter(ctx, channel, msg, reason, attempts)
+}
+
+func publishDeadLetter(ctx context.Context, channel dlqPublisher, msg amqp.Delivery, reason error, attempts int) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[dlqReasonHeader] = reason.Error()
+	headers[dlqAttemptsHeader] = int32(attempts)
+	headers[dlqFailedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+	headers[dlqRoutingKeyHeader] = msg.RoutingKey
+
+	err := channel.PublishWithContext(ctx,
+		"",
+		measurementsDLQ,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  msg.ContentType,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    msg.MessageId,
+			Timestamp:    msg.Timestamp,
+			Headers:      headers,
+			Body:         msg.Body,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", measurementsDLQ, err)
+	}
+	log.Printf("Dead-lettered measurement %s from %s: %v", msg.MessageId, msg.RoutingKey, reason)
+	return nil
+}
+
+type dlqEntry struct {
+	MessageID  string
+	RoutingKey string
+	Reason     string
+	Attempts   interface{}
+	FailedAt   string
+	Redrives   interface{}
+	Body       string
+}
+
+// runDLQ implements the dlq subcommand for inspecting and re-driving
+// measurements.dlq:
+//
+//	measurement-consumer dlq list [-limit n]
+//	measurement-consumer dlq redrive [-limit n]
+func runDLQ(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "redrive") {
+		log.Fatal("usage: dlq list|redrive [-limit n]")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("dlq "+command, flag.ExitOnError)
+	limit := flags.Int("limit", 0, "handle at most this many messages, 0 handles all")
+	flags.Parse(args[1:])
+
+	amqpURI := os.Getenv("AMQP_URI")
+	if amqpURI == "" {
+		log.Fatal("AMQP_URI is required!")
+	}
+	conn, err := amqp.Dial(amqpURI)
+	if err != nil {
+		log.Fatalf("failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		log.Fatalf("failed to open channel: %v", err)
+	}
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclarePassive(measurementsDLQ, true, false, false, false, nil)
+	if err != nil {
+		log.Fatalf("failed to inspect %s: %v", measurementsDLQ, err)
+	}
+	count := queue.Messages
+	if *limit > 0 && *limit < count {
+		count = *limit
+	}
+
+	switch command {
+	case "list":
+		err = listDLQ(channel, count)
+	case "redrive":
+		err = redriveDLQ(channel, count)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listDLQ prints the first count messages as JSON lines. The messages stay
+// unacknowledged and return to the queue when the channel closes.
+func listDLQ(channel *amqp.Channel, count int) error {
+	encoder := json.NewEncoder(os.Stdout)
+	for i := 0; i < count; i++ {
+		msg, ok, err := channel.Get(measurementsDLQ, false)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", measurementsDLQ, err)
+		}
+		if !ok {
+			break
+		}
+		reason, _ := msg.Headers[dlqReasonHeader].(string)
+		failedAt, _ := msg.Headers[dlqFailedAtHeader].(string)
+		routingKey, _ := msg.Headers[dlqRoutingKeyHeader].(string)
+		encoder.Encode(dlqEntry{
+			MessageID:  msg.MessageId,
+			RoutingKey: routingKey,
+			Reason:     reason,
+			Attempts:   msg.Headers[dlqAttemptsHeader],
+			FailedAt:   failedAt,
+			Redrives:   msg.Headers[dlqRedrivesHeader],
+			Body:       string(msg.Body),
+		})
+	}
+	return nil
+}
+
+// redriveDLQ publishes messages back to the exchange with their original
+// routing key and removes each one from the DLQ once the broker confirmed it.
+func redriveDLQ(channel *amqp.Channel, count int) error {
+	if err := channel.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	redriven := 0
+	for i := 0; i < count; i++ {
+		msg, ok, err := channel.Get(measurementsDLQ, false)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", measurementsDLQ, err)
+		}
+		if !ok {
+			break
+		}
+		routingKey, _ := msg.Headers[dlqRoutingKeyHeader].(string)
+		if routingKey == "" {
+			log.Printf("Leaving message %s in %s, it has no original routing key", msg.MessageId, measurementsDLQ)
+			msg.Nack(false, true)
+			continue
+		}
+
+		headers := amqp.Table{}
+		for key, value := range msg.Headers {
+			headers[key] = value
+		}
+		redrives, _ := msg.Headers[dlqRedrivesHeader].(int32)
+		headers[dlqRedrivesHeader] = redrives + 1
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx,
+			exchangeName,
+			routingKey,
+			false,
+			false,
+			amqp.Publishing{
+				ContentType:  msg.ContentType,
+				DeliveryMode: amqp.Persistent,
+				MessageId:    msg.MessageId,
+				Timestamp:    msg.Timestamp,
+				Headers:      headers,
+				Body:         msg.Body,
+			})
+		if err == nil {
+			var acked bool
+			acked, err = confirmation.WaitContext(ctx)
+			if err == nil && !acked {
+				err = fmt.Errorf("broker rejected the message")
+			}
+		}
+		cancel()
+		if err != nil {
+			msg.Nack(false, true)
+			return fmt.Errorf("failed to re-drive message %s after %d re-driven: %v", msg.MessageId, redriven, err)
+		}
+		if err := msg.Ack(false); err != nil {
+			return fmt.Errorf("failed to remove message %s from %s: %v", msg.MessageId, measurementsDLQ, err)
+		}
+		redriven++
+	}
+	log.Printf("Re-drove %d messages from %s", redriven, measurementsDLQ)
+	return nil
+}
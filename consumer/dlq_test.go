@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeDLQ records what is published to the dead-letter queue.
+type fakeDLQ struct {
+	mu        sync.Mutex
+	published []amqp.Publishing
+}
+
+func (q *fakeDLQ) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if exchange != "" || key != measurementsDLQ {
+		return fmt.Errorf("published to %q %q instead of the DLQ", exchange, key)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func TestPoisonMeasurementReachesDLQ(t *testing.T) {
+	poison := testPoint(3)
+	influx := &fakeInflux{reject: poison}
+	// InfluxDB is down for the first two attempts of the batch
+	influx.outage.Store(2)
+	writer := NewBatchWriter(influx, 5, time.Hour, 10, RetryPolicy{Backoff: time.Millisecond})
+	dlq := &fakeDLQ{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		point := testPoint(i)
+		if i == 3 {
+			point = poison
+		}
+		msg := amqp.Delivery{
+			MessageId:  "measurement-" + strconv.Itoa(i),
+			RoutingKey: "measurement.Novi Sad",
+			Headers:    amqp.Table{"seq": strconv.Itoa(i)},
+			Body:       []byte(fmt.Sprintf(`{"Value":%d}`, i)),
+		}
+		wg.Add(1)
+		writer.Write(context.Background(), []*write.Point{point}, func(attempts int, err error) {
+			defer wg.Done()
+			if err != nil {
+				publishDeadLetter(context.Background(), dlq, msg, fmt.Errorf("failed to write measurement to InfluxDB: %v", err), attempts)
+			}
+		})
+	}
+	wg.Wait()
+	writer.Close()
+
+	if len(dlq.published) != 1 {
+		t.Fatalf("%d messages dead-lettered, want only the poison one", len(dlq.published))
+	}
+	dead := dlq.published[0]
+	if dead.MessageId != "measurement-3" || string(dead.Body) != `{"Value":3}` || dead.DeliveryMode != amqp.Persistent {
+		t.Fatalf("dead-lettered %s %s, want measurement-3 kept as it was", dead.MessageId, dead.Body)
+	}
+	// Three attempts of the batch, the last one rejected, and one on its own
+	if attempts := dead.Headers[dlqAttemptsHeader]; attempts != int32(4) {
+		t.Errorf("attempts header = %v, want 4", attempts)
+	}
+	if reason, _ := dead.Headers[dlqReasonHeader].(string); !strings.Contains(reason, "field type conflict") {
+		t.Errorf("reason header = %q, want the InfluxDB rejection", reason)
+	}
+	if dead.Headers[dlqRoutingKeyHeader] != "measurement.Novi Sad" || dead.Headers["seq"] != "3" {
+		t.Errorf("headers %v lost the routing key or the original headers", dead.Headers)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheckTimeout bounds every dependency check of a probe
+const healthCheckTimeout = 2 * time.Second
+
+// healthReport is the body of /healthz and /readyz, Checks maps every
+// dependency to "ok" or the reason it is unreachable.
+type healthReport struct {
+	Status string
+	Checks map[string]string
+}
+
+// checkDependencies pings the broker, Redis, PostgreSQL and InfluxDB
+// concurrently and reports whether all of them are reachable.
+func (c *Consumer) checkDependencies(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"broker": func(context.Context) error {
+			if state := c.broker.State(); state != ConnReady {
+				return errors.New(string(state))
+			}
+			return nil
+		},
+		"redis": func(ctx context.Context) error {
+			return c.redisClient.Ping(ctx).Err()
+		},
+		"postgres": func(ctx context.Context) error {
+			return c.pgDB.PingContext(ctx)
+		},
+		"influx": func(ctx context.Context) error {
+			ok, err := c.influxClient.Ping(ctx)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("not ready")
+			}
+			return nil
+		},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]string, len(checks))
+	healthy := true
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			err := check(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				results[name] = err.Error()
+				healthy = false
+				return
+			}
+			results[name] = "ok"
+		}(name, check)
+	}
+	wg.Wait()
+	return results, healthy
+}
+
+func writeHealth(w http.ResponseWriter, status int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// runningConsumer answers the probe itself and returns nil while the
+// consumer is starting or shutting down.
+func runningConsumer(w http.ResponseWriter, consumer *atomic.Pointer[Consumer]) *Consumer {
+	c := consumer.Load()
+	if c == nil {
+		writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "starting"})
+		return nil
+	}
+	if c.stopping.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "shutting down"})
+		return nil
+	}
+	return c
+}
+
+// healthzHandler serves /healthz. It fails only while the consumer is not
+// running, an unreachable dependency is reported but does not fail the
+// probe, the consumer reconnects by itself and restarting it would not help.
+func healthzHandler(consumer *atomic.Pointer[Consumer]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := runningConsumer(w, consumer)
+		if c == nil {
+			return
+		}
+		checks, healthy := c.checkDependencies(r.Context())
+		status := "ok"
+		if !healthy {
+			status = "degraded"
+		}
+		writeHealth(w, http.StatusOK, healthReport{Status: status, Checks: checks})
+	}
+}
+
+// readyzHandler serves /readyz, which fails unless every dependency is
+// reachable.
+func readyzHandler(consumer *atomic.Pointer[Consumer]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := runningConsumer(w, consumer)
+		if c == nil {
+			return
+		}
+		checks, healthy := c.checkDependencies(r.Context())
+		if !healthy {
+			writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "unavailable", Checks: checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthReport{Status: "ok", Checks: checks})
+	}
+}
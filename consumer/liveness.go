@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// deadlineKey scores every tracked device by the time it goes offline
+	// without another heartbeat, in unix milliseconds. Scoring by deadline
+	// instead of last heartbeat lets every city use its own threshold.
+	deadlineKey = "liveness:deadline"
+	// onlineKey holds the devices currently reported online
+	onlineKey = "liveness:online"
+	// streakKey counts heartbeats of devices on their way back online
+	streakKey = "liveness:streak"
+	// flappingKey scores flapping devices by their last transition
+	flappingKey = "liveness:flapping"
+	// deviceCityKey maps devices to their city, heartbeats do not carry it
+	deviceCityKey          = "liveness:city"
+	transitionsKeyPrefix   = "liveness:transitions:"
+	livenessScanBatch      = 500
+	defaultLivenessScan    = 5 * time.Second
+	defaultHeartbeatPeriod = 5 * time.Second
+)
+
+// Device states recorded in Postgres and InfluxDB.
+const (
+	StateOnline   = "online"
+	StateOffline  = "offline"
+	StateFlapping = "flapping"
+)
+
+// LivenessConfig holds the thresholds of a deployment or a city. A device
+// goes offline after OfflineAfter missed heartbeats and comes back after
+// OnlineAfter heartbeats in a row. FlapTransitions transitions within
+// FlapWindow mark it flapping, which holds back further transitions until it
+// was stable for a whole window.
+type LivenessConfig struct {
+	HeartbeatPeriod Duration
+	OfflineAfter    int
+	OnlineAfter     int
+	FlapTransitions int
+	FlapWindow      Duration
+}
+
+// Duration reads durations like "5s" from the liveness config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// OfflineThreshold is how long a device may stay silent.
+func (l LivenessConfig) OfflineThreshold() time.Duration {
+	return time.Duration(l.HeartbeatPeriod) * time.Duration(l.OfflineAfter)
+}
+
+// merge fills the unset fields of an override from the defaults.
+func (l LivenessConfig) merge(defaults LivenessConfig) LivenessConfig {
+	if l.HeartbeatPeriod <= 0 {
+		l.HeartbeatPeriod = defaults.HeartbeatPeriod
+	}
+	if l.OfflineAfter <= 0 {
+		l.OfflineAfter = defaults.OfflineAfter
+	}
+	if l.OnlineAfter <= 0 {
+		l.OnlineAfter = defaults.OnlineAfter
+	}
+	if l.FlapTransitions <= 0 {
+		l.FlapTransitions = defaults.FlapTransitions
+	}
+	if l.FlapWindow <= 0 {
+		l.FlapWindow = defaults.FlapWindow
+	}
+	return l
+}
+
+// LivenessSettings are the deployment defaults and per-city overrides.
+type LivenessSettings struct {
+	ScanInterval Duration
+	Default      LivenessConfig
+	Cities       map[string]LivenessConfig
+}
+
+// defaultLivenessSettings keep the original 30 second threshold and report
+// a device online with its first heartbeat.
+func defaultLivenessSettings() LivenessSettings {
+	return LivenessSettings{
+		ScanInterval: Duration(defaultLivenessScan),
+		Default: LivenessConfig{
+			HeartbeatPeriod: Duration(defaultHeartbeatPeriod),
+			OfflineAfter:    6,
+			OnlineAfter:     1,
+			FlapTransitions: 6,
+			FlapWindow:      Duration(10 * time.Minute),
+		},
+	}
+}
+
+// livenessSettingsFromEnv starts from the defaults, applies LIVENESS_CONFIG
+// (a JSON file with ScanInterval, Default and Cities) and then the
+// LIVENESS_* variables for the deployment defaults.
+func livenessSettingsFromEnv() (LivenessSettings, error) {
+	settings := defaultLivenessSettings()
+	if filename := os.Getenv("LIVENESS_CONFIG"); filename != "" {
+		fileData, err := os.ReadFile(filename)
+		if err != nil {
+			return settings, fmt.Errorf("could not read liveness config: %w", err)
+		}
+		var loaded LivenessSettings
+		if err := json.Unmarshal(fileData, &loaded); err != nil {
+			return settings, fmt.Errorf("could not unmarshal liveness config: %w", err)
+		}
+		if loaded.ScanInterval > 0 {
+			settings.ScanInterval = loaded.ScanInterval
+		}
+		settings.Default = loaded.Default.merge(settings.Default)
+		settings.Cities = loaded.Cities
+	}
+
+	durations := map[string]*Duration{
+		"LIVENESS_SCAN_INTERVAL":    &settings.ScanInterval,
+		"LIVENESS_HEARTBEAT_PERIOD": &settings.Default.HeartbeatPeriod,
+		"LIVENESS_FLAP_WINDOW":      &settings.Default.FlapWindow,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return settings, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*target = Duration(parsed)
+		}
+	}
+	settings.Default.OfflineAfter = envInt("LIVENESS_OFFLINE_AFTER", settings.Default.OfflineAfter)
+	settings.Default.OnlineAfter = envInt("LIVENESS_ONLINE_AFTER", settings.Default.OnlineAfter)
+	settings.Default.FlapTransitions = envInt("LIVENESS_FLAP_TRANSITIONS", settings.Default.FlapTransitions)
+
+	for city, config := range settings.Cities {
+		settings.Cities[city] = config.merge(settings.Default)
+	}
+	return settings, nil
+}
+
+// forCity returns the thresholds of a city, the defaults when it has none.
+func (s LivenessSettings) forCity(city string) LivenessConfig {
+	if config, ok := s.Cities[city]; ok {
+		return config
+	}
+	return s.Default
+}
+
+// seenScript records a heartbeat. A device that is not online has to reach
+// ARGV[3] heartbeats in a row first, the streak is dropped when it misses
+// its deadline. Returns 1 when the device just came online.
+var seenScript = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+if redis.call("SISMEMBER", KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+if redis.call("HINCRBY", KEYS[3], ARGV[1], 1) < tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("SADD", KEYS[2], ARGV[1])
+return 1
+`)
+
+// staleScript drops up to ARGV[2] devices whose deadline passed before
+// ARGV[1] and returns the ones that were online. Running as one script keeps
+// a heartbeat from slipping in between the range query and the removal.
+var staleScript = redis.NewScript(`
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+local offline = {}
+for _, device in ipairs(stale) do
+	redis.call("ZREM", KEYS[1], device)
+	redis.call("HDEL", KEYS[3], device)
+	if redis.call("SREM", KEYS[2], device) == 1 then
+		table.insert(offline, device)
+	end
+end
+return offline
+`)
+
+// transitionScript records a transition at ARGV[2]. Returns 0 for a stable
+// device, 1 when it starts flapping and 2 while it keeps flapping.
+var transitionScript = redis.NewScript(`
+redis.call("LPUSH", KEYS[1], ARGV[2])
+redis.call("LTRIM", KEYS[1], 0, ARGV[3] - 1)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+if redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+	return 2
+end
+if redis.call("LLEN", KEYS[1]) < tonumber(ARGV[3]) then
+	return 0
+end
+local oldest = tonumber(redis.call("LINDEX", KEYS[1], -1))
+if tonumber(ARGV[2]) - oldest <= tonumber(ARGV[4]) then
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// settledScript removes device ARGV[1] from the flapping set unless it had
+// a transition after ARGV[2], returns 1 when it was removed.
+var settledScript = redis.NewScript(`
+local last = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if last and tonumber(last) <= tonumber(ARGV[2]) then
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// LivenessTracker replaces scanning every heartbeat key. A heartbeat only
+// touches its own device, and the periodic check reads the devices that
+// crossed their deadline straight from the sorted set.
+type LivenessTracker struct {
+	redisClient *redis.Client
+	settings    LivenessSettings
+	// cities caches the city of every device seen in a measurement, so the
+	// Redis mapping is only written when it changes
+	cities map[string]string
+	mu     sync.Mutex
+}
+
+func NewLivenessTracker(redisClient *redis.Client, settings LivenessSettings) *LivenessTracker {
+	return &LivenessTracker{
+		redisClient: redisClient,
+		settings:    settings,
+		cities:      make(map[string]string),
+	}
+}
+
+// SetCity remembers the city of a device for its thresholds.
+func (t *LivenessTracker) SetCity(ctx context.Context, deviceID string, city string) {
+	t.mu.Lock()
+	known := t.cities[deviceID] == city
+	t.cities[deviceID] = city
+	t.mu.Unlock()
+	if known {
+		return
+	}
+	if err := t.redisClient.HSet(ctx, deviceCityKey, deviceID, city).Err(); err != nil {
+		log.Printf("Failed to save city of device %s: %v", deviceID, err)
+	}
+}
+
+// config returns the thresholds of the device's city.
+func (t *LivenessTracker) config(ctx context.Context, deviceID string) LivenessConfig {
+	if len(t.settings.Cities) == 0 {
+		return t.settings.Default
+	}
+	t.mu.Lock()
+	city, ok := t.cities[deviceID]
+	t.mu.Unlock()
+	if !ok {
+		var err error
+		city, err = t.redisClient.HGet(ctx, deviceCityKey, deviceID).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("Failed to load city of device %s: %v", deviceID, err)
+		}
+		if err == nil {
+			t.mu.Lock()
+			t.cities[deviceID] = city
+			t.mu.Unlock()
+		}
+	}
+	return t.settings.forCity(city)
+}
+
+// Seen records a heartbeat and reports whether the device just came online,
+// which includes devices never seen before.
+func (t *LivenessTracker) Seen(ctx context.Context, deviceID string, lastSeen time.Time) (bool, error) {
+	config := t.config(ctx, deviceID)
+	deadline := lastSeen.Add(config.OfflineThreshold())
+	if !deadline.After(time.Now()) {
+		// A late heartbeat does not make the device alive
+		return false, nil
+	}
+	added, err := seenScript.Run(ctx, t.redisClient, []string{deadlineKey, onlineKey, streakKey},
+		deviceID, deadline.UnixMilli(), config.OnlineAfter).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to record heartbeat of device %s: %v", deviceID, err)
+	}
+	return added == 1, nil
+}
+
+// Expired returns the devices that missed their deadline and were online
+// until now. They stop being tracked until their next heartbeat.
+func (t *LivenessTracker) Expired(ctx context.Context, now time.Time) ([]string, error) {
+	cutoff := now.UnixMilli()
+	var offline []string
+	for {
+		devices, err := staleScript.Run(ctx, t.redisClient, []string{deadlineKey, onlineKey, streakKey}, cutoff, livenessScanBatch).StringSlice()
+		if err != nil {
+			return offline, fmt.Errorf("failed to expire devices: %v", err)
+		}
+		offline = append(offline, devices...)
+		// A batch returns fewer devices than it removed when some were
+		// already offline, so only an empty range ends the scan
+		count, err := t.redisClient.ZCount(ctx, deadlineKey, "-inf", fmt.Sprint(cutoff)).Result()
+		if err != nil {
+			return offline, fmt.Errorf("failed to count stale devices: %v", err)
+		}
+		if count == 0 {
+			return offline, nil
+		}
+	}
+}
+
+// Transition records a status change and returns the state to report, or
+// an empty state when the change is held back because the device flaps.
+func (t *LivenessTracker) Transition(ctx context.Context, deviceID string, online bool, now time.Time) (string, error) {
+	config := t.config(ctx, deviceID)
+	result, err := transitionScript.Run(ctx, t.redisClient, []string{transitionsKeyPrefix + deviceID, flappingKey},
+		deviceID, now.UnixMilli(), config.FlapTransitions, time.Duration(config.FlapWindow).Milliseconds()).Int()
+	if err != nil {
+		return "", fmt.Errorf("failed to record transition of device %s: %v", deviceID, err)
+	}
+	switch result {
+	case 1:
+		return StateFlapping, nil
+	case 2:
+		return "", nil
+	}
+	if online {
+		return StateOnline, nil
+	}
+	return StateOffline, nil
+}
+
+// Settled returns flapping devices without a transition for a whole window
+// together with whether they are online now.
+func (t *LivenessTracker) Settled(ctx context.Context, now time.Time) (map[string]bool, error) {
+	// The shortest window bounds the query, longer windows are checked below
+	window := t.settings.Default.FlapWindow
+	for _, config := range t.settings.Cities {
+		window = min(window, config.FlapWindow)
+	}
+	devices, err := t.redisClient.ZRangeByScoreWithScores(ctx, flappingKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(now.Add(-time.Duration(window)).UnixMilli()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flapping devices: %v", err)
+	}
+
+	settled := make(map[string]bool)
+	for _, device := range devices {
+		deviceID := device.Member.(string)
+		config := t.config(ctx, deviceID)
+		cutoff := now.Add(-time.Duration(config.FlapWindow)).UnixMilli()
+		if int64(device.Score) > cutoff {
+			continue
+		}
+		removed, err := settledScript.Run(ctx, t.redisClient, []string{flappingKey}, deviceID, cutoff).Int()
+		if err != nil {
+			return settled, fmt.Errorf("failed to settle device %s: %v", deviceID, err)
+		}
+		if removed == 0 {
+			continue
+		}
+		online, err := t.redisClient.SIsMember(ctx, onlineKey, deviceID).Result()
+		if err != nil {
+			return settled, fmt.Errorf("failed to read status of device %s: %v", deviceID, err)
+		}
+		settled[deviceID] = online
+	}
+	return settled, nil
+}
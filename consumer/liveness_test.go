@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testLivenessSettings = LivenessSettings{
+	ScanInterval: Duration(time.Second),
+	Default: LivenessConfig{
+		HeartbeatPeriod: Duration(5 * time.Second),
+		OfflineAfter:    6,
+		OnlineAfter:     2,
+		FlapTransitions: 4,
+		FlapWindow:      Duration(10 * time.Minute),
+	},
+}
+
+func TestLivenessExpiresSilentDevices(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	tracker := NewLivenessTracker(client, testLivenessSettings)
+	now := time.Now()
+	threshold := testLivenessSettings.Default.OfflineThreshold()
+
+	steps := []struct {
+		name   string
+		device string
+		at     time.Time
+		online bool
+	}{
+		{"first heartbeat", "device-1", now, false},
+		{"second heartbeat in a row", "device-1", now.Add(5 * time.Second), true},
+		{"already online", "device-1", now.Add(10 * time.Second), false},
+		{"other device", "device-2", now, false},
+		// A heartbeat past its deadline does not count
+		{"late heartbeat", "device-3", now.Add(-threshold), false},
+	}
+	for _, step := range steps {
+		online, err := tracker.Seen(ctx, step.device, step.at)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if online != step.online {
+			t.Fatalf("%s: came online = %v, want %v", step.name, online, step.online)
+		}
+	}
+
+	expired, err := tracker.Expired(ctx, now.Add(threshold+5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("expired %v before the last deadline of device-1", expired)
+	}
+	expired, err = tracker.Expired(ctx, now.Add(threshold+10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// device-2 never came online, it only drops its streak
+	if !slices.Equal(expired, []string{"device-1"}) {
+		t.Fatalf("expired %v, want [device-1]", expired)
+	}
+	if streak, _ := client.HGet(ctx, streakKey, "device-2").Result(); streak != "" {
+		t.Fatalf("streak of an expired device kept at %s", streak)
+	}
+
+	// Back after the outage it needs a full streak again
+	for i, want := range []bool{false, true} {
+		online, err := tracker.Seen(ctx, "device-1", time.Now().Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if online != want {
+			t.Fatalf("heartbeat %d after expiry came online = %v, want %v", i+1, online, want)
+		}
+	}
+}
+
+func TestLivenessFlappingDeviceSettles(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	settings := testLivenessSettings
+	// Subotica devices settle after a shorter window
+	settings.Cities = map[string]LivenessConfig{
+		"Subotica": LivenessConfig{FlapWindow: Duration(2 * time.Minute)}.merge(settings.Default),
+	}
+	tracker := NewLivenessTracker(client, settings)
+	tracker.SetCity(ctx, "device-2", "Subotica")
+	start := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	// Four transitions within the window, the fourth marks it flapping and
+	// later ones are held back
+	want := []string{StateOffline, StateOnline, StateOffline, StateFlapping, "", ""}
+	for i, state := range want {
+		for _, device := range []string{"device-1", "device-2"} {
+			reported, err := tracker.Transition(ctx, device, i%2 == 1, start.Add(time.Duration(i)*20*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reported != state {
+				t.Fatalf("transition %d of %s reported %q, want %q", i+1, device, reported, state)
+			}
+		}
+	}
+	last := start.Add(100 * time.Second)
+	client.SAdd(ctx, onlineKey, "device-1")
+
+	steps := []struct {
+		at      time.Time
+		settled map[string]bool
+	}{
+		{last.Add(time.Minute), map[string]bool{}},
+		{last.Add(2 * time.Minute), map[string]bool{"device-2": false}},
+		{last.Add(9 * time.Minute), map[string]bool{}},
+		{last.Add(10 * time.Minute), map[string]bool{"device-1": true}},
+	}
+	for _, step := range steps {
+		settled, err := tracker.Settled(ctx, step.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settled) != len(step.settled) {
+			t.Fatalf("settled at %s: %v, want %v", step.at.Format(time.Kitchen), settled, step.settled)
+		}
+		for device, online := range step.settled {
+			if got, ok := settled[device]; !ok || got != online {
+				t.Fatalf("settled at %s: %v, want %v", step.at.Format(time.Kitchen), settled, step.settled)
+			}
+		}
+	}
+
+	// A settled device is judged afresh
+	reported, err := tracker.Transition(ctx, "device-1", false, last.Add(11*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reported != StateOffline {
+		t.Fatalf("first transition after settling reported %q, want %q", reported, StateOffline)
+	}
+}
@@ -4,18 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	_ "github.com/lib/pq"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/redis/go-redis/v9"
@@ -26,22 +27,42 @@ const (
 	measurementsBucket = "power_measurements"
 	deviceStatusBucket = "device_status"
 	influxOrg          = "watt-flow"
-	redisTTL           = time.Second * 60
-	reconnectDelay     = time.Second * 10
+	// brokerSettleTime is how long heartbeats have to flow again after a
+	// reconnect before devices are marked offline
+	brokerSettleTime = 20 * time.Second
 )
 
 type Consumer struct {
 	influxClient  influxdb2.Client
-	conn          *amqp.Connection
-	channel       *amqp.Channel
+	broker        *BrokerSupervisor
 	pgDB          *sql.DB
 	redisClient   *redis.Client
-	reconnecting  chan bool
 	shutdown      chan struct{}
 	cancelContext context.CancelFunc
 	amqpURI       string
 	wg            sync.WaitGroup
 	wsServer      *WsServer
+	dedup         *Deduplicator
+	liveness      *LivenessTracker
+	outages       *OutageDetector
+	replay        *ReplayBuffer
+	aggregates    *CityAggregator
+	anomalies     *AnomalyDetector
+	shards        ShardConfig
+	leader        *LeaderElector
+	balancer      *ShardBalancer
+	registers     *pendingRegisters
+	writer        *BatchWriter
+	followUps     *WorkerPool
+	prefetch      int
+	stats         ConsumerStats
+	// stopping is read by the health probes
+	stopping atomic.Bool
+	// The supervisor hands the delivery channels of every new session to
+	// the processing goroutines through these
+	measurementFeed chan (<-chan amqp.Delivery)
+	heartbeatFeed   chan (<-chan amqp.Delivery)
+	alertFeed       chan (<-chan amqp.Delivery)
 }
 
 type DeviceStatus struct {
@@ -84,35 +105,144 @@ func NewConsumer(amqpURI, influxURI, influxToken, pgConnStr, redisAddr string, c
 	if err != nil {
 		fmt.Printf("Failed creating table: %v", err)
 	}
+	_, err = pgDB.Exec(`ALTER TABLE device_status ADD COLUMN IF NOT EXISTS state TEXT`)
+	if err != nil {
+		fmt.Printf("Failed adding state column: %v", err)
+	}
+	// The outages table is migrated by the server, outages only open once
+	// it ran
+
+	shards, err := shardConfigFromEnv()
+	if err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+	liveness, err := livenessSettingsFromEnv()
+	if err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+	outages, err := outageConfigFromEnv()
+	if err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+	anomalies, err := anomalyConfigFromEnv()
+	if err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+	retry := retryPolicyFromEnv()
+	writer := batchWriterFromEnv(influxClient.WriteAPIBlocking(influxOrg, measurementsBucket), retry)
+	prefetch := envInt("CONSUMER_PREFETCH", defaultPrefetch)
+	if prefetch < writer.batchSize {
+		log.Printf("CONSUMER_PREFETCH %d is below the batch size %d, batches will be flushed by time", prefetch, writer.batchSize)
+	}
+
+	replay := replayBufferFromEnv(redisClient)
+	wsServer.replay.Store(replay)
 
-	return &Consumer{
+	c := &Consumer{
 		shutdown:      make(chan struct{}),
-		reconnecting:  make(chan bool),
 		amqpURI:       amqpURI,
 		influxClient:  influxClient,
 		pgDB:          pgDB,
 		redisClient:   redisClient,
 		cancelContext: cancelFunc,
 		wsServer:      wsServer,
-	}, nil
+		dedup:         NewDeduplicator(redisClient, dedupTTLFromEnv()),
+		liveness:      NewLivenessTracker(redisClient, liveness),
+		outages:       NewOutageDetector(redisClient, pgDB, outages),
+		replay:        replay,
+		aggregates:    NewCityAggregator(redisClient, influxClient),
+		anomalies:     NewAnomalyDetector(redisClient, influxClient.WriteAPI(influxOrg, measurementsBucket), anomalies),
+		shards:        shards,
+		leader:        NewLeaderElector(redisClient, shards),
+		balancer:      NewShardBalancer(redisClient, shards),
+		registers:     newPendingRegisters(),
+		writer:        writer,
+		followUps:     followUpPoolFromEnv(),
+		prefetch:      prefetch,
+		// Buffered so the supervisor never waits for a busy processor
+		measurementFeed: make(chan (<-chan amqp.Delivery), 1),
+		heartbeatFeed:   make(chan (<-chan amqp.Delivery), 1),
+		alertFeed:       make(chan (<-chan amqp.Delivery), 1),
+	}
+	c.broker = NewBrokerSupervisor(c.dialBroker, c.setupBroker, reconnectPolicyFromEnv())
+	return c, nil
 }
 
-func (c *Consumer) ConnectToBroker() error {
-	conn, err := amqp.Dial(c.amqpURI)
+func (c *Consumer) dialBroker() (brokerSession, error) {
+	session, err := dialAMQP(c.amqpURI)
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		return nil, err
+	}
+	return session, nil
+}
+
+// setupBroker declares the topology on a new session and hands fresh
+// delivery channels to the processing goroutines.
+func (c *Consumer) setupBroker(session brokerSession) error {
+	channel := session.(*amqpSession).channel
+	if err := c.declareTopology(channel); err != nil {
+		return err
 	}
 
-	channel, err := conn.Channel()
+	measurementMsgs, err := c.consumeMeasurements(channel)
 	if err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to open channel: %v", err)
+		return err
 	}
+	heartbeatMsgs, err := channel.Consume(
+		"heartbeats_queue",
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start heartbeat consumer: %v", err)
+	}
+	alertMsgs, err := channel.Consume(
+		alertsQueue,
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start alert consumer: %v", err)
+	}
+	replaceFeed(c.measurementFeed, measurementMsgs)
+	replaceFeed(c.heartbeatFeed, heartbeatMsgs)
+	replaceFeed(c.alertFeed, alertMsgs)
+	return nil
+}
+
+// replaceFeed hands over the deliveries of a new session, dropping those of
+// an older one the processor did not pick up yet.
+func replaceFeed(feed chan (<-chan amqp.Delivery), msgs <-chan amqp.Delivery) {
+	select {
+	case <-feed:
+	default:
+	}
+	feed <- msgs
+}
 
-	c.conn = conn
-	c.channel = channel
+// brokerChannel returns the channel of the current session.
+func (c *Consumer) brokerChannel() (*amqp.Channel, error) {
+	session, ok := c.broker.Session().(*amqpSession)
+	if !ok {
+		return nil, errBrokerDown
+	}
+	return session.channel, nil
+}
 
-	err = c.channel.ExchangeDeclare(
+func (c *Consumer) declareTopology(channel *amqp.Channel) error {
+	err := channel.ExchangeDeclare(
 		exchangeName,
 		"topic",
 		true,
@@ -125,9 +255,13 @@ func (c *Consumer) ConnectToBroker() error {
 		return fmt.Errorf("failed to declare exchange: %v", err)
 	}
 
-	// Setup measurement queue
-	measurementQueue, err := c.channel.QueueDeclare(
-		"measurements_queue",
+	if err := channel.Qos(c.prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %v", err)
+	}
+
+	// Measurements that cannot be stored end up here, see the dlq subcommand
+	_, err = channel.QueueDeclare(
+		measurementsDLQ,
 		true,
 		false,
 		false,
@@ -135,22 +269,41 @@ func (c *Consumer) ConnectToBroker() error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare measurement queue: %v", err)
+		return fmt.Errorf("failed to declare dead-letter queue: %v", err)
 	}
 
-	err = c.channel.QueueBind(
-		measurementQueue.Name,
-		"measurement.*",
-		exchangeName,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to bind measurement queue: %v", err)
+	if c.shards.Clustered() {
+		if err := c.declareShardQueues(channel); err != nil {
+			return err
+		}
+	} else {
+		// Setup measurement queue
+		measurementQueue, err := channel.QueueDeclare(
+			"measurements_queue",
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare measurement queue: %v", err)
+		}
+
+		err = channel.QueueBind(
+			measurementQueue.Name,
+			"measurement.*",
+			exchangeName,
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind measurement queue: %v", err)
+		}
 	}
 
 	// Setup heartbeat queue
-	heartbeatQueue, err := c.channel.QueueDeclare(
+	heartbeatQueue, err := channel.QueueDeclare(
 		"heartbeats_queue",
 		false,
 		true,
@@ -162,7 +315,7 @@ func (c *Consumer) ConnectToBroker() error {
 		return fmt.Errorf("failed to declare heartbeat queue: %v", err)
 	}
 
-	err = c.channel.QueueBind(
+	err = channel.QueueBind(
 		heartbeatQueue.Name,
 		"heartbeat.*",
 		exchangeName,
@@ -173,27 +326,9 @@ func (c *Consumer) ConnectToBroker() error {
 		return fmt.Errorf("failed to bind heartbeat queue: %v", err)
 	}
 
-	fmt.Println("Successfully initialized rabbitmq connection and exchange!")
-	return nil
-}
-
-func (c *Consumer) Start(ctx context.Context) error {
-	measurementMsgs, err := c.channel.Consume(
-		"measurements_queue",
-		"",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to start measurement consumer: %v", err)
-	}
-
-	heartbeatMsgs, err := c.channel.Consume(
-		"heartbeats_queue",
-		"",
+	// Household alerts fired by the server, declared like the server does
+	_, err = channel.QueueDeclare(
+		alertsQueue,
 		true,
 		false,
 		false,
@@ -201,121 +336,238 @@ func (c *Consumer) Start(ctx context.Context) error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to start heartbeat consumer: %v", err)
+		return fmt.Errorf("failed to declare alert queue: %v", err)
 	}
-	c.wg.Add(3)
-	go c.processMeasurements(ctx, measurementMsgs)
-	go c.processHeartbeats(ctx, heartbeatMsgs)
-	go c.updateDeviceStatus(ctx)
 
+	fmt.Println("Successfully initialized rabbitmq connection and exchange!")
 	return nil
 }
 
-func (c *Consumer) processMeasurements(ctx context.Context, msgs <-chan amqp.Delivery) {
+// Start runs the processing goroutines and the broker supervisor, which
+// feeds them deliveries as soon as it is connected.
+func (c *Consumer) Start(ctx context.Context) {
+	c.wg.Add(4)
+	go c.processMeasurements(ctx)
+	go c.processHeartbeats(ctx)
+	go c.processAlerts(ctx)
+	go c.updateDeviceStatus(ctx)
+	go c.broker.Run(ctx)
+	go c.dedup.reportStats(ctx)
+	go c.wsServer.reportStats(ctx)
+	go c.leader.Run(ctx)
+	go c.balancer.Run(ctx)
+	go c.relayBroadcasts(ctx)
+}
+
+func (c *Consumer) processMeasurements(ctx context.Context) {
 	defer c.wg.Done()
-	writeAPI := c.influxClient.WriteAPIBlocking(influxOrg, measurementsBucket)
 
+	var msgs <-chan amqp.Delivery
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg := <-msgs:
-			var measurement Measurement
-			if err := json.Unmarshal(msg.Body, &measurement); err != nil {
-				log.Printf("Failed to unmarshal measurement: %v", err)
+		case msgs = <-c.measurementFeed:
+		case msg, ok := <-msgs:
+			if !ok {
+				// The session is gone, deliveries stop until the supervisor
+				// feeds those of the next one
+				msgs = nil
 				continue
 			}
+			c.stats.Measurements.Add(1)
+			c.handleMeasurement(ctx, msg)
+		}
+	}
+}
 
-			p := influxdb2.NewPoint(
-				"power_consumption",
-				map[string]string{
-					"device_id": measurement.DeviceID,
-					"city":      measurement.Address.City,
-				},
-				map[string]interface{}{
-					"value": measurement.Value,
-				},
-				measurement.Timestamp,
-			)
-
-			if err := writeAPI.WritePoint(ctx, p); err != nil {
-				log.Printf("Failed to write measurement to InfluxDB: %v", err)
-			} else {
-				// log.Printf("Successfully written measurement to InfluxDB")
-			}
+// handleMeasurement queues a delivery for the batch writer, it is only
+// acknowledged once it is in InfluxDB or in the dead-letter queue.
+func (c *Consumer) handleMeasurement(ctx context.Context, msg amqp.Delivery) {
+	var measurement Measurement
+	if err := json.Unmarshal(msg.Body, &measurement); err != nil {
+		log.Printf("Failed to unmarshal measurement: %v", err)
+		c.rejectMeasurement(ctx, msg, fmt.Errorf("failed to unmarshal measurement: %v", err), 1)
+		return
+	}
+	duplicate, err := c.dedup.Seen(ctx, msg.MessageId, msg.Redelivered, &measurement)
+	if err != nil {
+		log.Printf("Failed to check for duplicate measurement: %v", err)
+	} else if duplicate {
+		c.ack(msg)
+		c.balancer.settle(msg)
+		return
+	}
 
-			// Send consumption WebSocket message for device-specific consumption
-			consumptionMsg, err := json.Marshal(Consumption{
-				DeviceId:    measurement.DeviceID,
-				Consumption: measurement.Value,
-			})
-			if err != nil {
-				log.Printf("Failed marshalling consumption to json!", err)
-			} else {
-				c.wsServer.SendMessage(measurement.DeviceID, consumptionMsg, "consumption")
-				log.Printf("Sent realtime consumption data for device %s: %f kWh", measurement.DeviceID, measurement.Value)
-			}
+	readings, register, err := c.intervalReadings(ctx, &measurement)
+	if err != nil {
+		log.Printf("Failed to derive consumption from registers, using the reported value: %v", err)
+		readings = []Measurement{measurement}
+	}
+	if len(readings) == 0 {
+		c.ack(msg)
+		c.balancer.settle(msg)
+		return
+	}
 
-			// Update Redis for city-level consumption aggregation
-			cityKey := "city:" + measurement.Address.City
-			err = c.redisClient.HIncrByFloat(ctx, cityKey, "value", measurement.Value).Err()
-			if err != nil {
-				log.Printf("Failed to update Redis: %v", err)
-			}
-		case <-c.channel.NotifyClose(make(chan *amqp.Error)):
-			log.Println("Connection to RabbitMQ lost. Reconnecting...")
-			if err := c.reconnectBroker(); err != nil {
-				log.Printf("Failed to reconnect to RabbitMQ: %v", err)
-			}
-		}
+	consumption := 0.0
+	points := make([]*write.Point, 0, len(readings))
+	for _, reading := range readings {
+		points = append(points, influxdb2.NewPoint(
+			"power_consumption",
+			map[string]string{
+				"device_id": reading.DeviceID,
+				"city":      reading.Address.City,
+			},
+			reading.Fields(),
+			reading.Timestamp,
+		))
+		consumption += reading.Value
+	}
+
+	err = c.writer.Write(ctx, points, func(attempts int, err error) {
+		c.finishMeasurement(msg, &measurement, readings, register, consumption, attempts, err)
+	})
+	if err != nil {
+		// Shutting down before the writer had room, leave the measurement to
+		// the next consumer
+		c.requeueMeasurement(msg, &measurement, register)
 	}
 }
 
-func debugRedisData(ctx context.Context, redisClient *redis.Client) {
-	keys, err := redisClient.Keys(ctx, "city:*").Result()
+// finishMeasurement runs once the points of a delivery were written or given
+// up on. It is called from the batch writer, possibly after ctx ended, so it
+// only settles the delivery and leaves the rest to the follow-up workers.
+func (c *Consumer) finishMeasurement(msg amqp.Delivery, measurement *Measurement, readings []Measurement, register *registerState, consumption float64, attempts int, err error) {
+	ctx := context.Background()
+	if errors.Is(err, errWriterClosed) {
+		c.requeueMeasurement(msg, measurement, register)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to fetch Redis keys: %v", err)
+		if register != nil {
+			c.registers.release(measurement.DeviceID, register)
+		}
+		if err := c.dedup.Forget(ctx, msg.MessageId, measurement); err != nil {
+			log.Printf("Failed to release dead-lettered measurement: %v", err)
+		}
+		c.rejectMeasurement(ctx, msg, fmt.Errorf("failed to write measurement to InfluxDB: %v", err), attempts)
 		return
 	}
+	c.ack(msg)
+	c.followUps.Submit(measurement.DeviceID, func() {
+		c.followUpMeasurement(msg, measurement, readings, register, consumption)
+	})
+}
 
-	for _, key := range keys {
-		value, err := redisClient.HGetAll(ctx, key).Result()
-		if err != nil {
-			log.Printf("Failed to fetch Redis value for key %s: %v", key, err)
-			continue
+// followUpMeasurement does the work on a stored measurement that does not
+// hold up its acknowledgement. It runs on the follow-up worker of the device,
+// in the order the measurements of the device were stored.
+func (c *Consumer) followUpMeasurement(msg amqp.Delivery, measurement *Measurement, readings []Measurement, register *registerState, consumption float64) {
+	ctx := context.Background()
+	if register != nil {
+		if err := c.commitRegister(ctx, measurement.DeviceID, register); err != nil {
+			log.Printf("Failed to save register: %v", err)
+		}
+	}
+	// The register is committed, the shard may move on to another replica
+	c.balancer.settle(msg)
+	if err := c.dedup.Done(ctx, msg.MessageId, measurement); err != nil {
+		log.Printf("Failed to record stored measurement: %v", err)
+	}
+	c.liveness.SetCity(ctx, measurement.DeviceID, measurement.Address.City)
+	c.outages.SetLocation(ctx, measurement.DeviceID, measurement.Address)
+
+	// Send consumption WebSocket message for device-specific consumption
+	consumptionMsg, err := json.Marshal(Consumption{
+		DeviceId:    measurement.DeviceID,
+		Consumption: consumption,
+	})
+	if err != nil {
+		log.Printf("Failed marshalling consumption to json: %v", err)
+	} else {
+		c.broadcast(measurement.DeviceID, consumptionMsg, connTypeConsumption)
+		log.Printf("Sent realtime consumption data for device %s: %f kWh", measurement.DeviceID, consumption)
+	}
+
+	// The city aggregates of these windows are recomputed by the next pass
+	if err := c.aggregates.MarkDirty(ctx, readings); err != nil {
+		log.Printf("Failed to mark city aggregates: %v", err)
+	}
+	c.checkAnomalies(ctx, readings)
+}
+
+// requeueMeasurement hands a delivery back to the broker untouched.
+func (c *Consumer) requeueMeasurement(msg amqp.Delivery, measurement *Measurement, register *registerState) {
+	if register != nil {
+		c.registers.release(measurement.DeviceID, register)
+	}
+	if err := c.dedup.Forget(context.Background(), msg.MessageId, measurement); err != nil {
+		log.Printf("Failed to release requeued measurement: %v", err)
+	}
+	if err := msg.Nack(false, true); err != nil {
+		log.Printf("Failed to requeue measurement: %v", err)
+	}
+	c.balancer.settle(msg)
+}
+
+// rejectMeasurement moves a poison message to the dead-letter queue. When
+// that fails too the message is requeued rather than lost.
+func (c *Consumer) rejectMeasurement(ctx context.Context, msg amqp.Delivery, reason error, attempts int) {
+	defer c.balancer.settle(msg)
+	if err := c.deadLetter(ctx, msg, reason, attempts); err != nil {
+		log.Printf("Failed to dead-letter measurement: %v", err)
+		if err := msg.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue measurement: %v", err)
 		}
+		return
+	}
+	c.ack(msg)
+}
 
-		// Log the key and its value
-		log.Printf("Redis Key: %s, Value: %v", key, value)
+func (c *Consumer) ack(msg amqp.Delivery) {
+	if err := msg.Ack(false); err != nil {
+		log.Printf("Failed to acknowledge message: %v", err)
 	}
 }
 
-func (c *Consumer) processHeartbeats(ctx context.Context, msgs <-chan amqp.Delivery) {
+// processHeartbeats records heartbeats and reports devices coming online, the
+// offline side is left to updateDeviceStatus.
+func (c *Consumer) processHeartbeats(ctx context.Context) {
 	defer c.wg.Done()
+	writeAPI := c.influxClient.WriteAPIBlocking(influxOrg, deviceStatusBucket)
 
+	var msgs <-chan amqp.Delivery
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg := <-msgs:
+		case msgs = <-c.heartbeatFeed:
+		case msg, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			// A heartbeat is superseded by the next one, so it is never retried
+			c.ack(msg)
+			c.stats.Heartbeats.Add(1)
 			var heartbeat Heartbeat
 			if err := json.Unmarshal(msg.Body, &heartbeat); err != nil {
 				log.Printf("Failed to unmarshal heartbeat: %v", err)
 				continue
 			}
-			// err := c.redisClient.Set(ctx, heartbeat.DeviceID, heartbeat.Timestamp, redisTTL).Err()
-			err := c.redisClient.HSet(ctx, "heartbeat:"+heartbeat.DeviceID, map[string]interface{}{
-				"lastSeen": heartbeat.Timestamp,
-			}).Err()
+			lastSeen, err := time.Parse(time.RFC3339, heartbeat.Timestamp)
+			if err != nil {
+				log.Printf("Failed to parse last seen time for device %s: %v", heartbeat.DeviceID, err)
+				continue
+			}
+			cameOnline, err := c.liveness.Seen(ctx, heartbeat.DeviceID, lastSeen)
 			if err != nil {
 				log.Printf("Failed writing to redis!: %v", err)
+				continue
 			}
-			c.redisClient.Expire(ctx, "heartbeat:"+heartbeat.DeviceID, redisTTL)
-
-		case <-c.channel.NotifyClose(make(chan *amqp.Error)):
-			log.Println("Connection to RabbitMQ lost. Reconnecting...")
-			if err := c.reconnectBroker(); err != nil {
-				log.Printf("Failed to reconnect to RabbitMQ: %v", err)
+			if cameOnline {
+				c.reportTransition(ctx, heartbeat.DeviceID, true, writeAPI)
 			}
 		}
 	}
@@ -327,70 +579,51 @@ func (c *Consumer) updateDeviceStatus(ctx context.Context) {
 
 	done := false
 	doneTimeout := 0
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(time.Duration(c.liveness.settings.ScanInterval))
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-c.reconnecting:
-			log.Println("Cannot process device status! Waiting for connection!")
-			time.Sleep(20 * time.Second)
-			continue
-
 		case <-ctx.Done():
 			log.Printf("Context cancelled. Shutting down!")
 			return
 
 		case <-ticker.C:
-			keys, err := c.redisClient.Keys(ctx, "heartbeat:*").Result()
-			if err != nil {
-				log.Printf("Failed to get device IDs from Redis: %v", err)
+			if done && !c.leader.IsLeader() {
+				// Only the leader writes status changes, nothing to wait for
+				c.cancelContext()
+				return
+			}
+			if !c.leader.IsLeader() {
 				continue
 			}
-
-			// Iterate through devices and update status
-			for _, key := range keys {
-				result, err := c.redisClient.HGetAll(ctx, key).Result()
-				if err != nil {
-					log.Printf("Failed to get data for device %s: %v", key, err)
-					continue
-				}
-				lastStatus, exists := result["lastStatus"]
-				lastSeen := result["lastSeen"]
-				was_alive, _ := strconv.ParseBool(lastStatus)
-
-				lastSeenTime, err := time.Parse(time.RFC3339, lastSeen)
-				if err != nil {
-					log.Printf("Failed to parse last seen time for device %s: %v", key, err)
-					continue
-				}
-				// Checking device status
-				is_alive := time.Since(lastSeenTime) <= 30*time.Second
-
-				// If was not previously processed (new device)
-				if !exists {
-					c.updateStatusInDB(strings.TrimPrefix(key, "heartbeat:"), is_alive, &ctx, writeAPI)
-					log.Printf("Updated value in postgres on new entry!")
-				} else {
-					// only update postgres on status change
-					if is_alive != was_alive {
-						c.updateStatusInDB(strings.TrimPrefix(key, "heartbeat:"), is_alive, &ctx, writeAPI)
-						log.Printf("Updated value in postgres on status change!")
-					}
-				}
-				// update status in redis db
-				err = c.redisClient.HSet(ctx, key, "lastStatus", is_alive).Err()
-				if err != nil {
-					log.Printf("Failed writing to redis!: %v", err)
-				}
-
+			// Heartbeats do not arrive while the broker is away, that does
+			// not make the devices offline
+			readySince := c.broker.ReadySince()
+			if readySince.IsZero() || time.Since(readySince) < brokerSettleTime {
+				continue
+			}
+			offline, err := c.liveness.Expired(ctx, time.Now())
+			if err != nil {
+				log.Printf("Failed to check device liveness: %v", err)
+			}
+			for _, deviceID := range offline {
+				c.reportTransition(ctx, deviceID, false, writeAPI)
+			}
+			settled, err := c.liveness.Settled(ctx, time.Now())
+			if err != nil {
+				log.Printf("Failed to check flapping devices: %v", err)
+			}
+			for deviceID, online := range settled {
+				log.Printf("Device %s stopped flapping", deviceID)
+				c.updateStatusInDB(deviceID, online, stateOf(online), &ctx, writeAPI)
 			}
 			if done {
 				if doneTimeout >= 8 {
 					c.cancelContext()
 					return
 				}
-				log.Printf("Shutdown running! Waiting for possible device status changes.", doneTimeout)
+				log.Printf("Shutdown running! Waiting %v for possible device status changes.", doneTimeout)
 				doneTimeout++
 			}
 
@@ -400,14 +633,44 @@ func (c *Consumer) updateDeviceStatus(ctx context.Context) {
 	}
 }
 
-func (c *Consumer) updateStatusInDB(key string, status bool, ctx *context.Context, writeAPI api.WriteAPIBlocking) {
+// reportTransition writes a status change unless the device is flapping, a
+// device that starts flapping is recorded as such once. Outage detection
+// sees every change, flapping or not.
+func (c *Consumer) reportTransition(ctx context.Context, deviceID string, online bool, writeAPI api.WriteAPIBlocking) {
+	c.trackOutage(ctx, deviceID, online, time.Now())
+	state, err := c.liveness.Transition(ctx, deviceID, online, time.Now())
+	if err != nil {
+		log.Printf("Failed to check device %s for flapping: %v", deviceID, err)
+		state = stateOf(online)
+	}
+	c.stats.countTransition(state)
+	if state == "" {
+		log.Printf("Holding back status change of flapping device %s", deviceID)
+		return
+	}
+	if state == StateFlapping {
+		log.Printf("Device %s is flapping", deviceID)
+	}
+	c.updateStatusInDB(deviceID, online, state, &ctx, writeAPI)
+	log.Printf("Updated value in postgres on status change!")
+}
+
+func stateOf(online bool) string {
+	if online {
+		return StateOnline
+	}
+	return StateOffline
+}
+
+func (c *Consumer) updateStatusInDB(key string, status bool, state string, ctx *context.Context, writeAPI api.WriteAPIBlocking) {
 	_, err := c.pgDB.ExecContext(*ctx,
-		`INSERT INTO device_status (device_id, is_active)
-                         VALUES ($1, $2)
+		`INSERT INTO device_status (device_id, is_active, state)
+                         VALUES ($1, $2, $3)
                          ON CONFLICT (device_id)
-                         DO UPDATE SET is_active = $2`,
+                         DO UPDATE SET is_active = $2, state = $3`,
 		key,
 		status,
+		state,
 	)
 	if err != nil {
 		log.Printf("Failed to update device status for %s: %v", key, err)
@@ -420,6 +683,7 @@ func (c *Consumer) updateStatusInDB(key string, status bool, ctx *context.Contex
 		},
 		map[string]interface{}{
 			"value": status,
+			"state": state,
 		},
 		time.Now(),
 	)
@@ -427,11 +691,12 @@ func (c *Consumer) updateStatusInDB(key string, status bool, ctx *context.Contex
 	msg, err := json.Marshal(Status{
 		DeviceId: key,
 		IsActive: status,
+		State:    state,
 	})
 	if err != nil {
-		log.Printf("Failed marshalling to json!", err)
+		log.Printf("Failed marshalling to json: %v", err)
 	}
-	c.wsServer.SendMessage(key, msg, "avb")
+	c.broadcast(key, msg, connTypeAvailability)
 
 	if err := writeAPI.WritePoint(*ctx, p); err != nil {
 		log.Printf("Failed to write status change to InfluxDB: %v", err)
@@ -440,29 +705,6 @@ func (c *Consumer) updateStatusInDB(key string, status bool, ctx *context.Contex
 	}
 }
 
-func (c *Consumer) reconnectBroker() error {
-	// Close existing connection and channel
-	if err := c.channel.Close(); err != nil {
-		log.Printf("Error closing channel: %v", err)
-	}
-	if err := c.conn.Close(); err != nil {
-		log.Printf("Error closing connection: %v", err)
-	}
-	c.reconnecting <- true
-
-	// Reconnect to RabbitMQ
-	for {
-		err := c.ConnectToBroker()
-		log.Println("Attempting to reconnect to RabbitMQ...")
-		if err == nil {
-			log.Println("Reconnected to RabbitMQ")
-			c.reconnecting <- false
-			return nil
-		}
-		time.Sleep(reconnectDelay)
-	}
-}
-
 func (c *Consumer) Shutdown(ctx context.Context) error {
 	// Wait for goroutines to finish
 	done := make(chan struct{})
@@ -476,13 +718,15 @@ func (c *Consumer) Shutdown(ctx context.Context) error {
 	case <-ctx.Done():
 		return fmt.Errorf("shutdown timed out: %v", ctx.Err())
 	}
+	// Everything already taken from the queue is written (and acknowledged)
+	// before the channel goes away, and followed up on before Redis does
+	c.writer.Close()
+	c.followUps.Close()
+	c.balancer.releaseAll()
 
 	// Close connections
-	if err := c.channel.Close(); err != nil {
-		log.Printf("Error closing channel: %v", err)
-	}
-	if err := c.conn.Close(); err != nil {
-		log.Printf("Error closing connection: %v", err)
+	if err := c.broker.Close(); err != nil {
+		log.Printf("Error closing RabbitMQ connection: %v", err)
 	}
 	if err := c.pgDB.Close(); err != nil {
 		log.Printf("Error closing PostgreSQL connection: %v", err)
@@ -496,44 +740,44 @@ func (c *Consumer) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// SendAggregatedMeasurements recomputes the city aggregates of windows with
+// new readings and pushes the last closed 5 minute window of every city to
+// the city dashboards. A window recomputed after late readings is pushed
+// again with the same Timestamp and replaces the earlier value.
 func (c *Consumer) SendAggregatedMeasurements(ctx context.Context) {
-	keys, err := c.redisClient.Keys(ctx, "city:*").Result()
-	if err != nil {
-		log.Printf("Failed to fetch keys from Redis: %v", err)
+	if !c.leader.IsLeader() {
 		return
 	}
+	now := time.Now()
+	aggregates, err := c.aggregates.Run(ctx, now)
+	if err != nil {
+		log.Printf("Failed to aggregate city consumption: %v", err)
+	}
 
-	for _, key := range keys {
-		data, err := c.redisClient.HGetAll(ctx, key).Result()
-		if err != nil {
-			log.Printf("Failed to fetch data for %s: %v", key, err)
-			continue
-		}
-
-		city := strings.TrimPrefix(key, "city:")
-		value, _ := strconv.ParseFloat(data["value"], 64)
-
-		if value == 0 {
-			continue
-		}
-		debugRedisData(ctx, c.redisClient)
+	for _, aggregate := range latestClosed(aggregates, aggregateWindows[0].Size, now) {
 		wsmsg, err := json.Marshal(MeasurementValue{
-			Value:     value,
-			Timestamp: time.Now(),
-			City:      city,
+			Value:     aggregate.Value,
+			Timestamp: aggregate.Start,
+			City:      aggregate.City,
 		})
 		if err != nil {
 			log.Printf("Failed to marshal JSON: %v", err)
 			continue
 		}
-		c.wsServer.SendMessage(city, wsmsg, "csm")
-
-		// reset accumulated value
-		c.redisClient.HSet(ctx, key, "value", 0)
+		c.broadcast(aggregate.City, wsmsg, connTypeCity)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		runDLQ(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		runAggregate(os.Args[2:])
+		return
+	}
+
 	amqpURI := os.Getenv("AMQP_URI")
 	influxURI := os.Getenv("INFLUX_URI")
 	influxToken := os.Getenv("INFLUX_TOKEN")
@@ -561,25 +805,20 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	wsServer := NewWsServer()
+	wsServer := NewWsServer(envInt("WS_SEND_BUFFER", defaultSendBuffer), slowClientPolicyFromEnv())
 	go wsServer.Run()
 
-	go HttpServer(":9000", wsServer)
+	// The probes report starting until the consumer exists
+	var running atomic.Pointer[Consumer]
+	go HttpServer(":9000", wsServer, &running)
 
 	consumer, err := NewConsumer(amqpURI, influxURI, influxToken, pgConnStr, redisAddr, cancel, wsServer)
 	if err != nil {
 		log.Fatal(err)
 	}
+	running.Store(consumer)
 
-	err = consumer.ConnectToBroker()
-	if err != nil {
-		log.Printf("Failed connecting to broker: %v", err)
-		os.Exit(1)
-	}
-
-	if err := consumer.Start(ctx); err != nil {
-		log.Fatal(err)
-	}
+	consumer.Start(ctx)
 
 	//5-min timer for city consumption aggregation
 	go func() {
@@ -616,6 +855,7 @@ func main() {
 		select {
 		case <-sigChan:
 			log.Println("Received shutdown signal")
+			consumer.stopping.Store(true)
 			consumer.shutdown <- struct{}{}
 			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 60*time.Second)
 			defer shutdownCancel()
@@ -1,17 +1,89 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Heartbeat struct {
 	DeviceID  string
 	Timestamp string
 }
 
+type PhaseReading struct {
+	Voltage float64
+	Current float64
+	Power   float64
+}
+
+// Measurement is a meter reading. Version 1 readings only carry Value, version
+// 2 adds the reading interval and optional electrical fields.
 type Measurement struct {
+	Version   int
 	DeviceID  string
 	Value     float64
 	Timestamp time.Time
 	Address   Location
+
+	MeterSerial    string
+	ImportRegister *float64
+	ExportRegister *float64
+
+	IntervalSeconds int
+	Voltage         *float64
+	Current         *float64
+	PowerFactor     *float64
+	ReactiveEnergy  *float64
+	Phases          []PhaseReading
+
+	// Estimated marks readings the consumer made up for lost messages
+	Estimated bool `json:"-"`
+	// RegisterRollback marks readings whose registers went back to older
+	// values, they book no consumption
+	RegisterRollback bool `json:"-"`
+}
+
+func (m *Measurement) interval() time.Duration {
+	if m.IntervalSeconds > 0 {
+		return time.Duration(m.IntervalSeconds) * time.Second
+	}
+	return defaultInterval
+}
+
+// Fields returns the Influx fields of the reading, value is always present so
+// existing value based queries keep working.
+func (m *Measurement) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"value": m.Value,
+	}
+	if m.IntervalSeconds > 0 {
+		fields["interval_seconds"] = m.IntervalSeconds
+	}
+	if m.Estimated {
+		fields["estimated"] = true
+	}
+	if m.RegisterRollback {
+		fields["register_rollback"] = true
+	}
+	optional := map[string]*float64{
+		"import_register": m.ImportRegister,
+		"export_register": m.ExportRegister,
+		"voltage":         m.Voltage,
+		"current":         m.Current,
+		"power_factor":    m.PowerFactor,
+		"reactive_energy": m.ReactiveEnergy,
+	}
+	for name, value := range optional {
+		if value != nil {
+			fields[name] = *value
+		}
+	}
+	for i, phase := range m.Phases {
+		fields[fmt.Sprintf("voltage_l%d", i+1)] = phase.Voltage
+		fields[fmt.Sprintf("current_l%d", i+1)] = phase.Current
+		fields[fmt.Sprintf("power_l%d", i+1)] = phase.Power
+	}
+	return fields
 }
 
 type Location struct {
@@ -23,6 +95,7 @@ type Location struct {
 type Status struct {
 	DeviceId string
 	IsActive bool
+	State    string
 }
 
 type Consumption struct {
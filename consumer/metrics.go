@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// LatencyHistogram counts durations into latencyBuckets, its zero value is
+// ready to use.
+type LatencyHistogram struct {
+	buckets [len(latencyBuckets)]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64 // nanoseconds
+}
+
+func (h *LatencyHistogram) Observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(duration))
+}
+
+// ConsumerStats counts the deliveries and status changes the consumer
+// handled since it started.
+type ConsumerStats struct {
+	Measurements atomic.Int64
+	Heartbeats   atomic.Int64
+	Alerts       atomic.Int64
+	// Transitions counts status changes by the state written, held back
+	// changes of flapping devices are counted separately
+	Online   atomic.Int64
+	Offline  atomic.Int64
+	Flapping atomic.Int64
+	Held     atomic.Int64
+}
+
+// countTransition records a status change reportTransition decided on.
+func (s *ConsumerStats) countTransition(state string) {
+	switch state {
+	case StateOnline:
+		s.Online.Add(1)
+	case StateOffline:
+		s.Offline.Add(1)
+	case StateFlapping:
+		s.Flapping.Add(1)
+	case "":
+		s.Held.Add(1)
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) sample(name string, labels map[string]string, value float64) {
+	fmt.Fprintf(m.w, "%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m metricsWriter) counter(name string, help string, value int64) {
+	m.header(name, "counter", help)
+	m.sample(name, nil, float64(value))
+}
+
+func (m metricsWriter) gauge(name string, help string, value float64) {
+	m.header(name, "gauge", help)
+	m.sample(name, nil, value)
+}
+
+// labeled writes one sample per label value of a single label.
+func (m metricsWriter) labeled(name string, kind string, help string, label string, values map[string]int64) {
+	m.header(name, kind, help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.sample(name, map[string]string{label: key}, float64(values[key]))
+	}
+}
+
+func (m metricsWriter) histogram(name string, help string, h *LatencyHistogram) {
+	m.header(name, "histogram", help)
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += h.buckets[i].Load()
+		m.sample(name+"_bucket", map[string]string{"le": strconv.FormatFloat(bound, 'g', -1, 64)}, float64(cumulative))
+	}
+	count := h.count.Load()
+	m.sample(name+"_bucket", map[string]string{"le": "+Inf"}, float64(count))
+	m.sample(name+"_sum", nil, time.Duration(h.sum.Load()).Seconds())
+	m.sample(name+"_count", nil, float64(count))
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+strconv.Quote(labels[key]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics exposes the counters of every part of the consumer. The
+// WebSocket metrics are available before the consumer connected.
+func writeMetrics(w io.Writer, wsServer *WsServer, c *Consumer) {
+	m := metricsWriter{w: w}
+
+	ws := wsServer.Stats()
+	m.labeled("consumer_ws_clients", "gauge", "Connected WebSocket clients by subscribed connType.", "conn_type", wsServer.clientsByConnType())
+	m.counter("consumer_ws_frames_queued_total", "WebSocket frames queued for clients.", ws.Queued.Load())
+	m.counter("consumer_ws_frames_sent_total", "WebSocket frames written to clients.", ws.Sent.Load())
+	m.counter("consumer_ws_frames_dropped_total", "WebSocket frames dropped because a client queue was full.", ws.Dropped.Load())
+	m.counter("consumer_ws_slow_clients_disconnected_total", "WebSocket clients disconnected for being too slow.", ws.Disconnected.Load())
+	m.counter("consumer_ws_write_failures_total", "Failed WebSocket writes.", ws.WriteFailures.Load())
+	if c == nil {
+		return
+	}
+
+	m.labeled("consumer_messages_consumed_total", "counter", "Deliveries taken from the broker by queue.", "queue", map[string]int64{
+		"measurements": c.stats.Measurements.Load(),
+		"heartbeats":   c.stats.Heartbeats.Load(),
+		"alerts":       c.stats.Alerts.Load(),
+	})
+	connected := 0.0
+	if c.broker.State() == ConnReady {
+		connected = 1
+	}
+	m.gauge("consumer_broker_connected", "Whether the consumer is connected to the broker.", connected)
+	m.counter("consumer_broker_connects_total", "Sessions set up with the broker, the first one included.", c.broker.Connects.Load())
+
+	writer := c.writer.Stats()
+	m.histogram("consumer_influx_write_duration_seconds", "Duration of InfluxDB write requests of the batch writer.", &writer.WriteLatency)
+	m.counter("consumer_influx_write_errors_total", "Failed InfluxDB write requests, retries included.", writer.WriteErrors.Load())
+	m.counter("consumer_influx_failed_batches_total", "Batches InfluxDB rejected or that were given up on at shutdown.", writer.FailedBatches.Load())
+	m.counter("consumer_influx_batches_total", "Batches flushed to InfluxDB.", writer.Batches.Load())
+	m.counter("consumer_influx_points_total", "Points written to InfluxDB.", writer.Points.Load())
+
+	m.gauge("consumer_followup_queue_depth", "Stored measurements waiting for their follow-up work.", float64(c.followUps.Pending()))
+
+	dedup := c.dedup.Stats()
+	m.counter("consumer_dedup_checked_total", "Measurements checked against the dedup window.", dedup.Checked.Load())
+	m.labeled("consumer_dedup_dropped_total", "counter", "Duplicate measurements dropped by what matched.", "by", map[string]int64{
+		dedupByMessageID:   dedup.DroppedByID.Load(),
+		dedupByDeviceStamp: dedup.DroppedByReading.Load(),
+	})
+
+	anomalies := c.anomalies.Stats()
+	m.labeled("consumer_anomalies_total", "counter", "Implausible readings by kind.", "kind", map[string]int64{
+		AnomalySpike:    anomalies.Spikes.Load(),
+		AnomalyZero:     anomalies.Zeros.Load(),
+		AnomalyNegative: anomalies.Negatives.Load(),
+		AnomalyRollback: anomalies.Rollbacks.Load(),
+	})
+
+	m.labeled("consumer_status_transitions_total", "counter", "Device status changes by the state written, held marks changes held back while flapping.", "state", map[string]int64{
+		StateOnline:   c.stats.Online.Load(),
+		StateOffline:  c.stats.Offline.Load(),
+		StateFlapping: c.stats.Flapping.Load(),
+		"held":        c.stats.Held.Load(),
+	})
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(wsServer *WsServer, consumer *atomic.Pointer[Consumer]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, wsServer, consumer.Load())
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// offlineKeyPrefix starts the sorted set of offline devices of a scope,
+	// scored by when they went offline in unix milliseconds
+	offlineKeyPrefix = "outage:offline:"
+	// openOutagesKey maps the scopes with an open outage to its record
+	openOutagesKey = "outage:open"
+	// deviceLocationKey maps devices to their address, heartbeats do not
+	// carry it
+	deviceLocationKey = "outage:location"
+
+	// outageClaimTTL is how long a replica may take to store an outage it
+	// claimed, a claim older than that is taken over by the next offline
+	// device of the scope
+	outageClaimTTL = 10 * time.Second
+
+	defaultOutageWindow        = 2 * time.Minute
+	defaultOutageStreetDevices = 3
+	defaultOutageCityDevices   = 10
+
+	// allOutages is the WebSocket target of admins following every city
+	allOutages = "all"
+)
+
+// Outage scopes, a street outage is always inside its city.
+const (
+	ScopeStreet = "street"
+	ScopeCity   = "city"
+)
+
+// OutageConfig decides when offline devices count as an outage. An outage
+// opens when StreetDevices of a street or CityDevices of a city go offline
+// within Window, and it ends once fewer than that many of the devices that
+// went offline since it started are still offline.
+type OutageConfig struct {
+	Window        time.Duration
+	StreetDevices int
+	CityDevices   int
+}
+
+// outageConfigFromEnv reads OUTAGE_WINDOW, OUTAGE_STREET_DEVICES and
+// OUTAGE_CITY_DEVICES.
+func outageConfigFromEnv() (OutageConfig, error) {
+	config := OutageConfig{
+		Window:        defaultOutageWindow,
+		StreetDevices: envInt("OUTAGE_STREET_DEVICES", defaultOutageStreetDevices),
+		CityDevices:   envInt("OUTAGE_CITY_DEVICES", defaultOutageCityDevices),
+	}
+	if value := os.Getenv("OUTAGE_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			return config, fmt.Errorf("invalid OUTAGE_WINDOW %q", value)
+		}
+		config.Window = window
+	}
+	if config.StreetDevices < 1 || config.CityDevices < 1 {
+		return config, fmt.Errorf("OUTAGE_STREET_DEVICES and OUTAGE_CITY_DEVICES must be at least 1")
+	}
+	return config, nil
+}
+
+// Outage is an incident record, EndedAt is nil while it is open.
+type Outage struct {
+	ID              int64
+	Scope           string
+	City            string
+	Street          string
+	AffectedDevices int
+	StartedAt       time.Time
+	EndedAt         *time.Time
+}
+
+// openOutage is what Redis keeps about an open outage. An ID of 0 is a
+// claim of the replica storing the outage since ClaimedAt.
+type openOutage struct {
+	ID        int64
+	StartedAt int64
+	ClaimedAt int64 `json:",omitempty"`
+}
+
+type outageScope struct {
+	kind   string
+	city   string
+	street string
+}
+
+func (s outageScope) key() string {
+	if s.kind == ScopeStreet {
+		return ScopeStreet + ":" + s.city + "|" + s.street
+	}
+	return ScopeCity + ":" + s.city
+}
+
+// offlineScript records device ARGV[1] going offline at ARGV[2] and counts
+// the devices of the scope that went offline since ARGV[3]. Without an open
+// outage it claims one when the count reaches ARGV[4] and returns
+// {1, count, first offline time}. With an open outage it returns {2, count
+// since the outage started, outage id}, otherwise {0, count}. Claims made
+// before ARGV[6] are abandoned and no longer count as an open outage.
+var offlineScript = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+local open = redis.call("HGET", KEYS[2], ARGV[5])
+if open then
+	local outage = cjson.decode(open)
+	if outage["ID"] ~= 0 or (outage["ClaimedAt"] or 0) >= tonumber(ARGV[6]) then
+		return {2, redis.call("ZCOUNT", KEYS[1], outage["StartedAt"], "+inf"), outage["ID"]}
+	end
+	redis.call("HDEL", KEYS[2], ARGV[5])
+end
+local count = redis.call("ZCOUNT", KEYS[1], ARGV[3], "+inf")
+if count < tonumber(ARGV[4]) then
+	return {0, count}
+end
+local first = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[3], "+inf", "WITHSCORES", "LIMIT", 0, 1)
+redis.call("HSET", KEYS[2], ARGV[5], cjson.encode({ID = 0, StartedAt = tonumber(first[2]), ClaimedAt = tonumber(ARGV[2])}))
+return {1, count, tonumber(first[2])}
+`)
+
+// settleClaimScript replaces the claim made at ARGV[2] on scope ARGV[1] with
+// the outage record ARGV[3], or drops it when ARGV[3] is empty. It returns 0
+// when the claim was taken over in the meantime.
+var settleClaimScript = redis.NewScript(`
+local open = redis.call("HGET", KEYS[1], ARGV[1])
+if not open then
+	return 0
+end
+local outage = cjson.decode(open)
+if outage["ID"] ~= 0 or outage["ClaimedAt"] ~= tonumber(ARGV[2]) then
+	return 0
+end
+if ARGV[3] == "" then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+else
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`)
+
+// onlineScript records device ARGV[1] coming back. When that leaves fewer
+// than ARGV[2] devices offline since the open outage of the scope started,
+// the outage is removed and returned for closing. An outage still being
+// opened is left alone.
+var onlineScript = redis.NewScript(`
+redis.call("ZREM", KEYS[1], ARGV[1])
+local open = redis.call("HGET", KEYS[2], ARGV[3])
+if not open then
+	return false
+end
+local outage = cjson.decode(open)
+if outage["ID"] == 0 or redis.call("ZCOUNT", KEYS[1], outage["StartedAt"], "+inf") >= tonumber(ARGV[2]) then
+	return false
+end
+redis.call("HDEL", KEYS[2], ARGV[3])
+return open
+`)
+
+// OutageDetector correlates offline transitions of devices on the same
+// street or in the same city into outage incidents. Offline transitions come
+// from the leader only, so outages are opened by a single replica, any
+// replica may close one.
+type OutageDetector struct {
+	redisClient *redis.Client
+	store       outageStore
+	config      OutageConfig
+	// locations caches the address of every device seen in a measurement, so
+	// the Redis mapping is only written when it changes
+	locations map[string]Location
+	mu        sync.Mutex
+}
+
+func NewOutageDetector(redisClient *redis.Client, pgDB *sql.DB, config OutageConfig) *OutageDetector {
+	return &OutageDetector{
+		redisClient: redisClient,
+		store:       &pgOutageStore{pgDB: pgDB},
+		config:      config,
+		locations:   make(map[string]Location),
+	}
+}
+
+// SetLocation remembers the address of a device.
+func (d *OutageDetector) SetLocation(ctx context.Context, deviceID string, location Location) {
+	d.mu.Lock()
+	known := d.locations[deviceID] == location
+	d.locations[deviceID] = location
+	d.mu.Unlock()
+	if known {
+		return
+	}
+	data, err := json.Marshal(location)
+	if err != nil {
+		log.Printf("Failed to marshal location of device %s: %v", deviceID, err)
+		return
+	}
+	if err := d.redisClient.HSet(ctx, deviceLocationKey, deviceID, data).Err(); err != nil {
+		log.Printf("Failed to save location of device %s: %v", deviceID, err)
+	}
+}
+
+// scopes returns the street and city of a device, none when its address was
+// never seen.
+func (d *OutageDetector) scopes(ctx context.Context, deviceID string) []outageScope {
+	d.mu.Lock()
+	location, ok := d.locations[deviceID]
+	d.mu.Unlock()
+	if !ok {
+		data, err := d.redisClient.HGet(ctx, deviceLocationKey, deviceID).Result()
+		if err != nil {
+			if err != redis.Nil {
+				log.Printf("Failed to load location of device %s: %v", deviceID, err)
+			}
+			return nil
+		}
+		if err := json.Unmarshal([]byte(data), &location); err != nil {
+			log.Printf("Failed to unmarshal location of device %s: %v", deviceID, err)
+			return nil
+		}
+		d.mu.Lock()
+		d.locations[deviceID] = location
+		d.mu.Unlock()
+	}
+	if location.City == "" {
+		return nil
+	}
+	scopes := []outageScope{{kind: ScopeCity, city: location.City}}
+	if location.Street != "" {
+		scopes = append(scopes, outageScope{kind: ScopeStreet, city: location.City, street: location.Street})
+	}
+	return scopes
+}
+
+func (d *OutageDetector) threshold(scope outageScope) int {
+	if scope.kind == ScopeStreet {
+		return d.config.StreetDevices
+	}
+	return d.config.CityDevices
+}
+
+// Offline records a device going offline and returns the outages it opened
+// or grew.
+func (d *OutageDetector) Offline(ctx context.Context, deviceID string, at time.Time) ([]Outage, error) {
+	var changed []Outage
+	for _, scope := range d.scopes(ctx, deviceID) {
+		result, err := offlineScript.Run(ctx, d.redisClient, []string{offlineKeyPrefix + scope.key(), openOutagesKey},
+			deviceID, at.UnixMilli(), at.Add(-d.config.Window).UnixMilli(), d.threshold(scope), scope.key(),
+			at.Add(-outageClaimTTL).UnixMilli()).Int64Slice()
+		if err != nil {
+			return changed, fmt.Errorf("failed to record offline device %s: %v", deviceID, err)
+		}
+		switch result[0] {
+		case 1:
+			outage, opened, err := d.open(ctx, scope, int(result[1]), time.UnixMilli(result[2]), at.UnixMilli())
+			if err != nil {
+				return changed, err
+			}
+			if opened {
+				changed = append(changed, outage)
+			}
+		case 2:
+			if result[2] == 0 {
+				// Another device is opening it right now
+				continue
+			}
+			outage, updated, err := d.grow(ctx, scope, result[2], int(result[1]))
+			if err != nil {
+				return changed, err
+			}
+			if updated {
+				changed = append(changed, outage)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// open stores the outage claimed by offlineScript at claimedAt. The claim is
+// dropped again when Postgres fails, so the next offline device retries, and
+// the record is deleted again when it cannot be published in Redis. It
+// reports false when another replica took the claim over meanwhile.
+func (d *OutageDetector) open(ctx context.Context, scope outageScope, affected int, startedAt time.Time, claimedAt int64) (Outage, bool, error) {
+	outage := Outage{
+		Scope:           scope.kind,
+		City:            scope.city,
+		Street:          scope.street,
+		AffectedDevices: affected,
+		StartedAt:       startedAt,
+	}
+	if err := d.store.insert(ctx, &outage); err != nil {
+		d.settleClaim(ctx, scope, claimedAt, "")
+		return outage, false, fmt.Errorf("failed to open %s outage in %s: %v", scope.kind, scope.key(), err)
+	}
+
+	data, _ := json.Marshal(openOutage{ID: outage.ID, StartedAt: startedAt.UnixMilli()})
+	held, err := settleClaimScript.Run(ctx, d.redisClient, []string{openOutagesKey}, scope.key(), claimedAt, data).Int()
+	if err != nil || held == 0 {
+		// Nobody would ever close the record, take it back
+		if removeErr := d.store.remove(ctx, outage.ID); removeErr != nil {
+			log.Printf("Failed to remove unpublished outage %d: %v", outage.ID, removeErr)
+		}
+		if err != nil {
+			d.settleClaim(ctx, scope, claimedAt, "")
+			return outage, false, fmt.Errorf("failed to save open outage %d: %v", outage.ID, err)
+		}
+		log.Printf("Dropped %s outage %d in %s, another replica took over its claim", scope.kind, outage.ID, scope.key())
+		return outage, false, nil
+	}
+	log.Printf("Opened %s outage %d in %s with %d devices offline", scope.kind, outage.ID, scope.key(), affected)
+	return outage, true, nil
+}
+
+// settleClaim drops a claim that is still held, best effort since an
+// abandoned claim expires on its own.
+func (d *OutageDetector) settleClaim(ctx context.Context, scope outageScope, claimedAt int64, record string) {
+	if err := settleClaimScript.Run(ctx, d.redisClient, []string{openOutagesKey}, scope.key(), claimedAt, record).Err(); err != nil {
+		log.Printf("Failed to drop outage claim in %s: %v", scope.key(), err)
+	}
+}
+
+// grow raises the affected device count of an open outage, it reports false
+// when the count did not change.
+func (d *OutageDetector) grow(ctx context.Context, scope outageScope, id int64, affected int) (Outage, bool, error) {
+	outage := Outage{ID: id, Scope: scope.kind, City: scope.city, Street: scope.street}
+	updated, err := d.store.grow(ctx, &outage, affected)
+	if err != nil {
+		return outage, false, fmt.Errorf("failed to update outage %d: %v", id, err)
+	}
+	return outage, updated, nil
+}
+
+// Online records a device coming back and returns the outages that ended.
+func (d *OutageDetector) Online(ctx context.Context, deviceID string, at time.Time) ([]Outage, error) {
+	var ended []Outage
+	for _, scope := range d.scopes(ctx, deviceID) {
+		data, err := onlineScript.Run(ctx, d.redisClient, []string{offlineKeyPrefix + scope.key(), openOutagesKey},
+			deviceID, d.threshold(scope), scope.key()).Text()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return ended, fmt.Errorf("failed to record online device %s: %v", deviceID, err)
+		}
+		var open openOutage
+		if err := json.Unmarshal([]byte(data), &open); err != nil {
+			return ended, fmt.Errorf("failed to unmarshal open outage in %s: %v", scope.key(), err)
+		}
+		outage := Outage{ID: open.ID, Scope: scope.kind, City: scope.city, Street: scope.street}
+		if err := d.store.close(ctx, &outage, at); err != nil {
+			return ended, fmt.Errorf("failed to close outage %d: %v", open.ID, err)
+		}
+		log.Printf("Closed %s outage %d in %s after %s", scope.kind, outage.ID, scope.key(), outage.EndedAt.Sub(outage.StartedAt).Round(time.Second))
+		ended = append(ended, outage)
+	}
+	return ended, nil
+}
+
+// outageStore keeps the incident records the server queries. The server owns
+// the outages table, the consumer only writes rows.
+type outageStore interface {
+	// insert stores a new outage and sets its ID
+	insert(ctx context.Context, outage *Outage) error
+	// remove deletes an outage that was never published
+	remove(ctx context.Context, id int64) error
+	// grow raises the affected devices of an outage to affected, it reports
+	// false and leaves the outage alone when they were not lower
+	grow(ctx context.Context, outage *Outage, affected int) (bool, error)
+	// close ends an outage at endedAt and fills in the rest of it
+	close(ctx context.Context, outage *Outage, endedAt time.Time) error
+}
+
+type pgOutageStore struct {
+	pgDB *sql.DB
+}
+
+func (s *pgOutageStore) insert(ctx context.Context, outage *Outage) error {
+	return s.pgDB.QueryRowContext(ctx,
+		`INSERT INTO outages (scope, city, street, affected_devices, started_at)
+                         VALUES ($1, $2, $3, $4, $5)
+                         RETURNING id`,
+		outage.Scope, outage.City, outage.Street, outage.AffectedDevices, outage.StartedAt,
+	).Scan(&outage.ID)
+}
+
+func (s *pgOutageStore) remove(ctx context.Context, id int64) error {
+	_, err := s.pgDB.ExecContext(ctx, `DELETE FROM outages WHERE id = $1`, id)
+	return err
+}
+
+func (s *pgOutageStore) grow(ctx context.Context, outage *Outage, affected int) (bool, error) {
+	err := s.pgDB.QueryRowContext(ctx,
+		`UPDATE outages SET affected_devices = $2
+                         WHERE id = $1 AND affected_devices < $2
+                         RETURNING affected_devices, started_at`,
+		outage.ID, affected,
+	).Scan(&outage.AffectedDevices, &outage.StartedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *pgOutageStore) close(ctx context.Context, outage *Outage, endedAt time.Time) error {
+	err := s.pgDB.QueryRowContext(ctx,
+		`UPDATE outages SET ended_at = $2 WHERE id = $1
+                         RETURNING affected_devices, started_at`,
+		outage.ID, endedAt,
+	).Scan(&outage.AffectedDevices, &outage.StartedAt)
+	if err != nil {
+		return err
+	}
+	outage.EndedAt = &endedAt
+	return nil
+}
+
+// reportOutages pushes outage changes to admins following the city and to
+// those following all cities.
+func (c *Consumer) reportOutages(outages []Outage) {
+	for _, outage := range outages {
+		msg, err := json.Marshal(outage)
+		if err != nil {
+			log.Printf("Failed marshalling outage to json: %v", err)
+			continue
+		}
+		c.broadcast(outage.City, msg, connTypeOutage)
+		c.broadcast(allOutages, msg, connTypeOutage)
+	}
+}
+
+// trackOutage feeds a raw status change into the outage detector.
+func (c *Consumer) trackOutage(ctx context.Context, deviceID string, online bool, now time.Time) {
+	var outages []Outage
+	var err error
+	if online {
+		outages, err = c.outages.Online(ctx, deviceID, now)
+	} else {
+		outages, err = c.outages.Offline(ctx, deviceID, now)
+	}
+	if err != nil {
+		log.Printf("Failed to track outages: %v", err)
+	}
+	c.reportOutages(outages)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// fakeOutageStore keeps outages in memory, onInsert runs after a row is
+// stored to interfere with the claim.
+type fakeOutageStore struct {
+	outages  map[int64]*Outage
+	nextID   int64
+	onInsert func()
+}
+
+func (s *fakeOutageStore) insert(ctx context.Context, outage *Outage) error {
+	s.nextID++
+	outage.ID = s.nextID
+	stored := *outage
+	s.outages[outage.ID] = &stored
+	if s.onInsert != nil {
+		s.onInsert()
+	}
+	return nil
+}
+
+func (s *fakeOutageStore) remove(ctx context.Context, id int64) error {
+	delete(s.outages, id)
+	return nil
+}
+
+func (s *fakeOutageStore) grow(ctx context.Context, outage *Outage, affected int) (bool, error) {
+	stored, ok := s.outages[outage.ID]
+	if !ok || stored.AffectedDevices >= affected {
+		return false, nil
+	}
+	stored.AffectedDevices = affected
+	*outage = *stored
+	return true, nil
+}
+
+func (s *fakeOutageStore) close(ctx context.Context, outage *Outage, endedAt time.Time) error {
+	stored, ok := s.outages[outage.ID]
+	if !ok {
+		return fmt.Errorf("outage %d does not exist", outage.ID)
+	}
+	stored.EndedAt = &endedAt
+	*outage = *stored
+	return nil
+}
+
+func newTestOutageDetector(t *testing.T) (*OutageDetector, *fakeOutageStore, *miniredis.Miniredis) {
+	server, client := newTestRedis(t)
+	store := &fakeOutageStore{outages: make(map[int64]*Outage)}
+	detector := &OutageDetector{
+		redisClient: client,
+		store:       store,
+		config:      OutageConfig{Window: 2 * time.Minute, StreetDevices: 3, CityDevices: 10},
+		locations:   make(map[string]Location),
+	}
+	for i := 1; i <= 5; i++ {
+		detector.SetLocation(context.Background(), fmt.Sprintf("device-%d", i), Location{City: "Novi Sad", Street: "Main"})
+	}
+	return detector, store, server
+}
+
+func TestOutageOpensGrowsAndCloses(t *testing.T) {
+	ctx := context.Background()
+	detector, store, _ := newTestOutageDetector(t)
+	at := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	for i := 1; i <= 2; i++ {
+		changed, err := detector.Offline(ctx, fmt.Sprintf("device-%d", i), at.Add(time.Duration(i)*time.Second))
+		if err != nil || len(changed) != 0 {
+			t.Fatalf("device %d offline changed %v, %v before the threshold", i, changed, err)
+		}
+	}
+	changed, err := detector.Offline(ctx, "device-3", at.Add(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].Scope != ScopeStreet || changed[0].AffectedDevices != 3 || !changed[0].StartedAt.Equal(at.Add(time.Second)) {
+		t.Fatalf("third device opened %+v, want a street outage of 3 devices from the first", changed)
+	}
+	id := changed[0].ID
+
+	changed, err = detector.Offline(ctx, "device-4", at.Add(4*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].ID != id || changed[0].AffectedDevices != 4 {
+		t.Fatalf("fourth device changed %+v, want outage %d grown to 4", changed, id)
+	}
+
+	for i := 1; i <= 2; i++ {
+		ended, err := detector.Online(ctx, fmt.Sprintf("device-%d", i), at.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && len(ended) != 0 {
+			t.Fatalf("outage ended with 3 devices still offline: %+v", ended)
+		}
+		if i == 2 && (len(ended) != 1 || ended[0].ID != id || ended[0].EndedAt == nil) {
+			t.Fatalf("second device back ended %+v, want outage %d", ended, id)
+		}
+	}
+	if store.outages[id].EndedAt == nil {
+		t.Fatal("outage was not closed in the store")
+	}
+	if open, _ := detector.redisClient.HGet(ctx, openOutagesKey, ScopeStreet+":Novi Sad|Main").Result(); open != "" {
+		t.Fatalf("closed outage still open in Redis: %s", open)
+	}
+}
+
+func TestOutageTakesOverAbandonedClaim(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	scope := ScopeStreet + ":Novi Sad|Main"
+
+	tests := []struct {
+		name      string
+		claimedAt time.Time
+		opened    bool
+	}{
+		{"fresh claim", at.Add(-outageClaimTTL / 2), false},
+		{"abandoned claim", at.Add(-2 * outageClaimTTL), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector, store, server := newTestOutageDetector(t)
+			for i := 1; i <= 2; i++ {
+				detector.Offline(ctx, fmt.Sprintf("device-%d", i), at.Add(-time.Minute))
+			}
+			// A replica claimed the outage and never stored it
+			claim, _ := json.Marshal(openOutage{StartedAt: at.Add(-time.Minute).UnixMilli(), ClaimedAt: test.claimedAt.UnixMilli()})
+			server.HSet(openOutagesKey, scope, string(claim))
+
+			changed, err := detector.Offline(ctx, "device-3", at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opened := len(changed) == 1 && len(store.outages) == 1; opened != test.opened {
+				t.Fatalf("opened = %v (%+v), want %v", opened, changed, test.opened)
+			}
+		})
+	}
+}
+
+func TestOutageDropsRowItCannotPublish(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	scope := ScopeStreet + ":Novi Sad|Main"
+
+	tests := []struct {
+		name      string
+		interfere func(server *miniredis.Miniredis)
+		failed    bool
+	}{
+		{"claim taken over", func(server *miniredis.Miniredis) {
+			claim, _ := json.Marshal(openOutage{StartedAt: at.UnixMilli(), ClaimedAt: at.Add(time.Second).UnixMilli()})
+			server.HSet(openOutagesKey, scope, string(claim))
+		}, false},
+		{"redis down", func(server *miniredis.Miniredis) {
+			server.SetError("connection lost")
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector, store, server := newTestOutageDetector(t)
+			for i := 1; i <= 2; i++ {
+				detector.Offline(ctx, fmt.Sprintf("device-%d", i), at)
+			}
+			store.onInsert = func() { test.interfere(server) }
+
+			changed, err := detector.Offline(ctx, "device-3", at)
+			if (err != nil) != test.failed {
+				t.Fatalf("err = %v, want failed %v", err, test.failed)
+			}
+			if len(changed) != 0 {
+				t.Fatalf("reported %+v for an outage that was not published", changed)
+			}
+			if len(store.outages) != 0 {
+				t.Fatalf("unpublished outage rows left: %+v", store.outages)
+			}
+		})
+	}
+}
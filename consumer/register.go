@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	registerKeyPrefix = "register:"
+	// defaultInterval is the interval of readings sent before the schema
+	// carried one, devices used to report hourly.
+	defaultInterval = time.Hour
+	// maxBackfillIntervals caps how many estimated readings a single gap may
+	// produce, larger gaps are booked on the reading that closes them.
+	maxBackfillIntervals = 31 * 24 * 4
+	// maxDemand is the highest average power in kW a household meter is
+	// expected to see, a register that went back to below one interval of it
+	// restarted from zero, anything higher went back to an older reading.
+	maxDemand = 50.0
+)
+
+// registerState is the last register reading of a device, kept in Redis so
+// deltas survive consumer restarts.
+type registerState struct {
+	Serial    string
+	Import    float64
+	Export    float64
+	Timestamp time.Time
+}
+
+// pendingRegisters holds register states derived from readings that are
+// still waiting for their batch to be written, so the next reading of the
+// same device continues from them instead of from Redis.
+type pendingRegisters struct {
+	states map[string]*registerState
+	mu     sync.Mutex
+}
+
+func newPendingRegisters() *pendingRegisters {
+	return &pendingRegisters{states: make(map[string]*registerState)}
+}
+
+func (p *pendingRegisters) get(deviceID string) *registerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.states[deviceID]
+}
+
+func (p *pendingRegisters) set(deviceID string, state *registerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.states[deviceID] = state
+}
+
+// release forgets the state unless a newer reading replaced it already.
+func (p *pendingRegisters) release(deviceID string, state *registerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.states[deviceID] == state {
+		delete(p.states, deviceID)
+	}
+}
+
+func (c *Consumer) loadRegisterState(ctx context.Context, deviceID string) (*registerState, error) {
+	if state := c.registers.get(deviceID); state != nil {
+		return state, nil
+	}
+	values, err := c.redisClient.HGetAll(ctx, registerKeyPrefix+deviceID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load register of device %s: %v", deviceID, err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	state := &registerState{Serial: values["serial"]}
+	if state.Import, err = strconv.ParseFloat(values["import"], 64); err != nil {
+		return nil, fmt.Errorf("invalid import register of device %s: %v", deviceID, err)
+	}
+	if state.Export, err = strconv.ParseFloat(values["export"], 64); err != nil {
+		return nil, fmt.Errorf("invalid export register of device %s: %v", deviceID, err)
+	}
+	if state.Timestamp, err = time.Parse(time.RFC3339Nano, values["timestamp"]); err != nil {
+		return nil, fmt.Errorf("invalid register timestamp of device %s: %v", deviceID, err)
+	}
+	return state, nil
+}
+
+func (c *Consumer) saveRegisterState(ctx context.Context, deviceID string, state *registerState) error {
+	err := c.redisClient.HSet(ctx, registerKeyPrefix+deviceID, map[string]interface{}{
+		"serial":    state.Serial,
+		"import":    state.Import,
+		"export":    state.Export,
+		"timestamp": state.Timestamp.Format(time.RFC3339Nano),
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to save register of device %s: %v", deviceID, err)
+	}
+	return nil
+}
+
+// intervalReadings returns the readings to store for a measurement. Readings
+// without registers are stored as they are. Readings with registers get their
+// value from the register difference to the previous reading of the device,
+// and the energy of readings lost in between is spread evenly over estimated
+// readings at their timestamps. The returned state has to be committed once
+// the readings are stored and released when they are not, it is nil when
+// nothing changed.
+func (c *Consumer) intervalReadings(ctx context.Context, measurement *Measurement) ([]Measurement, *registerState, error) {
+	if measurement.ImportRegister == nil {
+		return []Measurement{*measurement}, nil, nil
+	}
+
+	previous, err := c.loadRegisterState(ctx, measurement.DeviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	readings, next := deriveReadings(previous, measurement)
+	if next == previous {
+		return readings, nil, nil
+	}
+	c.registers.set(measurement.DeviceID, next)
+	return readings, next, nil
+}
+
+// commitRegister saves the state of stored readings to Redis.
+func (c *Consumer) commitRegister(ctx context.Context, deviceID string, state *registerState) error {
+	defer c.registers.release(deviceID, state)
+	return c.saveRegisterState(ctx, deviceID, state)
+}
+
+// deriveReadings computes the readings and the new register state of a
+// measurement that carries registers.
+func deriveReadings(previous *registerState, measurement *Measurement) ([]Measurement, *registerState) {
+	next := &registerState{
+		Serial:    measurement.MeterSerial,
+		Import:    *measurement.ImportRegister,
+		Timestamp: measurement.Timestamp,
+	}
+	if measurement.ExportRegister != nil {
+		next.Export = *measurement.ExportRegister
+	}
+
+	switch {
+	case previous == nil:
+		// Nothing to compare with, trust the delta the device sent
+		return []Measurement{*measurement}, next
+	case previous.Serial != next.Serial:
+		log.Printf("Meter of device %s replaced (%s -> %s)", measurement.DeviceID, previous.Serial, next.Serial)
+		return []Measurement{*measurement}, next
+	case !next.Timestamp.After(previous.Timestamp):
+		// Late or duplicate reading, the register already accounted for it
+		log.Printf("Skipping reading of device %s at %s, register is already at %s",
+			measurement.DeviceID, measurement.Timestamp.Format(time.RFC3339), previous.Timestamp.Format(time.RFC3339))
+		return nil, previous
+	}
+
+	resetLimit := maxDemand * measurement.interval().Hours()
+	importDelta, importOK := registerDelta(measurement.DeviceID, "Import", previous.Import, next.Import, resetLimit)
+	exportDelta, exportOK := registerDelta(measurement.DeviceID, "Export", previous.Export, next.Export, resetLimit)
+	if !importOK || !exportOK {
+		// The device resumed from registers older than ones it already sent,
+		// continue from what it reports now without booking the difference
+		log.Printf("Registers of device %s went back (%f/%f -> %f/%f), resyncing without consumption",
+			measurement.DeviceID, previous.Import, previous.Export, next.Import, next.Export)
+		reading := *measurement
+		reading.Value = 0
+		reading.RegisterRollback = true
+		return []Measurement{reading}, next
+	}
+	delta := importDelta - exportDelta
+
+	interval := measurement.interval()
+	intervals := int(math.Round(float64(next.Timestamp.Sub(previous.Timestamp)) / float64(interval)))
+	if intervals <= 1 || intervals > maxBackfillIntervals {
+		reading := *measurement
+		reading.Value = delta
+		return []Measurement{reading}, next
+	}
+
+	log.Printf("Backfilling %d lost readings of device %s before %s", intervals-1, measurement.DeviceID, measurement.Timestamp.Format(time.RFC3339))
+	share := delta / float64(intervals)
+	readings := make([]Measurement, 0, intervals)
+	for i := intervals - 1; i >= 1; i-- {
+		readings = append(readings, Measurement{
+			Version:         measurement.Version,
+			DeviceID:        measurement.DeviceID,
+			Value:           share,
+			Timestamp:       measurement.Timestamp.Add(-time.Duration(i) * interval),
+			Address:         measurement.Address,
+			IntervalSeconds: measurement.IntervalSeconds,
+			Estimated:       true,
+		})
+	}
+	reading := *measurement
+	reading.Value = share
+	return append(readings, reading), next
+}
+
+// registerDelta returns how far a register moved. A register that went back
+// to below limit restarted from zero and everything on it is new, one that
+// went back further is not ok.
+func registerDelta(deviceID string, name string, previous float64, next float64, limit float64) (float64, bool) {
+	switch {
+	case next >= previous:
+		return next - previous, true
+	case next <= limit:
+		log.Printf("%s register of device %s reset (%f -> %f)", name, deviceID, previous, next)
+		return next, true
+	default:
+		return 0, false
+	}
+}
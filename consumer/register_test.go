@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDeriveReadings(t *testing.T) {
+	at := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	previous := &registerState{Serial: "SIM0001", Import: 5000, Export: 200, Timestamp: at}
+	reading := func(serial string, importRegister float64, exportRegister float64, timestamp time.Time) *Measurement {
+		return &Measurement{
+			DeviceID:        "device-1",
+			Value:           0.3,
+			Timestamp:       timestamp,
+			MeterSerial:     serial,
+			ImportRegister:  &importRegister,
+			ExportRegister:  &exportRegister,
+			IntervalSeconds: 900,
+		}
+	}
+	quarter := 15 * time.Minute
+
+	tests := []struct {
+		name        string
+		previous    *registerState
+		measurement *Measurement
+		values      []float64
+		estimated   int
+		rollback    bool
+		state       float64
+	}{
+		{"first reading", nil, reading("SIM0001", 5000.4, 200, at), []float64{0.3}, 0, false, 5000.4},
+		{"next interval", previous, reading("SIM0001", 5000.5, 200.1, at.Add(quarter)), []float64{0.4}, 0, false, 5000.5},
+		// A register restarting from zero only carries what it counted since
+		{"reset", previous, reading("SIM0001", 0.7, 200.2, at.Add(quarter)), []float64{0.5}, 0, false, 0.7},
+		// Registers far below the stored ones are an older state of the device
+		{"rollback", previous, reading("SIM0001", 4200, 180, at.Add(quarter)), []float64{0}, 0, true, 4200},
+		{"meter swap", previous, reading("SIM0002", 1.5, 0, at.Add(quarter)), []float64{0.3}, 0, false, 1.5},
+		{"late reading", previous, reading("SIM0001", 4999.8, 200, at.Add(-quarter)), nil, 0, false, 5000},
+		{"duplicate reading", previous, reading("SIM0001", 5000, 200, at), nil, 0, false, 5000},
+		{"gap backfill", previous, reading("SIM0001", 5002, 200, at.Add(4*quarter)), []float64{0.5, 0.5, 0.5, 0.5}, 3, false, 5002},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			readings, next := deriveReadings(test.previous, test.measurement)
+			if len(readings) != len(test.values) {
+				t.Fatalf("got %d readings, want %d", len(readings), len(test.values))
+			}
+			estimated := 0
+			for i, reading := range readings {
+				if math.Abs(reading.Value-test.values[i]) > 1e-9 {
+					t.Errorf("reading %d = %f, want %f", i, reading.Value, test.values[i])
+				}
+				if reading.RegisterRollback != test.rollback {
+					t.Errorf("reading %d rollback = %v, want %v", i, reading.RegisterRollback, test.rollback)
+				}
+				if reading.Estimated {
+					estimated++
+				}
+			}
+			if estimated != test.estimated {
+				t.Errorf("%d estimated readings, want %d", estimated, test.estimated)
+			}
+			if len(readings) > 0 && !readings[len(readings)-1].Timestamp.Equal(test.measurement.Timestamp) {
+				t.Errorf("last reading at %s, want the measurement at %s", readings[len(readings)-1].Timestamp, test.measurement.Timestamp)
+			}
+			if next.Import != test.state {
+				t.Errorf("register state at %f, want %f", next.Import, test.state)
+			}
+		})
+	}
+}
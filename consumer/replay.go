@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// replayKeyPrefix starts the list of recent messages of a topic, newest
+	// first
+	replayKeyPrefix     = "replay:"
+	defaultReplayLength = 60
+	defaultReplayTTL    = 24 * time.Hour
+)
+
+// replayEntry is a message kept for clients subscribing later.
+type replayEntry struct {
+	At      int64
+	Payload json.RawMessage
+}
+
+// ReplayRequest asks for the last messages of a topic when subscribing,
+// either the Last n of them or those of the past Since, e.g. "30m". With
+// both set a message has to satisfy both.
+type ReplayRequest struct {
+	Last  int
+	Since string
+}
+
+func (r ReplayRequest) empty() bool {
+	return r.Last <= 0 && r.Since == ""
+}
+
+// window returns how many messages to read at most and the oldest time to
+// include.
+func (r ReplayRequest) window(now time.Time) (int, time.Time, error) {
+	var since time.Time
+	if r.Since != "" {
+		duration, err := time.ParseDuration(r.Since)
+		if err != nil || duration <= 0 {
+			return 0, since, fmt.Errorf("invalid replay window %q", r.Since)
+		}
+		since = now.Add(-duration)
+	}
+	return r.Last, since, nil
+}
+
+// ReplayBuffer keeps the last messages of every topic in a capped Redis list,
+// so charts can be drawn as soon as a client subscribes instead of waiting
+// for the next reading or city total.
+type ReplayBuffer struct {
+	redisClient *redis.Client
+	length      int
+	ttl         time.Duration
+}
+
+func NewReplayBuffer(redisClient *redis.Client, length int, ttl time.Duration) *ReplayBuffer {
+	if length < 1 {
+		length = 1
+	}
+	return &ReplayBuffer{
+		redisClient: redisClient,
+		length:      length,
+		ttl:         ttl,
+	}
+}
+
+// replayBufferFromEnv reads REPLAY_LENGTH and REPLAY_TTL, the time a topic
+// without messages is kept.
+func replayBufferFromEnv(redisClient *redis.Client) *ReplayBuffer {
+	ttl := defaultReplayTTL
+	if value := os.Getenv("REPLAY_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid REPLAY_TTL %q, using %s", value, defaultReplayTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+	return NewReplayBuffer(redisClient, envInt("REPLAY_LENGTH", defaultReplayLength), ttl)
+}
+
+// Record adds a message to the buffer of its topic, dropping the oldest one
+// when the buffer is full.
+func (b *ReplayBuffer) Record(ctx context.Context, topic string, payload []byte, at time.Time) error {
+	data, err := json.Marshal(replayEntry{At: at.UnixMilli(), Payload: payload})
+	if err != nil {
+		return fmt.Errorf("failed to marshal replay entry: %v", err)
+	}
+	key := replayKeyPrefix + topic
+	pipe := b.redisClient.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, int64(b.length-1))
+	pipe.Expire(ctx, key, b.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record message of %s for replay: %v", topic, err)
+	}
+	return nil
+}
+
+// Recent returns up to last messages of a topic not older than since,
+// oldest first. A zero last or since does not limit.
+func (b *ReplayBuffer) Recent(ctx context.Context, topic string, last int, since time.Time) ([]json.RawMessage, error) {
+	stop := int64(-1)
+	if last > 0 {
+		stop = int64(last - 1)
+	}
+	entries, err := b.redisClient.LRange(ctx, replayKeyPrefix+topic, 0, stop).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay of %s: %v", topic, err)
+	}
+
+	var payloads []json.RawMessage
+	for i := len(entries) - 1; i >= 0; i-- {
+		var entry replayEntry
+		if err := json.Unmarshal([]byte(entries[i]), &entry); err != nil {
+			log.Printf("Skipping malformed replay entry of %s: %v", topic, err)
+			continue
+		}
+		if !since.IsZero() && entry.At < since.UnixMilli() {
+			continue
+		}
+		payloads = append(payloads, entry.Payload)
+	}
+	return payloads, nil
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,10 +27,51 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, enough for a subscription to
+	// a few dozen topics.
+	maxMessageSize = 4096
+
+	// Frames queued per client before the slow client policy applies.
+	defaultSendBuffer = 256
+
+	wsReportEvery = time.Minute
+)
+
+// serverAPI validates tokens and access to devices.
+var serverAPI = "http://server:5000/api"
+
+// SlowClientPolicy decides what happens to a client whose send queue is
+// full. Dropping loses the newest frames of that client only, disconnecting
+// makes it reconnect and start over.
+type SlowClientPolicy string
+
+const (
+	DropFrames       SlowClientPolicy = "drop"
+	DisconnectClient SlowClientPolicy = "disconnect"
 )
 
+// slowClientPolicyFromEnv reads WS_SLOW_CLIENT_POLICY, dropping frames by
+// default.
+func slowClientPolicyFromEnv() SlowClientPolicy {
+	switch policy := SlowClientPolicy(os.Getenv("WS_SLOW_CLIENT_POLICY")); policy {
+	case DropFrames, DisconnectClient:
+		return policy
+	case "":
+	default:
+		log.Printf("Invalid WS_SLOW_CLIENT_POLICY %q, using %s", policy, DropFrames)
+	}
+	return DropFrames
+}
+
+// WsStats counts outbound frames since the server started.
+type WsStats struct {
+	Queued        atomic.Int64
+	Sent          atomic.Int64
+	Dropped       atomic.Int64
+	Disconnected  atomic.Int64
+	WriteFailures atomic.Int64
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
@@ -34,34 +82,156 @@ var upgrader = websocket.Upgrader{
 	Subprotocols:      []string{"token"},
 }
 
+// Connection types name the kind of data a topic carries.
+const (
+	connTypeConsumption  = "consumption"
+	connTypeAvailability = "avb"
+	connTypeCity         = "csm"
+	connTypeOutage       = "outage"
+	connTypeAnomaly      = "anomaly"
+	connTypeAlert        = "alert"
+)
+
+// requiredRole is the endpoint ValidateUser checks a token against before
+// a client may follow topics of the connection type.
+func requiredRole(connType string) string {
+	if deviceScoped(connType) {
+		return "user"
+	}
+	return "admin"
+}
+
+// deviceScoped tells whether the targets of a connection type are devices,
+// which users may follow when they have access to the device.
+func deviceScoped(connType string) bool {
+	return connType == connTypeConsumption || connType == connTypeAnomaly || connType == connTypeAlert
+}
+
+// topicOf names what a client subscribes to, e.g. consumption:<device id>
+// or csm:<city>.
+func topicOf(connType string, target string) string {
+	return connType + ":" + target
+}
+
+// parseTopic splits a topic into its connection type and target.
+func parseTopic(topic string) (string, string, error) {
+	connType, target, ok := strings.Cut(topic, ":")
+	if !ok || target == "" {
+		return "", "", fmt.Errorf("topic %q is not <connType>:<target>", topic)
+	}
+	switch connType {
+	case connTypeConsumption, connTypeAvailability, connTypeCity, connTypeOutage, connTypeAnomaly, connTypeAlert:
+		return connType, target, nil
+	}
+	return "", "", fmt.Errorf("unknown connection type %q", connType)
+}
+
+// subscriptionRequest is what clients send to follow or stop following
+// topics, e.g. {"Action": "subscribe", "Topics": ["avb:42", "csm:Novi Sad"]}.
+// A subscription may ask for recent messages with e.g.
+// "Replay": {"Last": 24} or "Replay": {"Since": "30m"}.
+type subscriptionRequest struct {
+	Action string
+	Topics []string
+	Replay ReplayRequest
+}
+
+// subscriptionReply answers a subscriptionRequest, Rejected maps topics that
+// were refused to the reason.
+type subscriptionReply struct {
+	Action   string
+	Topics   []string
+	Rejected map[string]string `json:",omitempty"`
+}
+
+// topicMessage wraps the frames of multiplexed connections, so clients can
+// tell which subscription a payload belongs to.
+type topicMessage struct {
+	Topic string
+	Data  json.RawMessage
+	// Replayed marks messages sent on subscribe from the replay buffer
+	Replayed bool `json:",omitempty"`
+}
+
 type WebsocketClient struct {
-	conn     *websocket.Conn
-	deviceId string
-	connType string
-	mu       sync.RWMutex
-	done     chan struct{}
+	conn  *websocket.Conn
+	name  string
+	token string
+	// legacy clients name their only topic in the URL and get bare payloads
+	legacy bool
+	// roles caches the token validations of the connection, only readPump
+	// touches it after the upgrade
+	roles map[string]bool
+	// devices caches the household access checks of device topics
+	devices map[string]bool
+	// topics is guarded by the server's lock
+	topics map[string]bool
+	// send queues the frames writePump writes, it is the only writer of
+	// the connection
+	send    chan []byte
+	dropped atomic.Int64
+	done    chan struct{}
 }
 
-func newClient(conn *websocket.Conn, deviceId string, connType string) *WebsocketClient {
+func newClient(conn *websocket.Conn, name string, token string, legacy bool, sendBuffer int) *WebsocketClient {
 	conn.EnableWriteCompression(true)
 	client := &WebsocketClient{
-		conn:     conn,
-		deviceId: deviceId,
-		connType: connType,
-		done:     make(chan struct{}),
+		conn:    conn,
+		name:    name,
+		token:   token,
+		legacy:  legacy,
+		roles:   make(map[string]bool),
+		devices: make(map[string]bool),
+		topics:  make(map[string]bool),
+		send:    make(chan []byte, sendBuffer),
+		done:    make(chan struct{}),
 	}
 
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(pongWait))
-		log.Printf("Received pong from client: deviceId=%s", client.deviceId)
+		log.Printf("Received pong from client %s", client.name)
 		return nil
 	})
 
 	return client
 }
 
+func (c *WebsocketClient) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// authorize checks whether the token may follow a topic. Consumption of a
+// device also needs access to its household. Answers are cached for the
+// lifetime of the connection, errors are not.
+func (c *WebsocketClient) authorize(connType string, target string) (bool, error) {
+	role := requiredRole(connType)
+	allowed, ok := c.roles[role]
+	if !ok {
+		var err error
+		allowed, err = ValidateUser(c.token, connType)
+		if err != nil {
+			return false, err
+		}
+		c.roles[role] = allowed
+	}
+	if !allowed || !deviceScoped(connType) {
+		return allowed, nil
+	}
+
+	if allowed, ok := c.devices[target]; ok {
+		return allowed, nil
+	}
+	allowed, err := ValidateDevice(c.token, target)
+	if err != nil {
+		return false, err
+	}
+	c.devices[target] = allowed
+	return allowed, nil
+}
+
 func (c *WebsocketClient) readPump(wsServer *WsServer) {
 	defer func() {
 		wsServer.unregister <- c
@@ -72,20 +242,37 @@ func (c *WebsocketClient) readPump(wsServer *WsServer) {
 		case <-c.done:
 			return
 		default:
-			_, _, err := c.conn.ReadMessage()
+			_, data, err := c.conn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("ReadMessage error for client %s (%s): %v", c.deviceId, c.connType, err)
+					log.Printf("ReadMessage error for client %s: %v", c.name, err)
 				}
 				return
 			}
-			// Handle other message types if needed
-			log.Printf("Received message from client %s (%s)", c.deviceId, c.connType)
+			var request subscriptionRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				log.Printf("Ignoring malformed message from client %s: %v", c.name, err)
+				continue
+			}
+			reply := wsServer.handleSubscription(c, request)
+			replyData, err := json.Marshal(reply)
+			if err != nil {
+				log.Printf("Failed marshalling subscription reply: %v", err)
+				continue
+			}
+			wsServer.enqueue(c, replyData)
+			if request.Action == "subscribe" && !request.Replay.empty() {
+				for _, topic := range reply.Topics {
+					wsServer.replayTo(c, topic, request.Replay)
+				}
+			}
 		}
 	}
 }
 
-func (c *WebsocketClient) writePump() {
+// writePump writes queued frames and pings, a write error ends the
+// connection and readPump then unregisters the client.
+func (c *WebsocketClient) writePump(wsServer *WsServer) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
@@ -94,13 +281,20 @@ func (c *WebsocketClient) writePump() {
 
 	for {
 		select {
+		case frame := <-c.send:
+			if err := c.write(websocket.TextMessage, frame); err != nil {
+				log.Printf("Error sending message to client %s: %v", c.name, err)
+				wsServer.stats.WriteFailures.Add(1)
+				return
+			}
+			wsServer.stats.Sent.Add(1)
+
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("Failed to send ping to client %s: %v", c.deviceId, err)
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				log.Printf("Failed to send ping to client %s: %v", c.name, err)
 				return
 			}
-			log.Printf("Sent ping to client: deviceId=%s", c.deviceId)
+			log.Printf("Sent ping to client %s", c.name)
 
 		case <-c.done:
 			return
@@ -109,32 +303,64 @@ func (c *WebsocketClient) writePump() {
 }
 
 type WsServer struct {
-	clients    map[*WebsocketClient]bool
-	register   chan *WebsocketClient
-	unregister chan *WebsocketClient
-	mu         sync.RWMutex
-	done       chan struct{} // Channel to signal shutdown
+	clients map[*WebsocketClient]bool
+	// subscribers indexes the clients by topic, so a message only visits
+	// the clients that follow it
+	subscribers map[string]map[*WebsocketClient]bool
+	register    chan *WebsocketClient
+	unregister  chan *WebsocketClient
+	mu          sync.RWMutex
+	done        chan struct{} // Channel to signal shutdown
+	sendBuffer  int
+	policy      SlowClientPolicy
+	stats       WsStats
+	// replay is set once the consumer connected to Redis
+	replay atomic.Pointer[ReplayBuffer]
 }
 
-func NewWsServer() *WsServer {
+func NewWsServer(sendBuffer int, policy SlowClientPolicy) *WsServer {
+	if sendBuffer < 1 {
+		sendBuffer = 1
+	}
 	return &WsServer{
-		clients:    make(map[*WebsocketClient]bool),
-		register:   make(chan *WebsocketClient),
-		unregister: make(chan *WebsocketClient),
-		done:       make(chan struct{}),
+		sendBuffer:  sendBuffer,
+		policy:      policy,
+		clients:     make(map[*WebsocketClient]bool),
+		subscribers: make(map[string]map[*WebsocketClient]bool),
+		register:    make(chan *WebsocketClient),
+		unregister:  make(chan *WebsocketClient),
+		done:        make(chan struct{}),
 	}
 }
 
 func ValidateUser(token string, connType string) (bool, error) {
 	token = strings.Split(token, ",")[0]
 
-	var endpoint string
-	if connType == "consumption" {
-		endpoint = "http://server:5000/api/validate/user"
-	} else {
-		endpoint = "http://server:5000/api/validate/admin"
+	endpoint := serverAPI + "/validate/" + requiredRole(connType)
+	allowed, err := checkToken(endpoint, token)
+	if err != nil {
+		return false, err
 	}
+	log.Printf("Validated token for connType=%s: %t", connType, allowed)
+	return allowed, nil
+}
 
+// ValidateDevice checks that the token belongs to an admin, the owner of
+// the device's household or a user granted access to it.
+func ValidateDevice(token string, deviceId string) (bool, error) {
+	endpoint := serverAPI + "/validate/device/" + url.PathEscape(deviceId)
+	allowed, err := checkToken(endpoint, token)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Validated access to device %s: %t", deviceId, allowed)
+	return allowed, nil
+}
+
+// checkToken calls a validation endpoint of the server. Any answer but OK,
+// Unauthorized or Forbidden is an error, so an unavailable server does not
+// read as a denial.
+func checkToken(endpoint string, token string) (bool, error) {
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
 		return false, err
@@ -144,10 +370,22 @@ func ValidateUser(token string, connType string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	log.Printf("Validating token for connType=%s, statusCode=%d", connType, res.StatusCode)
-	return res.StatusCode == 200, nil
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d from %s", res.StatusCode, endpoint)
 }
 
+// ServeWs upgrades a connection. A client may name one topic with the
+// deviceId and connType query parameters, as the dashboards did before topics,
+// or connect without them and subscribe to topics over the socket. The
+// replayLast and replaySince parameters ask for recent messages of the topic
+// named in the URL.
 func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 	token := r.Header.Get("Sec-Websocket-Protocol")
 	if token == "" {
@@ -155,14 +393,26 @@ func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing authentication token", http.StatusUnauthorized)
 		return
 	}
+	token = strings.Split(token, ",")[0]
 
 	deviceId := r.URL.Query().Get("deviceId")
 	connType := r.URL.Query().Get("connType")
-	if deviceId == "" || connType == "" {
+	replayLast, _ := strconv.Atoi(r.URL.Query().Get("replayLast"))
+	replay := ReplayRequest{Last: replayLast, Since: r.URL.Query().Get("replaySince")}
+	if _, _, err := replay.window(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	legacy := deviceId != "" || connType != ""
+	if legacy && (deviceId == "" || connType == "") {
 		log.Println("Invalid request! Missing device id or connection params!")
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	if !legacy {
+		// Any user may connect, topics are checked as they are subscribed
+		connType = connTypeConsumption
+	}
 
 	valid, err := ValidateUser(token, connType)
 
@@ -176,6 +426,19 @@ func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if legacy && deviceScoped(connType) {
+		allowed, err := ValidateDevice(token, deviceId)
+		if err != nil {
+			log.Printf("Error validating access to device %s: %v", deviceId, err)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			log.Printf("User has no access to device %s, refusing connection!", deviceId)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -183,13 +446,23 @@ func ServeWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := newClient(conn, deviceId, connType)
+	client := newClient(conn, r.RemoteAddr, token, legacy, wsServer.sendBuffer)
+	client.roles[requiredRole(connType)] = true
+	if legacy {
+		client.topics[topicOf(connType, deviceId)] = true
+		if deviceScoped(connType) {
+			client.devices[deviceId] = true
+		}
+	}
 	wsServer.register <- client
 
-	go client.writePump()
+	go client.writePump(wsServer)
 	go client.readPump(wsServer)
+	if legacy && !replay.empty() {
+		wsServer.replayTo(client, topicOf(connType, deviceId), replay)
+	}
 
-	log.Printf("New client connected: deviceId=%s, connType=%s", deviceId, connType)
+	log.Printf("New client connected: %s, deviceId=%s, connType=%s", client.name, deviceId, connType)
 }
 
 func (server *WsServer) Run() {
@@ -207,19 +480,233 @@ func (server *WsServer) Run() {
 	}
 }
 
-func (server *WsServer) SendMessage(deviceId string, message []byte, connType string) {
+// SendMessage queues a message for the subscribers of a topic. It never
+// waits for the network, so the broker consumers calling it are not slowed
+// down by slow clients.
+func (server *WsServer) SendMessage(target string, message []byte, connType string) {
+	topic := topicOf(connType, target)
+
+	server.mu.RLock()
+	clients := make([]*WebsocketClient, 0, len(server.subscribers[topic]))
+	for client := range server.subscribers[topic] {
+		clients = append(clients, client)
+	}
+	server.mu.RUnlock()
+
+	var wrapped []byte
+	for _, client := range clients {
+		frame := message
+		if !client.legacy {
+			if wrapped == nil {
+				var err error
+				wrapped, err = json.Marshal(topicMessage{Topic: topic, Data: message})
+				if err != nil {
+					log.Printf("Failed marshalling message for topic %s: %v", topic, err)
+					return
+				}
+			}
+			frame = wrapped
+		}
+		server.enqueue(client, frame)
+	}
+}
+
+// enqueue hands a frame to the client's writePump, applying the slow client
+// policy when its queue is full.
+func (server *WsServer) enqueue(client *WebsocketClient, frame []byte) {
+	select {
+	case client.send <- frame:
+		server.stats.Queued.Add(1)
+		return
+	default:
+	}
+
+	server.stats.Dropped.Add(1)
+	if server.policy == DisconnectClient {
+		select {
+		case <-client.done:
+		default:
+			log.Printf("Disconnecting client %s, its send queue of %d frames is full", client.name, cap(client.send))
+			server.stats.Disconnected.Add(1)
+			go server.unregisterClient(client)
+		}
+		return
+	}
+	if client.dropped.Add(1) == 1 {
+		log.Printf("Client %s is too slow, dropping frames while its send queue is full", client.name)
+	}
+}
+
+// replayTo queues the recent messages of a topic for a client that just
+// subscribed to it. Messages published meanwhile may arrive before them.
+func (server *WsServer) replayTo(client *WebsocketClient, topic string, request ReplayRequest) {
+	replay := server.replay.Load()
+	if replay == nil {
+		return
+	}
+	last, since, err := request.window(time.Now())
+	if err != nil {
+		log.Printf("Not replaying %s to client %s: %v", topic, client.name, err)
+		return
+	}
+	payloads, err := replay.Recent(context.Background(), topic, last, since)
+	if err != nil {
+		log.Printf("Failed to replay %s to client %s: %v", topic, client.name, err)
+		return
+	}
+	for _, payload := range payloads {
+		frame := []byte(payload)
+		if !client.legacy {
+			frame, err = json.Marshal(topicMessage{Topic: topic, Data: payload, Replayed: true})
+			if err != nil {
+				log.Printf("Failed marshalling replay of %s: %v", topic, err)
+				return
+			}
+		}
+		server.enqueue(client, frame)
+	}
+	log.Printf("Replayed %d messages of %s to client %s", len(payloads), topic, client.name)
+}
+
+// reportStats logs the outbound frame counters whenever they changed.
+func (server *WsServer) reportStats(ctx context.Context) {
+	ticker := time.NewTicker(wsReportEvery)
+	defer ticker.Stop()
+
+	var lastQueued, lastDropped int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			queued, dropped := server.stats.Queued.Load(), server.stats.Dropped.Load()
+			if queued == lastQueued && dropped == lastDropped {
+				continue
+			}
+			lastQueued, lastDropped = queued, dropped
+			log.Printf("WebSocket frames: %d queued, %d sent, %d dropped, %d slow clients disconnected, %d write failures",
+				queued, server.stats.Sent.Load(), dropped, server.stats.Disconnected.Load(), server.stats.WriteFailures.Load())
+		}
+	}
+}
+
+func (server *WsServer) Stats() *WsStats {
+	return &server.stats
+}
+
+// clientsByConnType counts the connected clients following at least one
+// topic of each connection type.
+func (server *WsServer) clientsByConnType() map[string]int64 {
 	server.mu.RLock()
 	defer server.mu.RUnlock()
 
+	counts := map[string]int64{
+		connTypeConsumption:  0,
+		connTypeAvailability: 0,
+		connTypeCity:         0,
+		connTypeOutage:       0,
+		connTypeAnomaly:      0,
+		connTypeAlert:        0,
+	}
 	for client := range server.clients {
-		if client.deviceId == deviceId && client.connType == connType {
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err := client.conn.WriteMessage(websocket.TextMessage, message)
+		seen := make(map[string]bool)
+		for topic := range client.topics {
+			connType, _, err := parseTopic(topic)
+			if err != nil || seen[connType] {
+				continue
+			}
+			seen[connType] = true
+			counts[connType]++
+		}
+	}
+	return counts
+}
+
+// handleSubscription applies a subscribe or unsubscribe request of a client.
+func (server *WsServer) handleSubscription(client *WebsocketClient, request subscriptionRequest) subscriptionReply {
+	reply := subscriptionReply{Action: request.Action}
+	reject := func(topic string, reason string) {
+		if reply.Rejected == nil {
+			reply.Rejected = make(map[string]string)
+		}
+		reply.Rejected[topic] = reason
+	}
+
+	if request.Action == "subscribe" {
+		if _, _, err := request.Replay.window(time.Now()); err != nil {
+			for _, topic := range request.Topics {
+				reject(topic, err.Error())
+			}
+			return reply
+		}
+	}
+
+	for _, topic := range request.Topics {
+		connType, target, err := parseTopic(topic)
+		if err != nil {
+			reject(topic, err.Error())
+			continue
+		}
+		switch request.Action {
+		case "subscribe":
+			allowed, err := client.authorize(connType, target)
 			if err != nil {
-				log.Printf("Error sending message to client %s: %v", client.deviceId, err)
-				go server.unregisterClient(client)
+				log.Printf("Error validating client %s for %s: %v", client.name, topic, err)
+				reject(topic, "authentication error")
+				continue
+			}
+			if !allowed {
+				reject(topic, "unauthorized")
+				continue
 			}
+			server.subscribe(client, topic)
+		case "unsubscribe":
+			server.unsubscribe(client, topic)
+		default:
+			reject(topic, fmt.Sprintf("unknown action %q", request.Action))
+			continue
 		}
+		reply.Topics = append(reply.Topics, topic)
+	}
+	return reply
+}
+
+func (server *WsServer) subscribe(client *WebsocketClient, topic string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	select {
+	case <-client.done:
+		// Already unregistered, the subscription would never be removed
+		return
+	default:
+	}
+	server.addSubscription(client, topic)
+	log.Printf("Client %s subscribed to %s", client.name, topic)
+}
+
+// addSubscription expects the server's lock to be held.
+func (server *WsServer) addSubscription(client *WebsocketClient, topic string) {
+	if server.subscribers[topic] == nil {
+		server.subscribers[topic] = make(map[*WebsocketClient]bool)
+	}
+	server.subscribers[topic][client] = true
+	client.topics[topic] = true
+}
+
+func (server *WsServer) unsubscribe(client *WebsocketClient, topic string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.removeSubscription(client, topic)
+}
+
+// removeSubscription expects the server's lock to be held.
+func (server *WsServer) removeSubscription(client *WebsocketClient, topic string) {
+	delete(client.topics, topic)
+	delete(server.subscribers[topic], client)
+	if len(server.subscribers[topic]) == 0 {
+		delete(server.subscribers, topic)
 	}
 }
 
@@ -233,6 +720,7 @@ func (server *WsServer) Shutdown() {
 		client.conn.Close()
 	}
 	server.clients = make(map[*WebsocketClient]bool)
+	server.subscribers = make(map[string]map[*WebsocketClient]bool)
 }
 
 func (server *WsServer) registerClient(client *WebsocketClient) {
@@ -240,7 +728,10 @@ func (server *WsServer) registerClient(client *WebsocketClient) {
 	defer server.mu.Unlock()
 
 	server.clients[client] = true
-	log.Printf("Client registered: deviceId=%s, connType=%s", client.deviceId, client.connType)
+	for topic := range client.topics {
+		server.addSubscription(client, topic)
+	}
+	log.Printf("Client registered: %s", client.name)
 }
 
 func (server *WsServer) unregisterClient(client *WebsocketClient) {
@@ -250,15 +741,21 @@ func (server *WsServer) unregisterClient(client *WebsocketClient) {
 	if _, ok := server.clients[client]; ok {
 		close(client.done)
 		delete(server.clients, client)
+		for topic := range client.topics {
+			server.removeSubscription(client, topic)
+		}
 		client.conn.Close()
-		log.Printf("Client unregistered: deviceId=%s, connType=%s", client.deviceId, client.connType)
+		log.Printf("Client unregistered: %s", client.name)
 	}
 }
 
-func HttpServer(port string, wsServer *WsServer) {
+func HttpServer(port string, wsServer *WsServer, consumer *atomic.Pointer[Consumer]) {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		ServeWs(wsServer, w, r)
 	})
+	http.HandleFunc("/healthz", healthzHandler(consumer))
+	http.HandleFunc("/readyz", readyzHandler(consumer))
+	http.HandleFunc("/metrics", metricsHandler(wsServer, consumer))
 
 	server := &http.Server{
 		Addr:         port,
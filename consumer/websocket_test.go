@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient is a client whose token validations are cached already, so
+// subscribing needs no server.
+func newTestClient(name string, legacy bool) *WebsocketClient {
+	return &WebsocketClient{
+		name:    name,
+		legacy:  legacy,
+		roles:   map[string]bool{"user": true, "admin": false},
+		devices: map[string]bool{"device-1": true, "device-2": false},
+		topics:  make(map[string]bool),
+		send:    make(chan []byte, 8),
+		done:    make(chan struct{}),
+	}
+}
+
+func subscribers(server *WsServer, topic string) []string {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	var names []string
+	for client := range server.subscribers[topic] {
+		names = append(names, client.name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestHandleSubscriptionUpdatesTopicIndex(t *testing.T) {
+	server := NewWsServer(8, DropFrames)
+	alice := newTestClient("alice", false)
+	bob := newTestClient("bob", false)
+	server.registerClient(alice)
+	server.registerClient(bob)
+
+	reply := server.handleSubscription(alice, subscriptionRequest{
+		Action: "subscribe",
+		Topics: []string{"consumption:device-1", "consumption:device-2", "csm:Novi Sad", "weather:Novi Sad"},
+	})
+	if !slices.Equal(reply.Topics, []string{"consumption:device-1"}) {
+		t.Fatalf("subscribed to %v, want only consumption:device-1", reply.Topics)
+	}
+	want := map[string]string{
+		"consumption:device-2": "unauthorized",
+		"csm:Novi Sad":         "unauthorized",
+		"weather:Novi Sad":     `unknown connection type "weather"`,
+	}
+	if fmt.Sprint(reply.Rejected) != fmt.Sprint(want) {
+		t.Fatalf("rejected %v, want %v", reply.Rejected, want)
+	}
+	server.handleSubscription(bob, subscriptionRequest{Action: "subscribe", Topics: []string{"consumption:device-1"}})
+	if names := subscribers(server, "consumption:device-1"); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Fatalf("consumption:device-1 followed by %v, want [alice bob]", names)
+	}
+
+	server.handleSubscription(alice, subscriptionRequest{Action: "unsubscribe", Topics: []string{"consumption:device-1"}})
+	if names := subscribers(server, "consumption:device-1"); !slices.Equal(names, []string{"bob"}) {
+		t.Fatalf("consumption:device-1 followed by %v after alice left, want [bob]", names)
+	}
+	if len(alice.topics) != 0 {
+		t.Fatalf("alice still lists %v", alice.topics)
+	}
+
+	server.handleSubscription(bob, subscriptionRequest{Action: "unsubscribe", Topics: []string{"consumption:device-1"}})
+	if _, ok := server.subscribers["consumption:device-1"]; ok {
+		t.Fatal("a topic nobody follows is still indexed")
+	}
+}
+
+func TestSendMessageWrapsFramesOfTopicClients(t *testing.T) {
+	server := NewWsServer(8, DropFrames)
+	multiplexed := newTestClient("multiplexed", false)
+	legacy := newTestClient("legacy", true)
+	legacy.topics[topicOf(connTypeConsumption, "device-1")] = true
+	server.registerClient(multiplexed)
+	server.registerClient(legacy)
+	server.handleSubscription(multiplexed, subscriptionRequest{Action: "subscribe", Topics: []string{"consumption:device-1"}})
+
+	payload := []byte(`{"DeviceId":"device-1","Consumption":0.3}`)
+	server.SendMessage("device-1", payload, connTypeConsumption)
+	server.SendMessage("device-2", []byte(`{}`), connTypeConsumption)
+
+	// Clients that named their topic in the URL get the payload as it is
+	if frame := <-legacy.send; string(frame) != string(payload) {
+		t.Fatalf("legacy client got %s, want the bare payload", frame)
+	}
+	var message topicMessage
+	if err := json.Unmarshal(<-multiplexed.send, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Topic != "consumption:device-1" || string(message.Data) != string(payload) {
+		t.Fatalf("multiplexed client got %+v, want the payload wrapped in its topic", message)
+	}
+	if len(legacy.send)+len(multiplexed.send) != 0 {
+		t.Fatal("a message of an unfollowed topic was queued")
+	}
+}
+
+// newTestConn returns the server side of a live WebSocket connection.
+func newTestConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(stub.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(stub.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-accepted
+}
+
+func TestEnqueueAppliesSlowClientPolicy(t *testing.T) {
+	tests := []struct {
+		policy       SlowClientPolicy
+		disconnected bool
+	}{
+		{DropFrames, false},
+		{DisconnectClient, true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			server := NewWsServer(2, test.policy)
+			slow := newTestClient("slow", false)
+			slow.conn = newTestConn(t)
+			slow.send = make(chan []byte, server.sendBuffer)
+			fast := newTestClient("fast", false)
+			server.registerClient(slow)
+			server.registerClient(fast)
+			for _, client := range []*WebsocketClient{slow, fast} {
+				server.handleSubscription(client, subscriptionRequest{Action: "subscribe", Topics: []string{"consumption:device-1"}})
+			}
+
+			// Nobody drains the slow client, the third frame does not fit
+			for i := 0; i < 3; i++ {
+				server.SendMessage("device-1", []byte(fmt.Sprintf(`{"Consumption":%d}`, i)), connTypeConsumption)
+			}
+			if len(fast.send) != 3 {
+				t.Fatalf("the fast client got %d of 3 frames", len(fast.send))
+			}
+			if len(slow.send) != 2 || server.stats.Dropped.Load() != 1 {
+				t.Fatalf("slow client queued %d frames with %d dropped, want 2 and 1", len(slow.send), server.stats.Dropped.Load())
+			}
+
+			if test.disconnected {
+				select {
+				case <-slow.done:
+				case <-time.After(time.Second):
+					t.Fatal("the slow client was not disconnected")
+				}
+				if names := subscribers(server, "consumption:device-1"); !slices.Equal(names, []string{"fast"}) {
+					t.Fatalf("consumption:device-1 followed by %v after the disconnect, want [fast]", names)
+				}
+				return
+			}
+			select {
+			case <-slow.done:
+				t.Fatal("the slow client was disconnected while dropping frames")
+			default:
+			}
+			if slow.dropped.Load() != 1 {
+				t.Fatalf("the slow client dropped %d frames, want 1", slow.dropped.Load())
+			}
+		})
+	}
+}
+
+// validationStub stands in for the /validate endpoints of the server. Paths
+// answer with the status queued for them, the last one repeats.
+type validationStub struct {
+	mu       sync.Mutex
+	statuses map[string][]int
+	requests map[string]int
+}
+
+func newValidationStub(t *testing.T, statuses map[string][]int) *validationStub {
+	stub := &validationStub{statuses: statuses, requests: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/api")
+		stub.requests[path]++
+		if r.Header.Get("Authorization") != "Bearer user-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		queued := stub.statuses[path]
+		if len(queued) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(queued[0])
+		if len(queued) > 1 {
+			stub.statuses[path] = queued[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	previous := serverAPI
+	serverAPI = server.URL + "/api"
+	t.Cleanup(func() { serverAPI = previous })
+	return stub
+}
+
+func (s *validationStub) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func TestAuthorizeCachesAnswersButNotErrors(t *testing.T) {
+	stub := newValidationStub(t, map[string][]int{
+		"/validate/user":            {http.StatusOK},
+		"/validate/admin":           {http.StatusForbidden},
+		"/validate/device/device-1": {http.StatusBadGateway, http.StatusOK},
+		"/validate/device/device-2": {http.StatusForbidden},
+		"/validate/device/device 3": {http.StatusOK},
+	})
+	client := &WebsocketClient{name: "client", token: "user-token", roles: make(map[string]bool), devices: make(map[string]bool)}
+
+	steps := []struct {
+		connType string
+		target   string
+		allowed  bool
+		failed   bool
+	}{
+		// The server was unavailable, which must not read as a denial
+		{connTypeConsumption, "device-1", false, true},
+		{connTypeConsumption, "device-1", true, false},
+		{connTypeAnomaly, "device-1", true, false},
+		{connTypeConsumption, "device-2", false, false},
+		{connTypeConsumption, "device-2", false, false},
+		{connTypeConsumption, "device 3", true, false},
+		{connTypeCity, "Novi Sad", false, false},
+		{connTypeOutage, "Novi Sad", false, false},
+	}
+	for i, step := range steps {
+		allowed, err := client.authorize(step.connType, step.target)
+		if (err != nil) != step.failed || allowed != step.allowed {
+			t.Fatalf("step %d, %s:%s: got %v, %v, want allowed %v and failed %v", i+1, step.connType, step.target, allowed, err, step.allowed, step.failed)
+		}
+	}
+
+	want := map[string]int{
+		"/validate/user":            1,
+		"/validate/admin":           1,
+		"/validate/device/device-1": 2,
+		"/validate/device/device-2": 1,
+		"/validate/device/device 3": 1,
+	}
+	for path, count := range want {
+		if got := stub.count(path); got != count {
+			t.Errorf("%s called %d times, want %d", path, got, count)
+		}
+	}
+}
+
+func TestLegacyURLGetsBarePayloads(t *testing.T) {
+	newValidationStub(t, map[string][]int{
+		"/validate/user":            {http.StatusOK},
+		"/validate/device/device-1": {http.StatusOK},
+		"/validate/device/device-2": {http.StatusForbidden},
+	})
+	wsServer := NewWsServer(8, DropFrames)
+	go wsServer.Run()
+	defer wsServer.Shutdown()
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(wsServer, w, r)
+	}))
+	defer consumer.Close()
+
+	dial := func(query string) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(consumer.URL, "http") + "/ws" + query
+		return websocket.DefaultDialer.Dial(url, http.Header{"Sec-WebSocket-Protocol": {"user-token"}})
+	}
+	if _, res, err := dial("?deviceId=device-2&connType=consumption"); err == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("connecting to a device without access gave %v, want 403", err)
+	}
+
+	conn, _, err := dial("?deviceId=device-1&connType=consumption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(time.Second); len(subscribers(wsServer, "consumption:device-1")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the legacy client was never subscribed to its URL topic")
+		}
+	}
+
+	payload := `{"DeviceId":"device-1","Consumption":0.3}`
+	wsServer.SendMessage("device-1", []byte(payload), connTypeConsumption)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != payload {
+		t.Fatalf("legacy client got %s, want the bare payload", frame)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	defaultFollowUpWorkers = 8
+	defaultFollowUpQueue   = 1000
+)
+
+// WorkerPool runs tasks on a fixed number of goroutines. Tasks with the same
+// key go to the same worker and run in the order they were submitted, so the
+// work on a device is never reordered or run concurrently.
+type WorkerPool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewWorkerPool(workers int, queueSize int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	p := &WorkerPool{queues: make([]chan func(), workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// followUpPoolFromEnv reads FOLLOWUP_WORKERS and FOLLOWUP_QUEUE, the queue
+// size is per worker.
+func followUpPoolFromEnv() *WorkerPool {
+	return NewWorkerPool(envInt("FOLLOWUP_WORKERS", defaultFollowUpWorkers), envInt("FOLLOWUP_QUEUE", defaultFollowUpQueue))
+}
+
+func (p *WorkerPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for task := range queue {
+		task()
+	}
+}
+
+// Submit queues a task, it blocks while the worker of the key is full. Tasks
+// submitted after Close are run right away.
+func (p *WorkerPool) Submit(key string, task func()) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		task()
+		return
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	p.queues[hash.Sum32()%uint32(len(p.queues))] <- task
+}
+
+// Pending returns the number of queued tasks.
+func (p *WorkerPool) Pending() int {
+	pending := 0
+	for _, queue := range p.queues {
+		pending += len(queue)
+	}
+	return pending
+}
+
+// Close runs the queued tasks and stops the workers.
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
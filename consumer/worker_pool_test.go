@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolKeepsOrderPerKey(t *testing.T) {
+	pool := NewWorkerPool(4, 2)
+
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for device := 0; device < 10; device++ {
+			key := "device-" + strconv.Itoa(device)
+			pool.Submit(key, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				seen[key] = append(seen[key], i)
+			})
+		}
+	}
+	pool.Close()
+
+	for key, order := range seen {
+		if len(order) != 100 {
+			t.Fatalf("%s ran %d tasks, want 100", key, len(order))
+		}
+		for i, n := range order {
+			if n != i {
+				t.Fatalf("%s ran task %d at position %d", key, n, i)
+			}
+		}
+	}
+	if len(seen) != 10 {
+		t.Errorf("tasks of %d keys ran, want 10", len(seen))
+	}
+}
+
+func TestWorkerPoolRunsTasksAfterClose(t *testing.T) {
+	pool := NewWorkerPool(1, 1)
+	pool.Close()
+
+	ran := false
+	pool.Submit("device", func() { ran = true })
+	if !ran {
+		t.Error("task submitted after Close did not run")
+	}
+}
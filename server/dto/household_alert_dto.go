@@ -0,0 +1,22 @@
+package dto
+
+import "time"
+
+type HouseholdAlertDto struct {
+	Type      string  `json:"type" binding:"required,oneof=daily_consumption monthly_bill no_data"`
+	Threshold float64 `json:"threshold" binding:"required,gt=0"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+// AlertNotificationDto is pushed to the measurement consumer, which forwards
+// it to the WebSocket clients following the household's device.
+type AlertNotificationDto struct {
+	RuleID      uint64
+	HouseholdID uint64
+	DeviceID    string
+	Type        string
+	Threshold   float64
+	Value       float64
+	Message     string
+	FiredAt     time.Time
+}
@@ -0,0 +1,20 @@
+package dto
+
+import "time"
+
+type OutageSearchParams struct {
+	Scope  string     `json:"scope"`
+	City   string     `json:"city"`
+	Street string     `json:"street"`
+	Active *bool      `json:"active"`
+	From   *time.Time `json:"from"`
+	To     *time.Time `json:"to"`
+}
+
+type OutageQueryParams struct {
+	Page      int                `json:"page"`
+	PageSize  int                `json:"pageSize"`
+	SortBy    string             `json:"sortBy"`
+	SortOrder string             `json:"sortOrder"`
+	Search    OutageSearchParams `json:"search"`
+}
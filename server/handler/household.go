@@ -86,6 +86,39 @@ func (h HouseholdHandler) GetMyHouseholdById(c *gin.Context) {
 	c.JSON(200, gin.H{"data": data})
 }
 
+// ValidateDeviceAccess answers the consumer's WebSocket server whether the
+// caller may follow the live data of a device. Admins may follow every
+// device, users only those of households they own or were granted access to.
+func (h HouseholdHandler) ValidateDeviceAccess(c *gin.Context) {
+	deviceID := c.Param("deviceId")
+	claimsMap, ok := c.MustGet("claims").(jwt.MapClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user claims format"})
+		return
+	}
+	if role, _ := claimsMap["role"].(string); role == "Admin" || role == "SuperAdmin" {
+		c.JSON(http.StatusOK, gin.H{"data": "ok"})
+		return
+	}
+	userIDFloat, ok := claimsMap["id"].(float64)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	allowed, err := h.service.CanAccessDevice(deviceID, uint64(userIDFloat))
+	if err != nil {
+		h.logger.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check device access"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have access to this device"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": "ok"})
+}
+
 func (h HouseholdHandler) Query(c *gin.Context) {
 	page := c.DefaultQuery("page", "1")
 	pageSize := c.DefaultQuery("pageSize", "10")
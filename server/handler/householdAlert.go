@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"watt-flow/dto"
+	"watt-flow/service"
+	"watt-flow/util"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type HouseholdAlertHandler struct {
+	service service.IHouseholdAlertService
+	logger  util.Logger
+}
+
+func NewHouseholdAlertHandler(service service.IHouseholdAlertService, logger util.Logger) *HouseholdAlertHandler {
+	return &HouseholdAlertHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+// currentUserID reads the logged in user from the claims, it answers the
+// request itself when they are missing.
+func (h *HouseholdAlertHandler) currentUserID(c *gin.Context) (uint64, bool) {
+	claims, exists := c.Get("claims")
+	if !exists {
+		h.logger.Error("Claims not found in context, middleware might be missing")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User claims not found"})
+		c.Abort()
+		return 0, false
+	}
+
+	claimsMap, ok := claims.(jwt.MapClaims)
+	if !ok {
+		h.logger.Error("Invalid claims format", zap.Any("claims", claims))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user claims format"})
+		c.Abort()
+		return 0, false
+	}
+
+	loggedInUserID, ok := claimsMap["id"].(float64)
+	if !ok {
+		h.logger.Error("ID not found in claims")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in claims"})
+		c.Abort()
+		return 0, false
+	}
+	return uint64(loggedInUserID), true
+}
+
+// writeError maps the errors of the alert service to a response.
+func (h *HouseholdAlertHandler) writeError(c *gin.Context, err error, message string) {
+	h.logger.Error(message, err)
+	switch err.Error() {
+	case "household not found", "alert not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case "forbidden: only the owner can manage alerts":
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func (h *HouseholdAlertHandler) List(c *gin.Context) {
+	householdId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid household ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid household ID format"})
+		return
+	}
+	userId, ok := h.currentUserID(c)
+	if !ok {
+		return
+	}
+
+	alerts, err := h.service.FindByHousehold(householdId, userId)
+	if err != nil {
+		h.writeError(c, err, "Failed to get alerts")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": alerts})
+}
+
+func (h *HouseholdAlertHandler) Create(c *gin.Context) {
+	householdId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid household ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid household ID format"})
+		return
+	}
+	var alertDto dto.HouseholdAlertDto
+	if err := c.ShouldBindJSON(&alertDto); err != nil {
+		h.logger.Error("Invalid request body for alert", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userId, ok := h.currentUserID(c)
+	if !ok {
+		return
+	}
+
+	alert, err := h.service.Create(householdId, alertDto, userId)
+	if err != nil {
+		h.writeError(c, err, "Failed to create alert")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": alert})
+}
+
+func (h *HouseholdAlertHandler) Update(c *gin.Context) {
+	householdId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid household ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid household ID format"})
+		return
+	}
+	alertId, err := strconv.ParseUint(c.Param("alertId"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid alert ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert ID format"})
+		return
+	}
+	var alertDto dto.HouseholdAlertDto
+	if err := c.ShouldBindJSON(&alertDto); err != nil {
+		h.logger.Error("Invalid request body for alert", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userId, ok := h.currentUserID(c)
+	if !ok {
+		return
+	}
+
+	alert, err := h.service.Update(householdId, alertId, alertDto, userId)
+	if err != nil {
+		h.writeError(c, err, "Failed to update alert")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": alert})
+}
+
+func (h *HouseholdAlertHandler) Delete(c *gin.Context) {
+	// The DELETE route names the household householdId, it shares its path
+	// with revoking household access
+	householdId, err := strconv.ParseUint(c.Param("householdId"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid household ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid household ID format"})
+		return
+	}
+	alertId, err := strconv.ParseUint(c.Param("alertId"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid alert ID format", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert ID format"})
+		return
+	}
+	userId, ok := h.currentUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.Delete(householdId, alertId, userId); err != nil {
+		h.writeError(c, err, "Failed to delete alert")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"watt-flow/dto"
+	"watt-flow/service"
+	"watt-flow/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OutageHandler struct {
+	service service.IOutageService
+	logger  util.Logger
+}
+
+func NewOutageHandler(service service.IOutageService, logger util.Logger) *OutageHandler {
+	return &OutageHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+func (h OutageHandler) Query(c *gin.Context) {
+	page := c.DefaultQuery("page", "1")
+	pageSize := c.DefaultQuery("pageSize", "10")
+	sortBy := c.DefaultQuery("sortBy", "started_at")
+	sortOrder := c.DefaultQuery("sortOrder", "desc")
+	search := c.DefaultQuery("search", "{}")
+
+	pageInt, err := strconv.Atoi(page)
+	if err != nil || pageInt < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
+		return
+	}
+	pageSizeInt, err := strconv.Atoi(pageSize)
+	if err != nil || pageSizeInt < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pageSize parameter"})
+		return
+	}
+
+	var searchParams dto.OutageSearchParams
+	if search != "" && search != "{}" {
+		if err := json.Unmarshal([]byte(search), &searchParams); err != nil {
+			h.logger.Error("Invalid search parameter", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search parameter format"})
+			return
+		}
+	}
+
+	params := dto.OutageQueryParams{
+		Page:      pageInt,
+		PageSize:  pageSizeInt,
+		SortBy:    sortBy,
+		SortOrder: sortOrder,
+		Search:    searchParams,
+	}
+	outages, total, err := h.service.Query(&params)
+	if err != nil {
+		h.logger.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query outages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"outages": outages, "total": total})
+}
+
+func (h OutageHandler) GetById(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.logger.Error("Invalid outage ID:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid outage ID"})
+		return
+	}
+	outage, err := h.service.FindById(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Outage not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": outage})
+}
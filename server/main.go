@@ -44,6 +44,7 @@ func main() {
 	defer cancel()
 
 	go monitorDBConnections(ctx, dependencies, dependencies.Logger)
+	go dependencies.HouseholdAlertService.Run(ctx)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
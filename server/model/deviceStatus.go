@@ -3,6 +3,8 @@ package model
 type DeviceStatus struct {
 	DeviceId string `gorm:"primaryKey" json:"device_id"`
 	IsActive bool   `json:"is_active"`
+	// State is online, offline or flapping for meters switching too often
+	State string `json:"state"`
 }
 
 func (DeviceStatus) TableName() string {
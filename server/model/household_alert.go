@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Household alert types.
+const (
+	DailyConsumptionAlert = "daily_consumption"
+	MonthlyBillAlert      = "monthly_bill"
+	NoDataAlert           = "no_data"
+)
+
+// HouseholdAlert is a rule the owner of a household sets on its consumption.
+// Threshold is in kWh for the daily consumption, in the pricelist's currency
+// for the projected monthly bill and in hours for missing data.
+type HouseholdAlert struct {
+	Id          uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	HouseholdID uint64     `gorm:"not null;index" json:"household_id"`
+	Household   *Household `gorm:"foreignKey:HouseholdID" json:"-"`
+	Type        string     `gorm:"not null" json:"type"`
+	Threshold   float64    `gorm:"not null" json:"threshold"`
+	Enabled     bool       `gorm:"not null" json:"enabled"`
+	// FiredFor is the day, month or gap in the data the rule last fired for,
+	// a rule fires once for each of them
+	FiredFor    string     `gorm:"not null;default:''" json:"-"`
+	LastFiredAt *time.Time `json:"last_fired_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// Outage is an incident the consumer opens when many meters of a street or a
+// city go offline together. EndedAt is nil while it is ongoing.
+type Outage struct {
+	ID              uint64     `gorm:"primary_key" json:"id"`
+	Scope           string     `gorm:"not null" json:"scope"`
+	City            string     `gorm:"not null;index" json:"city"`
+	Street          string     `gorm:"not null;default:''" json:"street"`
+	AffectedDevices int        `gorm:"not null" json:"affected_devices"`
+	StartedAt       time.Time  `gorm:"not null;index" json:"started_at"`
+	EndedAt         *time.Time `json:"ended_at"`
+}
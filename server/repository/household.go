@@ -86,6 +86,27 @@ func (repository *HouseholdRepository) FindMyHouseholdById(id uint64, userId uin
 	return &household, nil
 }
 
+// CanAccessDevice reports whether the user owns the household metered by the
+// device or was granted access to it.
+func (repository *HouseholdRepository) CanAccessDevice(deviceID string, userId uint64) (bool, error) {
+	var count int64
+	err := repository.Database.Model(&model.Household{}).
+		Where("device_status_id = ?", deviceID).
+		Where(`
+            owner_id = ? OR
+            EXISTS (
+                SELECT 1 FROM household_accesses ha
+                WHERE ha.household_id = households.id AND ha.user_id = ?
+            )
+        `, userId, userId).
+		Count(&count).Error
+	if err != nil {
+		repository.Logger.Error("Error checking device access", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (repository *HouseholdRepository) FindByStatus(status model.HouseholdStatus) ([]model.Household, error) {
 	var households []model.Household
 	result := repository.Database.Where("status = ?", status).Find(&households)
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"time"
+	"watt-flow/db"
+	"watt-flow/model"
+	"watt-flow/util"
+
+	"gorm.io/gorm"
+)
+
+type HouseholdAlertRepository struct {
+	Database db.Database
+	Logger   util.Logger
+}
+
+func NewHouseholdAlertRepository(db db.Database, logger util.Logger) *HouseholdAlertRepository {
+	err := db.AutoMigrate(&model.HouseholdAlert{})
+	if err != nil {
+		logger.Error("Error migrating household alert repo", err)
+	}
+	return &HouseholdAlertRepository{
+		Database: db,
+		Logger:   logger,
+	}
+}
+
+func (r *HouseholdAlertRepository) WithTrx(trxHandle *gorm.DB) *HouseholdAlertRepository {
+	if trxHandle == nil {
+		r.Logger.Error("Transaction Database not found in gin context. ")
+		return r
+	}
+	return &HouseholdAlertRepository{
+		Database: db.Database{DB: trxHandle},
+		Logger:   r.Logger,
+	}
+}
+
+// FindByHouseholdId returns the alerts of a household, oldest first.
+func (r *HouseholdAlertRepository) FindByHouseholdId(householdID uint64) ([]model.HouseholdAlert, error) {
+	var alerts []model.HouseholdAlert
+	if err := r.Database.Where("household_id = ?", householdID).Order("id").Find(&alerts).Error; err != nil {
+		r.Logger.Error("Error finding household alerts", err)
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// FindByIdAndHouseholdId returns gorm.ErrRecordNotFound when the alert is
+// not one of the household's.
+func (r *HouseholdAlertRepository) FindByIdAndHouseholdId(id uint64, householdID uint64) (*model.HouseholdAlert, error) {
+	var alert model.HouseholdAlert
+	if err := r.Database.Where("id = ? AND household_id = ?", id, householdID).First(&alert).Error; err != nil {
+		r.Logger.Error("Error finding household alert by ID", err)
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// FindEnabled returns the enabled alerts with their household, its owner
+// and its property.
+func (r *HouseholdAlertRepository) FindEnabled() ([]model.HouseholdAlert, error) {
+	var alerts []model.HouseholdAlert
+	if err := r.Database.Preload("Household.Owner").Preload("Household.Property").Where("enabled = ?", true).Find(&alerts).Error; err != nil {
+		r.Logger.Error("Error finding enabled household alerts", err)
+		return nil, err
+	}
+	return alerts, nil
+}
+
+func (r *HouseholdAlertRepository) Create(alert *model.HouseholdAlert) error {
+	if err := r.Database.Create(alert).Error; err != nil {
+		r.Logger.Error("Error creating household alert", err)
+		return err
+	}
+	return nil
+}
+
+// Update saves the rule of an alert and lets it fire again.
+func (r *HouseholdAlertRepository) Update(alert *model.HouseholdAlert) error {
+	alert.FiredFor = ""
+	result := r.Database.Model(alert).Select("type", "threshold", "enabled", "fired_for").Updates(alert)
+	if result.Error != nil {
+		r.Logger.Error("Error updating household alert", result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (r *HouseholdAlertRepository) Delete(id uint64, householdID uint64) error {
+	result := r.Database.Where("id = ? AND household_id = ?", id, householdID).Delete(&model.HouseholdAlert{})
+	if result.Error != nil {
+		r.Logger.Error("Error deleting household alert", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// MarkFired records that an alert fired for a period and reports whether it
+// had not fired for it yet, so only one server instance notifies the owner.
+func (r *HouseholdAlertRepository) MarkFired(id uint64, period string, firedAt time.Time) (bool, error) {
+	result := r.Database.Model(&model.HouseholdAlert{}).
+		Where("id = ? AND fired_for <> ?", id, period).
+		Updates(map[string]interface{}{"fired_for": period, "last_fired_at": firedAt})
+	if result.Error != nil {
+		r.Logger.Error("Error marking household alert as fired", result.Error)
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ReleaseFired undoes MarkFired when the alert could not be delivered, so it
+// fires for the period again. It leaves an alert that was claimed since alone.
+func (r *HouseholdAlertRepository) ReleaseFired(id uint64, period string, previousPeriod string, previousFiredAt *time.Time) error {
+	result := r.Database.Model(&model.HouseholdAlert{}).
+		Where("id = ? AND fired_for = ?", id, period).
+		Updates(map[string]interface{}{"fired_for": previousPeriod, "last_fired_at": previousFiredAt})
+	if result.Error != nil {
+		r.Logger.Error("Error releasing household alert", result.Error)
+		return result.Error
+	}
+	return nil
+}
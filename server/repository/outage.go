@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"fmt"
+	"watt-flow/db"
+	"watt-flow/dto"
+	"watt-flow/model"
+	"watt-flow/util"
+
+	"gorm.io/gorm"
+)
+
+// outageSortColumns are the columns outages can be sorted by
+var outageSortColumns = map[string]bool{
+	"started_at":       true,
+	"ended_at":         true,
+	"affected_devices": true,
+	"city":             true,
+	"street":           true,
+}
+
+type OutageRepository struct {
+	Database db.Database
+	Logger   util.Logger
+}
+
+func NewOutageRepository(db db.Database, logger util.Logger) *OutageRepository {
+	err := db.AutoMigrate(&model.Outage{})
+	if err != nil {
+		logger.Error("Error migrating outage repo", err)
+	}
+	return &OutageRepository{
+		Database: db,
+		Logger:   logger,
+	}
+}
+
+func (r *OutageRepository) WithTrx(trxHandle *gorm.DB) *OutageRepository {
+	if trxHandle == nil {
+		r.Logger.Error("Transaction Database not found in gin context. ")
+		return r
+	}
+	return &OutageRepository{
+		Database: db.Database{DB: trxHandle},
+		Logger:   r.Logger,
+	}
+}
+
+func (repository *OutageRepository) FindById(id uint64) (*model.Outage, error) {
+	var outage model.Outage
+	if err := repository.Database.Where("id = ?", id).First(&outage).Error; err != nil {
+		repository.Logger.Error("Error finding outage by ID", err)
+		return nil, err
+	}
+	return &outage, nil
+}
+
+// Query returns a page of outages. An outage matches the From and To range
+// when it was ongoing at some point within it.
+func (repository *OutageRepository) Query(params *dto.OutageQueryParams) ([]model.Outage, int64, error) {
+	var outages []model.Outage
+	var total int64
+
+	query := repository.Database.Model(&model.Outage{})
+
+	search := params.Search
+	if search.Scope != "" {
+		query = query.Where("scope = ?", search.Scope)
+	}
+	if search.City != "" {
+		query = query.Where("city = ?", search.City)
+	}
+	if search.Street != "" {
+		query = query.Where("street ILIKE ?", "%"+search.Street+"%")
+	}
+	if search.Active != nil {
+		if *search.Active {
+			query = query.Where("ended_at IS NULL")
+		} else {
+			query = query.Where("ended_at IS NOT NULL")
+		}
+	}
+	if search.From != nil {
+		query = query.Where("(ended_at IS NULL OR ended_at >= ?)", *search.From)
+	}
+	if search.To != nil {
+		query = query.Where("started_at <= ?", *search.To)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		repository.Logger.Error("Error querying outage count", err)
+		return nil, 0, err
+	}
+
+	sortBy := params.SortBy
+	if !outageSortColumns[sortBy] {
+		sortBy = "started_at"
+	}
+	sortOrder := params.SortOrder
+	if sortOrder != "asc" && sortOrder != "desc" {
+		sortOrder = "desc"
+	}
+	query = query.Order(fmt.Sprintf("%s %s", sortBy, sortOrder))
+	offset := (params.Page - 1) * params.PageSize
+	query = query.Offset(offset).Limit(params.PageSize)
+
+	if err := query.Find(&outages).Error; err != nil {
+		repository.Logger.Error("Error querying outages", err)
+		return nil, 0, err
+	}
+	return outages, total, nil
+}
@@ -0,0 +1,32 @@
+package route
+
+import (
+	"github.com/gin-gonic/gin"
+	"watt-flow/middleware"
+	"watt-flow/server"
+)
+
+type HouseholdAlertRoute struct {
+	engine *gin.Engine
+}
+
+func (r HouseholdAlertRoute) Register(server *server.Server) {
+	server.Logger.Info("Setting up household alert routes")
+	authMid := middleware.NewAuthMiddleware(server.AuthService, server.Logger)
+
+	api := r.engine.Group("/api").Use(authMid.Handler())
+	{
+		// Not cached, the list is only for the owner and changes with every edit
+		api.GET("/household/:id/alerts", authMid.RoleMiddleware([]string{"Regular"}), server.HouseholdAlertHandler.List)
+		api.POST("/household/:id/alerts", authMid.RoleMiddleware([]string{"Regular"}), server.HouseholdAlertHandler.Create)
+		api.PUT("/household/:id/alerts/:alertId", authMid.RoleMiddleware([]string{"Regular"}), server.HouseholdAlertHandler.Update)
+		// Named householdId like the access revoke route sharing the DELETE tree
+		api.DELETE("/household/:householdId/alerts/:alertId", authMid.RoleMiddleware([]string{"Regular"}), server.HouseholdAlertHandler.Delete)
+	}
+}
+
+func NewHouseholdAlertRoute(engine *gin.Engine) *HouseholdAlertRoute {
+	return &HouseholdAlertRoute{
+		engine: engine,
+	}
+}
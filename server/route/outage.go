@@ -0,0 +1,33 @@
+package route
+
+import (
+	cache "github.com/chenyahui/gin-cache"
+	"github.com/chenyahui/gin-cache/persist"
+	"time"
+	"watt-flow/middleware"
+	"watt-flow/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OutageRoute struct {
+	engine *gin.Engine
+	store  persist.CacheStore
+}
+
+func (r OutageRoute) Register(server *server.Server) {
+	server.Logger.Info("Setting up outage routes")
+	authMid := middleware.NewAuthMiddleware(server.AuthService, server.Logger)
+	api := r.engine.Group("/api").Use(authMid.Handler())
+	{
+		api.GET("/outages", authMid.RoleMiddleware([]string{"Admin", "SuperAdmin"}), cache.CacheByRequestURI(r.store, 2*time.Second), server.OutageHandler.Query)
+		api.GET("/outages/:id", authMid.RoleMiddleware([]string{"Admin", "SuperAdmin"}), cache.CacheByRequestURI(r.store, 2*time.Second), server.OutageHandler.GetById)
+	}
+}
+
+func NewOutageRoute(engine *gin.Engine, store persist.CacheStore) *OutageRoute {
+	return &OutageRoute{
+		engine: engine,
+		store:  store,
+	}
+}
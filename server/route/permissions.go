@@ -18,6 +18,7 @@ func (r PermissionRoute) Register(server *server.Server) {
 	{
 		api.GET("/validate/admin", authMid.RoleMiddleware([]string{"Admin", "SuperAdmin"}), server.UserHandler.ReturnOk)
 		api.GET("/validate/user", authMid.RoleMiddleware([]string{"Regular", "Admin", "SuperAdmin"}), server.UserHandler.ReturnOk)
+		api.GET("/validate/device/:deviceId", authMid.RoleMiddleware([]string{"Regular", "Admin", "SuperAdmin"}), server.HouseholdHandler.ValidateDeviceAccess)
 	}
 }
 
@@ -51,4 +51,6 @@ func RegisterRoutes(
 	NewPricelistRoute(engine, cacheStore).Register(server)
 	NewBillRoute(engine, cacheStore).Register(server)
 	NewHouseholdAccessRoute(engine, cacheStore).Register(server)
+	NewOutageRoute(engine, cacheStore).Register(server)
+	NewHouseholdAlertRoute(engine).Register(server)
 }
@@ -35,6 +35,10 @@ type Server struct {
 	electricityConsumptionService service.IElectricityConsumptionService
 	HouseholdAccessService        service.IHouseholdAccessService
 	HouseholdAccessHandler        *handler.HouseholdAccessHandler
+	OutageService                 service.IOutageService
+	OutageHandler                 *handler.OutageHandler
+	HouseholdAlertService         service.IHouseholdAlertService
+	HouseholdAlertHandler         *handler.HouseholdAlertHandler
 	Db                            db.Database
 }
 
@@ -50,6 +54,8 @@ func NewServer(logger util.Logger, userService service.IUserService, authService
 	cityService service.ICityService, cityHandler *handler.CityHandler,
 	electricityConsumptionService service.IElectricityConsumptionService, electricityConsumptionHandler *handler.ElectricityConsumptionHandler,
 	householdAccessService service.IHouseholdAccessService, householdAccessHandler *handler.HouseholdAccessHandler,
+	outageService service.IOutageService, outageHandler *handler.OutageHandler,
+	householdAlertService service.IHouseholdAlertService, householdAlertHandler *handler.HouseholdAlertHandler,
 	db db.Database,
 ) *Server {
 	return &Server{
@@ -80,6 +86,10 @@ func NewServer(logger util.Logger, userService service.IUserService, authService
 		electricityConsumptionService: electricityConsumptionService,
 		HouseholdAccessService:        householdAccessService,
 		HouseholdAccessHandler:        householdAccessHandler,
+		OutageService:                 outageService,
+		OutageHandler:                 outageHandler,
+		HouseholdAlertService:         householdAlertService,
+		HouseholdAlertHandler:         householdAlertHandler,
 		Db:                            db,
 	}
 }
@@ -61,6 +61,14 @@ var householdAccessServiceSet = wire.NewSet(
 	service.NewHouseholdAccessService,
 	wire.Bind(new(service.IHouseholdAccessService), new(*service.HouseholdAccessService)))
 
+var outageServiceSet = wire.NewSet(
+	service.NewOutageService,
+	wire.Bind(new(service.IOutageService), new(*service.OutageService)))
+
+var householdAlertServiceSet = wire.NewSet(
+	service.NewHouseholdAlertService,
+	wire.Bind(new(service.IHouseholdAlertService), new(*service.HouseholdAlertService)))
+
 func InitDeps(env *config.Environment) *Server {
 	wire.Build(db.NewDatabase, util.NewLogger, util.NewEmailSender, util.NewInfluxQueryHelper,
 		repository.NewUserRepository, service.NewAuthService,
@@ -73,6 +81,8 @@ func InitDeps(env *config.Environment) *Server {
 		repository.NewAddressRepository, addressServiceSet, handler.NewAddressHandler,
 		repository.NewCityRepository, cityServiceSet, handler.NewCityHandler,
 		repository.NewHouseholdAccessRepository, householdAccessServiceSet, handler.NewHouseholdAccessHandler,
+		repository.NewOutageRepository, outageServiceSet, handler.NewOutageHandler,
+		repository.NewHouseholdAlertRepository, householdAlertServiceSet, handler.NewHouseholdAlertHandler,
 		repository.NewTimeSlotRepository, repository.NewMeetingRepository, meetingServiceSet, handler.NewMeetingHandler,
 		electricityConsumptionServiceSet, handler.NewElectricityConsumptionHandler,
 		userServiceSet, service.NewRestartService, handler.NewUserHandler,
@@ -62,7 +62,13 @@ func InitDeps(env *config.Environment) *Server {
 	householdAccessRepository := repository.NewHouseholdAccessRepository(database, logger)
 	householdAccessService := service.NewHouseholdAccessService(householdAccessRepository, householdRepository, userRepository)
 	householdAccessHandler := handler.NewHouseholdAccessHandler(householdAccessService, logger)
-	server := NewServer(logger, userService, authService, restartService, userHandler, propertyService, propertyHandler, householdService, householdHandler, ownershipService, ownershipHandler, deviceStatusService, deviceStatusHandler, addressService, addressHandler, meetingService, meetingHandler, pricelistService, pricelistHandler, billService, billHandler, cityService, cityHandler, iElectricityConsumptionService, electricityConsumptionHandler, householdAccessService, householdAccessHandler, database)
+	outageRepository := repository.NewOutageRepository(database, logger)
+	outageService := service.NewOutageService(outageRepository)
+	outageHandler := handler.NewOutageHandler(outageService, logger)
+	householdAlertRepository := repository.NewHouseholdAlertRepository(database, logger)
+	householdAlertService := service.NewHouseholdAlertService(householdAlertRepository, householdRepository, pricelistService, influxQueryHelper, emailSender, logger)
+	householdAlertHandler := handler.NewHouseholdAlertHandler(householdAlertService, logger)
+	server := NewServer(logger, userService, authService, restartService, userHandler, propertyService, propertyHandler, householdService, householdHandler, ownershipService, ownershipHandler, deviceStatusService, deviceStatusHandler, addressService, addressHandler, meetingService, meetingHandler, pricelistService, pricelistHandler, billService, billHandler, cityService, cityHandler, iElectricityConsumptionService, electricityConsumptionHandler, householdAccessService, householdAccessHandler, outageService, outageHandler, householdAlertService, householdAlertHandler, database)
 	return server
 }
 
@@ -91,3 +97,7 @@ var billServiceSet = wire.NewSet(service.NewBillService, wire.Bind(new(service.I
 var electricityConsumptionServiceSet = wire.NewSet(service.NewElectricityConsumptionService)
 
 var householdAccessServiceSet = wire.NewSet(service.NewHouseholdAccessService, wire.Bind(new(service.IHouseholdAccessService), new(*service.HouseholdAccessService)))
+
+var outageServiceSet = wire.NewSet(service.NewOutageService, wire.Bind(new(service.IOutageService), new(*service.OutageService)))
+
+var householdAlertServiceSet = wire.NewSet(service.NewHouseholdAlertService, wire.Bind(new(service.IHouseholdAlertService), new(*service.HouseholdAlertService)))
@@ -22,6 +22,7 @@ type IHouseholdService interface {
 	AcceptHouseholds(tx *gorm.DB, propertyID uint64) error
 	WithTrx(trxHandle *gorm.DB) IHouseholdService
 	FindMyHouseholdById(id uint64, userId uint64) (*dto.HouseholdResultDto, error)
+	CanAccessDevice(deviceID string, userId uint64) (bool, error)
 }
 
 type HouseholdService struct {
@@ -63,6 +64,10 @@ func (service *HouseholdService) FindMyHouseholdById(id uint64, userId uint64) (
 	return &mappedHousehold, nil
 }
 
+func (service *HouseholdService) CanAccessDevice(deviceID string, userId uint64) (bool, error) {
+	return service.repository.CanAccessDevice(deviceID, userId)
+}
+
 func (service *HouseholdService) Query(queryParams *dto.HouseholdQueryParams) ([]dto.HouseholdResultDto, int64, error) {
 	var households []dto.HouseholdResultDto
 	if queryParams.Search.Id != "" {
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"watt-flow/dto"
+	"watt-flow/model"
+	"watt-flow/repository"
+	"watt-flow/util"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// alertCheckInterval is how often the enabled alerts are evaluated
+	alertCheckInterval = 5 * time.Minute
+	// noDataLookback bounds how far back the last reading of a device is
+	// looked for
+	noDataLookback = 30 * 24 * time.Hour
+	// alertsQueue carries fired alerts to the measurement consumer, which
+	// pushes them to WebSocket clients
+	alertsQueue = "alerts_queue"
+)
+
+type IHouseholdAlertService interface {
+	FindByHousehold(householdID uint64, currentUserID uint64) ([]model.HouseholdAlert, error)
+	Create(householdID uint64, alertDto dto.HouseholdAlertDto, currentUserID uint64) (*model.HouseholdAlert, error)
+	Update(householdID uint64, alertID uint64, alertDto dto.HouseholdAlertDto, currentUserID uint64) (*model.HouseholdAlert, error)
+	Delete(householdID uint64, alertID uint64, currentUserID uint64) error
+	Run(ctx context.Context)
+	WithTrx(trxHandle *gorm.DB) IHouseholdAlertService
+}
+
+// HouseholdAlertService manages the alerts owners set on their households
+// and evaluates them periodically. A fired alert is mailed to the owner and
+// pushed over the measurement consumer's WebSocket.
+type HouseholdAlertService struct {
+	householdAlertRepository *repository.HouseholdAlertRepository
+	householdRepository      *repository.HouseholdRepository
+	pricelistService         IPricelistService
+	influxQueryHelper        *util.InfluxQueryHelper
+	emailSender              *util.EmailSender
+	logger                   util.Logger
+}
+
+func NewHouseholdAlertService(alertRepo *repository.HouseholdAlertRepository, householdRepo *repository.HouseholdRepository, pricelistService IPricelistService, influxQueryHelper *util.InfluxQueryHelper, emailSender *util.EmailSender, logger util.Logger) *HouseholdAlertService {
+	return &HouseholdAlertService{
+		householdAlertRepository: alertRepo,
+		householdRepository:      householdRepo,
+		pricelistService:         pricelistService,
+		influxQueryHelper:        influxQueryHelper,
+		emailSender:              emailSender,
+		logger:                   logger,
+	}
+}
+
+func (s *HouseholdAlertService) WithTrx(trxHandle *gorm.DB) IHouseholdAlertService {
+	return &HouseholdAlertService{
+		householdAlertRepository: s.householdAlertRepository.WithTrx(trxHandle),
+		householdRepository:      s.householdRepository.WithTrx(trxHandle),
+		pricelistService:         s.pricelistService,
+		influxQueryHelper:        s.influxQueryHelper,
+		emailSender:              s.emailSender,
+		logger:                   s.logger,
+	}
+}
+
+// checkOwner fails unless the current user owns the household.
+func (s *HouseholdAlertService) checkOwner(householdID uint64, currentUserID uint64) error {
+	household, err := s.householdRepository.FindById(householdID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("household not found")
+		}
+		return err
+	}
+	if household.OwnerID == nil || *household.OwnerID != currentUserID {
+		return errors.New("forbidden: only the owner can manage alerts")
+	}
+	return nil
+}
+
+func (s *HouseholdAlertService) FindByHousehold(householdID uint64, currentUserID uint64) ([]model.HouseholdAlert, error) {
+	if err := s.checkOwner(householdID, currentUserID); err != nil {
+		return nil, err
+	}
+	return s.householdAlertRepository.FindByHouseholdId(householdID)
+}
+
+func (s *HouseholdAlertService) Create(householdID uint64, alertDto dto.HouseholdAlertDto, currentUserID uint64) (*model.HouseholdAlert, error) {
+	if err := s.checkOwner(householdID, currentUserID); err != nil {
+		return nil, err
+	}
+	alert := &model.HouseholdAlert{
+		HouseholdID: householdID,
+		Type:        alertDto.Type,
+		Threshold:   alertDto.Threshold,
+		Enabled:     alertDto.Enabled == nil || *alertDto.Enabled,
+	}
+	if err := s.householdAlertRepository.Create(alert); err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (s *HouseholdAlertService) Update(householdID uint64, alertID uint64, alertDto dto.HouseholdAlertDto, currentUserID uint64) (*model.HouseholdAlert, error) {
+	if err := s.checkOwner(householdID, currentUserID); err != nil {
+		return nil, err
+	}
+	alert, err := s.householdAlertRepository.FindByIdAndHouseholdId(alertID, householdID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("alert not found")
+		}
+		return nil, err
+	}
+	alert.Type = alertDto.Type
+	alert.Threshold = alertDto.Threshold
+	alert.Enabled = alertDto.Enabled == nil || *alertDto.Enabled
+	if err := s.householdAlertRepository.Update(alert); err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (s *HouseholdAlertService) Delete(householdID uint64, alertID uint64, currentUserID uint64) error {
+	if err := s.checkOwner(householdID, currentUserID); err != nil {
+		return err
+	}
+	err := s.householdAlertRepository.Delete(alertID, householdID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.New("alert not found")
+	}
+	return err
+}
+
+// Run evaluates the enabled alerts every alertCheckInterval until ctx ends.
+func (s *HouseholdAlertService) Run(ctx context.Context) {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Evaluate(time.Now().UTC())
+		}
+	}
+}
+
+// alertRun holds what one evaluation shares between alerts, the pricelist
+// and the queue are only fetched once an alert needs them.
+type alertRun struct {
+	now       time.Time
+	pricelist *model.Pricelist
+	queue     *util.MessageQueue
+}
+
+// Evaluate checks every enabled alert against the consumption up to now.
+// Days and months are UTC, like the consumption endpoints.
+func (s *HouseholdAlertService) Evaluate(now time.Time) {
+	alerts, err := s.householdAlertRepository.FindEnabled()
+	if err != nil {
+		s.logger.Error("Failed to load household alerts", err)
+		return
+	}
+	run := &alertRun{now: now}
+	defer func() {
+		if run.queue != nil {
+			run.queue.Close()
+		}
+	}()
+
+	for i := range alerts {
+		alert := &alerts[i]
+		if alert.Household == nil || alert.Household.Owner == nil || alert.Household.DeviceStatusID == "" {
+			continue
+		}
+		if err := s.evaluateAlert(run, alert); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to evaluate alert %d", alert.Id), err)
+		}
+	}
+}
+
+func (s *HouseholdAlertService) evaluateAlert(run *alertRun, alert *model.HouseholdAlert) error {
+	deviceID := alert.Household.DeviceStatusID
+	now := run.now
+
+	switch alert.Type {
+	case model.DailyConsumptionAlert:
+		consumption, err := s.influxQueryHelper.GetTotalConsumptionForDay(deviceID, now.Year(), int(now.Month()), now.Day())
+		if err != nil {
+			return fmt.Errorf("failed to query daily consumption: %v", err)
+		}
+		if consumption <= alert.Threshold {
+			return nil
+		}
+		message := fmt.Sprintf("Consumption today reached %.2f kWh, above your limit of %.2f kWh.", consumption, alert.Threshold)
+		return s.fire(run, alert, now.Format("2006-01-02"), consumption, message)
+
+	case model.MonthlyBillAlert:
+		if run.pricelist == nil {
+			pricelist, err := s.pricelistService.GetActivePricelist()
+			if err != nil {
+				return err
+			}
+			run.pricelist = pricelist
+		}
+		consumption, err := s.influxQueryHelper.GetTotalConsumptionForMonth(deviceID, now.Year(), int(now.Month()))
+		if err != nil {
+			return fmt.Errorf("failed to query monthly consumption: %v", err)
+		}
+		price, projected := projectMonthlyBill(consumption, now, *run.pricelist)
+		if price <= alert.Threshold {
+			return nil
+		}
+		message := fmt.Sprintf("Your bill for this month is projected at %.2f for %.2f kWh, above your limit of %.2f.", price, projected, alert.Threshold)
+		return s.fire(run, alert, now.Format("2006-01"), price, message)
+
+	case model.NoDataAlert:
+		last, err := s.influxQueryHelper.GetLastMeasurementTime(deviceID, noDataLookback)
+		if err != nil {
+			return fmt.Errorf("failed to query last measurement: %v", err)
+		}
+		if last.IsZero() {
+			message := fmt.Sprintf("Your meter has not reported any consumption in the last %d days.", int(noDataLookback.Hours()/24))
+			return s.fire(run, alert, "none", noDataLookback.Hours(), message)
+		}
+		silent := now.Sub(last)
+		if silent.Hours() < alert.Threshold {
+			return nil
+		}
+		// The gap is keyed by the last reading, so it fires again once the
+		// meter reports and then goes quiet again
+		message := fmt.Sprintf("Your meter has not reported consumption since %s UTC.", last.UTC().Format("2006-01-02 15:04"))
+		return s.fire(run, alert, last.UTC().Format(time.RFC3339), silent.Hours(), message)
+	}
+	return fmt.Errorf("unknown alert type %q", alert.Type)
+}
+
+// projectMonthlyBill projects the consumption of the month so far over the
+// whole month and prices it. The first day counts in full so a few early
+// readings do not blow it up.
+func projectMonthlyBill(consumption float64, now time.Time, pricelist model.Pricelist) (float64, float64) {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthLength := monthStart.AddDate(0, 1, 0).Sub(monthStart)
+	elapsed := max(now.Sub(monthStart), 24*time.Hour)
+	projected := consumption * monthLength.Hours() / elapsed.Hours()
+	return calculatePrice(projected, pricelist), projected
+}
+
+// fire notifies the owner unless the alert already fired for the period.
+// The period is claimed first so only one server instance notifies, and
+// released again when a notification could not be delivered, so the next
+// check retries it. Delivery is at least once.
+func (s *HouseholdAlertService) fire(run *alertRun, alert *model.HouseholdAlert, period string, value float64, message string) error {
+	marked, err := s.householdAlertRepository.MarkFired(alert.Id, period, run.now)
+	if err != nil || !marked {
+		return err
+	}
+	if err := s.deliver(run, alert, value, message); err != nil {
+		if releaseErr := s.householdAlertRepository.ReleaseFired(alert.Id, period, alert.FiredFor, alert.LastFiredAt); releaseErr != nil {
+			s.logger.Error(fmt.Sprintf("Failed to release alert %d for %s", alert.Id, period), releaseErr)
+		}
+		return err
+	}
+	alert.FiredFor = period
+	alert.LastFiredAt = &run.now
+	return nil
+}
+
+// deliver pushes the notification to the WebSocket clients and mails it to
+// the owner. The push goes first, a failed one is retried before any mail
+// is sent.
+func (s *HouseholdAlertService) deliver(run *alertRun, alert *model.HouseholdAlert, value float64, message string) error {
+	household := alert.Household
+
+	notification := dto.AlertNotificationDto{
+		RuleID:      alert.Id,
+		HouseholdID: household.Id,
+		DeviceID:    household.DeviceStatusID,
+		Type:        alert.Type,
+		Threshold:   alert.Threshold,
+		Value:       value,
+		Message:     message,
+		FiredAt:     run.now,
+	}
+	notificationJSON, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert notification: %v", err)
+	}
+	if run.queue == nil {
+		queue, err := util.NewMessageQueue(alertsQueue)
+		if err != nil {
+			return err
+		}
+		run.queue = queue
+	}
+	if err := run.queue.Publish(alertsQueue, notificationJSON); err != nil {
+		// The channel is closed after a failed publish, the next alert
+		// reconnects
+		run.queue.Close()
+		run.queue = nil
+		return fmt.Errorf("failed to publish alert notification: %v", err)
+	}
+
+	householdName := household.Property.Address.City + ", " + household.Property.Address.Street + " " + household.Property.Address.Number + " suite: " + household.Suite
+	emailBody := util.GenerateHouseholdAlertEmailBody(householdName, message, "http://localhost:5173/")
+	if err := s.emailSender.SendEmail(household.Owner.Email, "Household alert", emailBody); err != nil {
+		return fmt.Errorf("failed to send alert email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"math"
+	"testing"
+	"time"
+	"watt-flow/model"
+)
+
+func TestProjectMonthlyBill(t *testing.T) {
+	// Flat green zone prices so the bill is the projected kWh plus the
+	// billing power
+	pricelist := model.Pricelist{GreenZone: 1, BlueZone: 1, RedZone: 1, BillingPower: 0}
+
+	tests := []struct {
+		name        string
+		consumption float64
+		now         time.Time
+		projected   float64
+	}{
+		// The first hours of a month count as a whole day
+		{"first hour", 2, time.Date(2026, 9, 1, 1, 0, 0, 0, time.UTC), 60},
+		{"end of first day", 2, time.Date(2026, 9, 2, 0, 0, 0, 0, time.UTC), 60},
+		{"mid month", 150, time.Date(2026, 9, 16, 0, 0, 0, 0, time.UTC), 300},
+		{"february", 14, time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC), 28},
+		{"leap february", 14, time.Date(2028, 2, 15, 0, 0, 0, 0, time.UTC), 29},
+		{"last hour", 310, time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC), 310 * 744.0 / 743.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, projected := projectMonthlyBill(tt.consumption, tt.now, pricelist)
+			if math.Abs(projected-tt.projected) > 1e-9 {
+				t.Errorf("projected %v kWh, want %v", projected, tt.projected)
+			}
+			if math.Abs(price-projected) > 1e-9 {
+				t.Errorf("price %v, want %v", price, projected)
+			}
+		})
+	}
+}
+
+func TestProjectMonthlyBillPricesByZone(t *testing.T) {
+	pricelist := model.Pricelist{GreenZone: 10, BlueZone: 15, RedZone: 20, BillingPower: 50, Tax: 20}
+	now := time.Date(2026, 9, 11, 0, 0, 0, 0, time.UTC)
+
+	// 100 kWh in the first ten days project to 300 kWh in the green zone,
+	// (300*10 + 7*50) * 1.2
+	price, projected := projectMonthlyBill(100, now, pricelist)
+	if projected != 300 || math.Abs(price-4020) > 1e-9 {
+		t.Fatalf("got %v for %v kWh, want 4020 for 300 kWh", price, projected)
+	}
+	// A projection crossing into the blue zone is priced by zones
+	price, _ = projectMonthlyBill(200, now, pricelist)
+	if want := (350*10 + 250*15 + 7*50) * 1.2; math.Abs(price-want) > 1e-9 {
+		t.Fatalf("got %v, want %v", price, want)
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"watt-flow/dto"
+	"watt-flow/model"
+	"watt-flow/repository"
+
+	"gorm.io/gorm"
+)
+
+type IOutageService interface {
+	FindById(id uint64) (*model.Outage, error)
+	Query(params *dto.OutageQueryParams) ([]model.Outage, int64, error)
+	WithTrx(trxHandle *gorm.DB) IOutageService
+}
+
+// OutageService only reads outages, the measurement consumer opens and
+// closes them.
+type OutageService struct {
+	outageRepository *repository.OutageRepository
+}
+
+func NewOutageService(outageRepository *repository.OutageRepository) *OutageService {
+	return &OutageService{
+		outageRepository: outageRepository,
+	}
+}
+
+func (s *OutageService) WithTrx(trxHandle *gorm.DB) IOutageService {
+	return &OutageService{
+		outageRepository: s.outageRepository.WithTrx(trxHandle),
+	}
+}
+
+func (s *OutageService) FindById(id uint64) (*model.Outage, error) {
+	return s.outageRepository.FindById(id)
+}
+
+func (s *OutageService) Query(params *dto.OutageQueryParams) ([]model.Outage, int64, error) {
+	return s.outageRepository.Query(params)
+}
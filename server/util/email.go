@@ -456,3 +456,19 @@ func GenerateOwnershipDenialEmailBody(householdName string, reason string, login
 		</html>
 	`, householdName, reason, loginLink)
 }
+
+func GenerateHouseholdAlertEmailBody(householdName string, message string, loginLink string) string {
+	return fmt.Sprintf(`
+		<html>
+			<body style="font-family: Arial, sans-serif; background: linear-gradient(90deg, #1d1e26 0%%, #4d596a 100%%); color: #333; padding: 40px; text-align: center;">
+				<div style="background: white; max-width: 600px; margin: 0 auto; padding: 40px; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1);">
+					<h2 style="color: #333; margin-bottom: 20px;">Household Alert</h2>
+					<p style="font-size: 16px; color: #555;">An alert you set on your household at "<strong>%s</strong>" went off.</p>
+					<p style="font-size: 16px; color: #555;"><strong>%s</strong></p>
+					<p style="font-size: 16px; color: #555;">Click the button below to log in and see its consumption:</p>
+					<a href="%s" style="display: inline-block; padding: 12px 24px; background-color: #1d1e26; color: white; text-decoration: none; border-radius: 5px; font-weight: bold;">Log In</a>
+				</div>
+			</body>
+		</html>
+	`, householdName, message, loginLink)
+}
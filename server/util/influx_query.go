@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"watt-flow/config"
@@ -84,6 +85,30 @@ func (inf *InfluxQueryHelper) GetTotalConsumptionForDay(deviceID string, year in
 	return totalConsumption, nil
 }
 
+// GetLastMeasurementTime returns when the device last reported consumption,
+// zero when it reported nothing within the lookback.
+func (inf *InfluxQueryHelper) GetLastMeasurementTime(deviceID string, lookback time.Duration) (time.Time, error) {
+	queryAPI := inf.client.QueryAPI(inf.organization)
+	fluxQuery := generateLastMeasurementQueryString(deviceID, fmt.Sprintf("-%dh", int(lookback.Hours())))
+
+	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer result.Close()
+	var last time.Time
+
+	for result.Next() {
+		last = result.Record().Time()
+	}
+
+	if result.Err() != nil {
+		return time.Time{}, result.Err()
+	}
+
+	return last, nil
+}
+
 func (inf *InfluxQueryHelper) SendStatusQuery(queryParams dto.FluxQueryStatusDto) (*dto.StatusQueryResult, error) {
 	queryAPI := inf.client.QueryAPI(inf.organization)
 	fluxQuery := ""
@@ -290,7 +315,7 @@ func generateMonthConsumptionQueryString(deviceID string, startMonth string, end
 	fluxQuery := fmt.Sprintf(`
   from(bucket: "power_measurements")
     |> range(start: %s, stop: %s)
-    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r.device_id == "%s")
+    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r["_field"] == "value" and r.device_id == "%s")
     |> sum(column: "_value")
     `, startMonth, endMonth, deviceID)
 
@@ -301,13 +326,25 @@ func generateDayConsumptionQueryString(deviceID string, startDay string, endDay
 	fluxQuery := fmt.Sprintf(`
   from(bucket: "power_measurements")
     |> range(start: %s, stop: %s)
-    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r.device_id == "%s")
+    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r["_field"] == "value" and r.device_id == "%s")
     |> sum(column: "_value")
     `, startDay, endDay, deviceID)
 
 	return fluxQuery
 }
 
+func generateLastMeasurementQueryString(deviceID string, start string) string {
+	fluxQuery := fmt.Sprintf(`
+  from(bucket: "power_measurements")
+    |> range(start: %s)
+    |> filter(fn: (r) => r["_measurement"] == "power_consumption" and r["_field"] == "value" and r.device_id == "%s")
+    |> group()
+    |> last()
+    `, start, deviceID)
+
+	return fluxQuery
+}
+
 func generateQueryString(params dto.FluxQueryStatusDto) string {
 	fluxQuery := fmt.Sprintf(`
   import "array"
@@ -440,8 +477,63 @@ func generateRealtimeConsumptionQuery(params dto.FluxQueryConsumptionDto) string
 	return fluxQuery
 }
 
+// cityAggregateWindows are the window sizes the consumer rolls city
+// consumption up into, largest first
+var cityAggregateWindows = []struct {
+	name string
+	size time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"1h", time.Hour},
+	{"5m", 5 * time.Minute},
+}
+
+// cityConsumptionSource picks the measurement city consumption grouped by
+// groupPeriod is read from, the largest pre-aggregated window that divides
+// the period or the raw readings, with the filter selecting that window.
+func cityConsumptionSource(groupPeriod string) (string, string) {
+	period, ok := fluxPeriod(groupPeriod)
+	if ok {
+		for _, window := range cityAggregateWindows {
+			if period%window.size == 0 {
+				return "city_consumption", fmt.Sprintf(` and r.window == "%s"`, window.name)
+			}
+		}
+	}
+	return "power_consumption", ""
+}
+
+// fluxPeriod converts a Flux duration such as "15m", "1d" or "1mo" to a
+// length that is a multiple of the same windows, months and years count as
+// whole days.
+func fluxPeriod(groupPeriod string) (time.Duration, bool) {
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"mo", 24 * time.Hour},
+		{"y", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+	} {
+		if count, found := strings.CutSuffix(groupPeriod, unit.suffix); found {
+			n, err := strconv.Atoi(count)
+			if err != nil || n <= 0 {
+				return 0, false
+			}
+			return time.Duration(n) * unit.size, true
+		}
+	}
+	period, err := time.ParseDuration(groupPeriod)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return period, true
+}
+
 // City-based consumption queries
 func generateCityPowerConsumptionQuery(params dto.FluxQueryCityConsumptionDto) string {
+	measurement, windowFilter := cityConsumptionSource(params.GroupPeriod)
 	fluxQuery := fmt.Sprintf(`
   import "array"
   import "experimental"
@@ -450,14 +542,15 @@ func generateCityPowerConsumptionQuery(params dto.FluxQueryCityConsumptionDto) s
 
   data = from(bucket: "power_measurements")
     |> range(start: startTime)
-    |> filter(fn: (r) => r._measurement == "power_consumption" and r._field == "value" and r.city == "%s")
+    |> filter(fn: (r) => r._measurement == "%s" and r._field == "value" and r.city == "%s"%s)
+    |> drop(columns: ["window"])
 
   bounds = array.from(rows: [
     {
       _time: startTime,
       _value: 0.0, // Vrednost 0 da ne utiče na sumu
       _field: "value",
-      _measurement: "power_consumption",
+      _measurement: "%s",
       city: "%s",
       _start: startTime, // Dodajemo _start i _stop da se poklopi shema
       _stop: now()
@@ -473,11 +566,12 @@ func generateCityPowerConsumptionQuery(params dto.FluxQueryCityConsumptionDto) s
       city: r.city
     }))
     |> yield(name: "power_consumption_summary")
-`, params.TimePeriod, params.City, params.City, params.GroupPeriod)
+`, params.TimePeriod, measurement, params.City, windowFilter, measurement, params.City, params.GroupPeriod)
 	return fluxQuery
 }
 
 func generateCityPowerConsumptionRangeQueryString(params dto.FluxQueryCityConsumptionDto) string {
+	measurement, windowFilter := cityConsumptionSource(params.GroupPeriod)
 	startDate := params.StartDate.Format(time.RFC3339)
 	endDate := params.EndDate.Format(time.RFC3339)
 	fluxQuery := fmt.Sprintf(`
@@ -485,14 +579,15 @@ func generateCityPowerConsumptionRangeQueryString(params dto.FluxQueryCityConsum
 
   data = from(bucket: "power_measurements")
     |> range(start: %s, stop: %s)
-    |> filter(fn: (r) => r._measurement == "power_consumption" and r._field == "value" and r.city == "%s")
+    |> filter(fn: (r) => r._measurement == "%s" and r._field == "value" and r.city == "%s"%s)
+    |> drop(columns: ["window"])
 
   bounds = array.from(rows: [
     {
       _time: %s,
       _value: 0.0,
       _field: "value",
-      _measurement: "power_consumption",
+      _measurement: "%s",
       city: "%s",
       _start: %s,
       _stop: %s
@@ -509,7 +604,7 @@ func generateCityPowerConsumptionRangeQueryString(params dto.FluxQueryCityConsum
       city: r.city
     }))
     |> yield(name: "power_consumption_summary")
-`, startDate, endDate, params.City, startDate, params.City, startDate, endDate, params.GroupPeriod)
+`, startDate, endDate, measurement, params.City, windowFilter, startDate, measurement, params.City, startDate, endDate, params.GroupPeriod)
 	return fluxQuery
 }
 
@@ -2,45 +2,122 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const confirmBufferSize = 128
+
+// deviceIDHeader carries the device of a message, the consumer spreads
+// measurements over its shards by hashing it.
+const deviceIDHeader = "device_id"
+
+var confirmTimeout = 10 * time.Second
+
+var (
+	errNotConnected  = errors.New("not connected to RabbitMQ")
+	errNacked        = errors.New("message was nacked by RabbitMQ")
+	errUnroutable    = errors.New("message was returned as unroutable")
+	errUnconfirmed   = errors.New("message was not confirmed in time")
+	errChannelClosed = errors.New("channel closed before message was confirmed")
+)
+
+// publishChannel is the part of *amqp.Channel used for confirmed publishing.
+type publishChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+type inflightPublish struct {
+	messageID string
+	returned  bool
+	done      chan error
+}
+
+// confirmTracker follows the publishes made on a single channel in confirm
+// mode. Delivery tags start from 1 on every new channel, so each channel
+// gets its own tracker.
+type confirmTracker struct {
+	channel     publishChannel
+	deliveryTag uint64
+	inflight    map[uint64]*inflightPublish
+	byID        map[string]uint64
+	mu          sync.Mutex
+}
+
 type MessageBroker struct {
 	amqpURI      string
 	conn         *amqp.Connection
 	channel      *amqp.Channel
+	tracker      *confirmTracker
 	reconnecting chan struct{}
 	exchange     string
 	mu           sync.Mutex
 	isConnected  bool
+	isClosed     bool
+
+	// pool is set when the broker shares its connection with other devices,
+	// the broker then only owns its channel.
+	pool *ConnectionPool
+	slot int
 }
 
 func NewMessageBroker(exchange string, amqpUri string) *MessageBroker {
 	return &MessageBroker{
-		reconnecting: make(chan struct{}),
+		reconnecting: make(chan struct{}, 1),
 		exchange:     exchange,
 		amqpURI:      amqpUri,
 	}
 }
 
-func (b *MessageBroker) Connect() error {
+func NewPooledMessageBroker(exchange string, pool *ConnectionPool, slot int) *MessageBroker {
+	return &MessageBroker{
+		reconnecting: make(chan struct{}, 1),
+		exchange:     exchange,
+		pool:         pool,
+		slot:         slot,
+	}
+}
+
+func (b *MessageBroker) dial() (*amqp.Connection, error) {
+	if b.pool != nil {
+		return b.pool.Connection(b.slot)
+	}
 	config := amqp.Config{
 		Heartbeat: 10 * time.Second,
 	}
-
 	conn, err := amqp.DialConfig(b.amqpURI, config)
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	return conn, nil
+}
+
+// closeConn closes the connection unless it is shared through the pool.
+func (b *MessageBroker) closeConn(conn *amqp.Connection) error {
+	if b.pool != nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (b *MessageBroker) Connect() error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		conn.Close()
+		b.closeConn(conn)
 		return fmt.Errorf("failed to open channel: %v", err)
 	}
 
@@ -55,59 +132,25 @@ func (b *MessageBroker) Connect() error {
 	)
 	if err != nil {
 		ch.Close()
-		conn.Close()
+		b.closeConn(conn)
 		return fmt.Errorf("failed to declare exchange: %v", err)
 	}
 
-	measurementQueue, err := ch.QueueDeclare(
-		"measurements_queue",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare measurement queue: %v", err)
-	}
+	// The queues are the consumer's, with CONSUMER_SHARDS it binds shard
+	// queues instead of measurements_queue. Until it declared them messages
+	// are returned as unroutable and stay in the outbox.
 
-	err = ch.QueueBind(
-		measurementQueue.Name,
-		"measurement.*",
-		exchangeName,
-		false,
-		nil,
-	)
+	tracker, err := newConfirmTracker(ch)
 	if err != nil {
-		return fmt.Errorf("failed to bind measurement queue: %v", err)
-	}
-
-	// heartbeatQueue, err := ch.QueueDeclare(
-	// 	"heartbeats_queue",
-	// 	true,
-	// 	false,
-	// 	false,
-	// 	false,
-	// 	nil,
-	// )
-	// if err != nil {
-	// 	return fmt.Errorf("failed to declare heartbeat queue: %v", err)
-	// }
-	//
-	// err = ch.QueueBind(
-	// 	heartbeatQueue.Name,
-	// 	"heartbeat.*",
-	// 	exchangeName,
-	// 	false,
-	// 	nil,
-	// )
-	// if err != nil {
-	// 	return fmt.Errorf("failed to bind heartbeat queue: %v", err)
-	// }
+		ch.Close()
+		b.closeConn(conn)
+		return err
+	}
 
 	b.mu.Lock()
 	b.conn = conn
 	b.channel = ch
+	b.tracker = tracker
 	b.isConnected = true
 	b.mu.Unlock()
 
@@ -116,11 +159,152 @@ func (b *MessageBroker) Connect() error {
 	return nil
 }
 
+// newConfirmTracker puts the channel into confirm mode and starts following
+// the confirmations and returns RabbitMQ sends for it.
+func newConfirmTracker(ch publishChannel) (*confirmTracker, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to put channel into confirm mode: %v", err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize))
+	// Returns stay unbuffered, the client library then hands a return over
+	// before it dispatches the confirmation of the same message.
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+
+	tracker := &confirmTracker{
+		channel:  ch,
+		inflight: make(map[uint64]*inflightPublish),
+		byID:     make(map[string]uint64),
+	}
+	go tracker.run(confirms, returns)
+	return tracker, nil
+}
+
+func (t *confirmTracker) run(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			t.handleReturn(ret)
+		case confirmation, ok := <-confirms:
+			if !ok {
+				t.failAll(errChannelClosed)
+				return
+			}
+			t.handleConfirmation(confirmation)
+		}
+	}
+}
+
+func (t *confirmTracker) handleReturn(ret amqp.Return) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tag, ok := t.byID[ret.MessageId]
+	if !ok {
+		log.Printf("Received return for unknown message %s: %s", ret.MessageId, ret.ReplyText)
+		return
+	}
+	t.inflight[tag].returned = true
+	log.Printf("Message with delivery tag %d returned: %s", tag, ret.ReplyText)
+}
+
+func (t *confirmTracker) handleConfirmation(confirmation amqp.Confirmation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	publish, ok := t.inflight[confirmation.DeliveryTag]
+	if !ok {
+		return
+	}
+	t.remove(confirmation.DeliveryTag)
+
+	switch {
+	case !confirmation.Ack:
+		publish.done <- errNacked
+	case publish.returned:
+		publish.done <- errUnroutable
+	default:
+		publish.done <- nil
+	}
+}
+
+func (t *confirmTracker) failAll(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for tag, publish := range t.inflight {
+		t.remove(tag)
+		publish.done <- err
+	}
+}
+
+// publish sends the message and returns the delivery tag together with the
+// channel the outcome is reported on.
+func (t *confirmTracker) publish(ctx context.Context, msg Message) (uint64, <-chan error, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deliveryTag++
+	tag := t.deliveryTag
+	publish := &inflightPublish{
+		messageID: fmt.Sprintf("%s-%d-%d", msg.Type, tag, time.Now().UnixNano()),
+		done:      make(chan error, 1),
+	}
+	t.inflight[tag] = publish
+	t.byID[publish.messageID] = tag
+	// Messages stored before they carried their device hash by city as before
+	hashKey := msg.DeviceID
+	if hashKey == "" {
+		hashKey = msg.Queue
+	}
+
+	err := t.channel.PublishWithContext(ctx,
+		exchangeName,
+		msg.Queue,
+		true,
+		false,
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        msg.Payload,
+			Timestamp:   time.Now(),
+			Type:        msg.Type,
+			MessageId:   publish.messageID,
+			Headers:     amqp.Table{"seq": strconv.FormatUint(msg.Seq, 10), deviceIDHeader: hashKey},
+		})
+	if err != nil {
+		// Nothing reached the broker, so the tag was not used
+		t.remove(tag)
+		t.deliveryTag--
+		return tag, nil, err
+	}
+	return tag, publish.done, nil
+}
+
+func (t *confirmTracker) forget(tag uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(tag)
+}
+
+func (t *confirmTracker) remove(tag uint64) {
+	if publish, ok := t.inflight[tag]; ok {
+		delete(t.inflight, tag)
+		delete(t.byID, publish.messageID)
+	}
+}
+
 func (mb *MessageBroker) handleConnectionClose() {
-	<-mb.conn.NotifyClose(make(chan *amqp.Error))
+	<-mb.conn.NotifyClose(make(chan *amqp.Error, 1))
 	mb.mu.Lock()
 	mb.isConnected = false
+	closed := mb.isClosed
 	mb.mu.Unlock()
+	if closed {
+		return
+	}
 
 	log.Println("Connection to RabbitMQ lost.")
 	for {
@@ -128,29 +312,72 @@ func (mb *MessageBroker) handleConnectionClose() {
 		log.Println("Attempting to reconnect to RabbitMQ...")
 		if err == nil {
 			log.Println("Reconnected to RabbitMQ")
-			mb.reconnecting <- struct{}{}
+			// Nobody may be listening, the replay subcommand never does,
+			// and a pending notification already covers this one
+			select {
+			case mb.reconnecting <- struct{}{}:
+			default:
+			}
+			return
+		}
+		if errors.Is(err, errPoolClosed) {
 			return
 		}
 		time.Sleep(reconnectDelay)
 	}
 }
 
-func (mb *MessageBroker) PublishMessage(ctx context.Context, msg Message) error {
+// Close releases the broker's channel, and its connection when it is not
+// shared, without triggering a reconnect.
+func (mb *MessageBroker) Close() error {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
+	mb.isClosed = true
+	mb.isConnected = false
+	if mb.channel != nil {
+		if err := mb.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return fmt.Errorf("failed to close channel: %v", err)
+		}
+	}
+	if mb.conn != nil {
+		if err := mb.closeConn(mb.conn); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return fmt.Errorf("failed to close connection: %v", err)
+		}
+	}
+	return nil
+}
+
+// PublishMessage publishes the message as mandatory and waits until RabbitMQ
+// confirms it. Nacked, unroutable and unconfirmed messages are reported as
+// errors so the caller can put them back into its buffer.
+func (mb *MessageBroker) PublishMessage(ctx context.Context, msg Message) error {
+	mb.mu.Lock()
 	if !mb.isConnected {
-		return fmt.Errorf("not connected to RabbitMQ")
+		mb.mu.Unlock()
+		return errNotConnected
+	}
+	tracker := mb.tracker
+	tag, done, err := tracker.publish(ctx, msg)
+	mb.mu.Unlock()
+	if err != nil {
+		return err
 	}
 
-	return mb.channel.PublishWithContext(ctx,
-		exchangeName,
-		msg.Queue,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        msg.Payload,
-			Timestamp:   time.Now(),
-		})
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("delivery tag %d: %w", tag, err)
+		}
+		return nil
+	case <-timer.C:
+		tracker.forget(tag)
+		return fmt.Errorf("delivery tag %d: %w", tag, errUnconfirmed)
+	case <-ctx.Done():
+		tracker.forget(tag)
+		return ctx.Err()
+	}
 }
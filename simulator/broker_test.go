@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type fakeOutcome int
+
+const (
+	outcomeAck fakeOutcome = iota
+	outcomeNack
+	outcomeUnroutable
+	outcomeSilent
+)
+
+// fakeChannel is an in-process stand-in for a RabbitMQ channel in confirm
+// mode. Frames are dispatched from a single goroutine in the same order a
+// broker sends them, a basic.return always before the matching basic.ack.
+type fakeChannel struct {
+	mu         sync.Mutex
+	confirming bool
+	tag        uint64
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	frames     chan func()
+	outcome    func(key string) fakeOutcome
+	published  []amqp.Publishing
+	publishErr error
+	closed     chan struct{}
+}
+
+func newFakeChannel(outcome func(key string) fakeOutcome) *fakeChannel {
+	ch := &fakeChannel{
+		frames:  make(chan func(), 64),
+		outcome: outcome,
+		closed:  make(chan struct{}),
+	}
+	go ch.dispatch()
+	return ch
+}
+
+func (ch *fakeChannel) dispatch() {
+	for frame := range ch.frames {
+		frame()
+	}
+	close(ch.confirms)
+	close(ch.returns)
+	close(ch.closed)
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.returns = c
+	return c
+}
+
+func (ch *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.publishErr != nil {
+		return ch.publishErr
+	}
+	if !ch.confirming {
+		return errors.New("channel is not in confirm mode")
+	}
+	ch.tag++
+	tag := ch.tag
+	ch.published = append(ch.published, msg)
+
+	switch ch.outcome(key) {
+	case outcomeAck:
+		ch.frames <- func() { ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true} }
+	case outcomeNack:
+		ch.frames <- func() { ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false} }
+	case outcomeUnroutable:
+		if !mandatory {
+			ch.frames <- func() { ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true} }
+			break
+		}
+		ch.frames <- func() {
+			ch.returns <- amqp.Return{
+				ReplyCode:  312,
+				ReplyText:  "NO_ROUTE",
+				Exchange:   exchange,
+				RoutingKey: key,
+				MessageId:  msg.MessageId,
+				Type:       msg.Type,
+				Body:       msg.Body,
+			}
+		}
+		ch.frames <- func() { ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true} }
+	case outcomeSilent:
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Close() {
+	close(ch.frames)
+	<-ch.closed
+}
+
+func newTestBroker(t *testing.T, ch *fakeChannel) *MessageBroker {
+	t.Helper()
+	tracker, err := newConfirmTracker(ch)
+	if err != nil {
+		t.Fatalf("newConfirmTracker() error = %v", err)
+	}
+	return &MessageBroker{
+		reconnecting: make(chan struct{}),
+		exchange:     exchangeName,
+		tracker:      tracker,
+		isConnected:  true,
+	}
+}
+
+func testMessage(queue string, seq uint64) Message {
+	return Message{
+		Seq:       seq,
+		Type:      "measurement",
+		Payload:   []byte(`{"Value":1}`),
+		Queue:     queue,
+		Timestamp: time.Now(),
+	}
+}
+
+func TestPublishMessage(t *testing.T) {
+	confirmTimeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		outcome fakeOutcome
+		wantErr error
+	}{
+		{name: "acked", outcome: outcomeAck, wantErr: nil},
+		{name: "nacked", outcome: outcomeNack, wantErr: errNacked},
+		{name: "unroutable", outcome: outcomeUnroutable, wantErr: errUnroutable},
+		{name: "unconfirmed", outcome: outcomeSilent, wantErr: errUnconfirmed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newFakeChannel(func(string) fakeOutcome { return tt.outcome })
+			defer ch.Close()
+			broker := newTestBroker(t, ch)
+
+			err := broker.PublishMessage(context.Background(), testMessage("measurement.Novi Sad", 1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PublishMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(ch.published) != 1 {
+				t.Fatalf("published %d messages, want 1", len(ch.published))
+			}
+			if ch.published[0].MessageId == "" {
+				t.Errorf("published message has no MessageId")
+			}
+		})
+	}
+}
+
+func TestPublishMessageDeliveryTags(t *testing.T) {
+	ch := newFakeChannel(func(key string) fakeOutcome {
+		if key == "measurement.Nowhere" {
+			return outcomeUnroutable
+		}
+		return outcomeAck
+	})
+	defer ch.Close()
+	broker := newTestBroker(t, ch)
+	ctx := context.Background()
+
+	if err := broker.PublishMessage(ctx, testMessage("measurement.Novi Sad", 1)); err != nil {
+		t.Fatalf("first PublishMessage() error = %v", err)
+	}
+	if err := broker.PublishMessage(ctx, testMessage("measurement.Nowhere", 2)); !errors.Is(err, errUnroutable) {
+		t.Fatalf("second PublishMessage() error = %v, want %v", err, errUnroutable)
+	}
+	if err := broker.PublishMessage(ctx, testMessage("measurement.Novi Sad", 3)); err != nil {
+		t.Fatalf("third PublishMessage() error = %v", err)
+	}
+	if broker.tracker.deliveryTag != 3 {
+		t.Errorf("deliveryTag = %d, want 3", broker.tracker.deliveryTag)
+	}
+	if len(broker.tracker.inflight) != 0 {
+		t.Errorf("%d publishes still in flight", len(broker.tracker.inflight))
+	}
+}
+
+func TestPublishMessageChannelClosed(t *testing.T) {
+	ch := newFakeChannel(func(string) fakeOutcome { return outcomeSilent })
+	broker := newTestBroker(t, ch)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- broker.PublishMessage(context.Background(), testMessage("measurement.Novi Sad", 1))
+	}()
+	for {
+		ch.mu.Lock()
+		published := len(ch.published)
+		ch.mu.Unlock()
+		if published == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ch.Close()
+
+	if err := <-errs; !errors.Is(err, errChannelClosed) {
+		t.Fatalf("PublishMessage() error = %v, want %v", err, errChannelClosed)
+	}
+}
+
+func TestPublishMessageSendFailureKeepsTags(t *testing.T) {
+	ch := newFakeChannel(func(string) fakeOutcome { return outcomeAck })
+	defer ch.Close()
+	broker := newTestBroker(t, ch)
+	ctx := context.Background()
+
+	ch.publishErr = amqp.ErrClosed
+	if err := broker.PublishMessage(ctx, testMessage("measurement.Novi Sad", 1)); !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("PublishMessage() error = %v, want %v", err, amqp.ErrClosed)
+	}
+	ch.publishErr = nil
+	if err := broker.PublishMessage(ctx, testMessage("measurement.Novi Sad", 2)); err != nil {
+		t.Fatalf("PublishMessage() error = %v", err)
+	}
+	if broker.tracker.deliveryTag != 1 {
+		t.Errorf("deliveryTag = %d, want 1", broker.tracker.deliveryTag)
+	}
+}
+
+func TestSendBufferedMessagesRequeuesRejected(t *testing.T) {
+	ch := newFakeChannel(func(key string) fakeOutcome {
+		if key == "measurement.Nowhere" {
+			return outcomeNack
+		}
+		return outcomeAck
+	})
+	defer ch.Close()
+
+	outbox, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	defer outbox.Close()
+
+	device := &Device{
+		broker: newTestBroker(t, ch),
+		buffer: NewMessageBuffer(),
+		outbox: outbox,
+	}
+	for _, queue := range []string{"measurement.Novi Sad", "measurement.Nowhere", "measurement.Novi Sad"} {
+		msg, err := outbox.Append(testMessage(queue, 0))
+		if err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+		device.buffer.Add(msg)
+	}
+
+	device.sendBufferedMessages(context.Background())
+
+	remaining := device.buffer.Flush()
+	if len(remaining) != 2 {
+		t.Fatalf("buffer holds %d messages, want 2", len(remaining))
+	}
+	if remaining[0].Seq != 2 || remaining[1].Seq != 3 {
+		t.Errorf("buffer holds seqs %d, %d, want 2, 3", remaining[0].Seq, remaining[1].Seq)
+	}
+
+	pending, err := outbox.Pending()
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].Seq != 2 {
+		t.Errorf("outbox pending = %+v, want seqs 2 and 3", pending)
+	}
+}
+
+func TestPublishMessageHashesByDevice(t *testing.T) {
+	ch := newFakeChannel(func(string) fakeOutcome { return outcomeAck })
+	defer ch.Close()
+	broker := newTestBroker(t, ch)
+	ctx := context.Background()
+
+	for i, device := range []string{"device-1", "device-2", ""} {
+		msg := testMessage("measurement.Novi Sad", uint64(i+1))
+		msg.DeviceID = device
+		if err := broker.PublishMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A message from an older outbox has no device and keeps its city
+	want := []string{"device-1", "device-2", "measurement.Novi Sad"}
+	for i, msg := range ch.published {
+		if msg.Headers[deviceIDHeader] != want[i] {
+			t.Errorf("message %d hashed by %v, want %s", i, msg.Headers[deviceIDHeader], want[i])
+		}
+	}
+}
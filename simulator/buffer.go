@@ -19,6 +19,19 @@ func (mb *MessageBuffer) Add(msg Message) {
 	mb.messages = append(mb.messages, msg)
 }
 
+// Requeue puts messages back in front of the buffer, keeping their order.
+func (mb *MessageBuffer) Requeue(msgs []Message) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.messages = append(append(make([]Message, 0, len(msgs)+len(mb.messages)), msgs...), mb.messages...)
+}
+
+func (mb *MessageBuffer) Len() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.messages)
+}
+
 func (mb *MessageBuffer) Flush() []Message {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
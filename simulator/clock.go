@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+type ClockMode string
+
+const (
+	// ClockRealtime advances simulated time at the speed of the wall clock.
+	ClockRealtime ClockMode = "realtime"
+	// ClockCompressed advances simulated time ratio times faster than the wall clock.
+	ClockCompressed ClockMode = "compressed"
+	// ClockBackfill sends every reading between two dates as fast as the
+	// broker confirms them and then stops producing measurements.
+	ClockBackfill ClockMode = "backfill"
+)
+
+const defaultClockStep = 1 * time.Hour
+
+// minClockInterval is the shortest wall time allowed between measurements,
+// a ticker cannot run any faster.
+const minClockInterval = time.Millisecond
+
+// VirtualClock decides which simulated timestamps a device produces and how
+// much wall time passes between them. Simulated time only ever moves in fixed
+// steps, so a seeded device produces the same readings for the same range no
+// matter how fast it runs.
+type VirtualClock struct {
+	mode  ClockMode
+	ratio float64
+	step  time.Duration
+	from  time.Time
+	to    time.Time
+}
+
+// defaultClock keeps the original pace of one simulated hour per measurementInterval.
+func defaultClock() *VirtualClock {
+	return &VirtualClock{
+		mode:  ClockCompressed,
+		ratio: float64(defaultClockStep) / float64(measurementInterval),
+		step:  defaultClockStep,
+	}
+}
+
+func NewRealtimeClock(step time.Duration) (*VirtualClock, error) {
+	return newPacedClock(ClockRealtime, step, 1)
+}
+
+func NewCompressedClock(step time.Duration, ratio float64) (*VirtualClock, error) {
+	if ratio <= 0 || math.IsInf(ratio, 0) || math.IsNaN(ratio) {
+		return nil, fmt.Errorf("clock ratio must be positive, got %v", ratio)
+	}
+	return newPacedClock(ClockCompressed, step, ratio)
+}
+
+// newPacedClock builds a clock ticking on the wall clock, the step shrunk by
+// the ratio has to leave at least minClockInterval between measurements.
+func newPacedClock(mode ClockMode, step time.Duration, ratio float64) (*VirtualClock, error) {
+	clock := &VirtualClock{mode: mode, ratio: ratio, step: step}
+	if interval := clock.Interval(); interval < minClockInterval {
+		return nil, fmt.Errorf("clock step %s at ratio %v leaves %s between measurements, at least %s is needed", step, ratio, interval, minClockInterval)
+	}
+	return clock, nil
+}
+
+func NewBackfillClock(step time.Duration, from time.Time, to time.Time) (*VirtualClock, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("backfill start %s is not before its end %s", from, to)
+	}
+	return &VirtualClock{mode: ClockBackfill, step: step, from: from, to: to}, nil
+}
+
+// clockFromEnv builds the clock from CLOCK_MODE, CLOCK_STEP, CLOCK_RATIO,
+// BACKFILL_FROM and BACKFILL_TO. Without CLOCK_MODE the default clock is used.
+func clockFromEnv() (*VirtualClock, error) {
+	mode := ClockMode(os.Getenv("CLOCK_MODE"))
+	if mode == "" {
+		return defaultClock(), nil
+	}
+
+	step := defaultClockStep
+	if value := os.Getenv("CLOCK_STEP"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid CLOCK_STEP %q", value)
+		}
+		step = parsed
+	}
+
+	switch mode {
+	case ClockRealtime:
+		return NewRealtimeClock(step)
+	case ClockCompressed:
+		ratio, err := strconv.ParseFloat(os.Getenv("CLOCK_RATIO"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLOCK_RATIO: %w", err)
+		}
+		return NewCompressedClock(step, ratio)
+	case ClockBackfill:
+		from, err := time.Parse(time.RFC3339, os.Getenv("BACKFILL_FROM"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKFILL_FROM: %w", err)
+		}
+		to, err := time.Parse(time.RFC3339, os.Getenv("BACKFILL_TO"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKFILL_TO: %w", err)
+		}
+		return NewBackfillClock(step, from, to)
+	default:
+		return nil, fmt.Errorf("unknown CLOCK_MODE %q", mode)
+	}
+}
+
+// Interval is the wall time between two measurements, zero when backfilling.
+func (c *VirtualClock) Interval() time.Duration {
+	if c.mode == ClockBackfill {
+		return 0
+	}
+	return time.Duration(float64(c.step) / c.ratio)
+}
+
+// Start returns the first simulated timestamp, saved is where the previous
+// run of the device stopped.
+func (c *VirtualClock) Start(saved time.Time) time.Time {
+	if c.mode == ClockBackfill {
+		return c.from
+	}
+	return saved
+}
+
+// Step is the simulated time covered by one measurement.
+func (c *VirtualClock) Step() time.Duration {
+	return c.step
+}
+
+// Energy scales an hourly consumption to the simulated time of one step, a
+// step shorter than an hour reports its share of the hour.
+func (c *VirtualClock) Energy(hourly float64) float64 {
+	return hourly * c.step.Hours()
+}
+
+func (c *VirtualClock) Next(current time.Time) time.Time {
+	return current.Add(c.step)
+}
+
+// Done reports whether no more measurements should be produced.
+func (c *VirtualClock) Done(current time.Time) bool {
+	return c.mode == ClockBackfill && !current.Before(c.to)
+}
+
+func (c *VirtualClock) IsBackfill() bool {
+	return c.mode == ClockBackfill
+}
+
+func (c *VirtualClock) String() string {
+	switch c.mode {
+	case ClockBackfill:
+		return fmt.Sprintf("%s from %s to %s in steps of %s", c.mode, c.from.Format(time.RFC3339), c.to.Format(time.RFC3339), c.step)
+	default:
+		return fmt.Sprintf("%s with %s steps every %s", c.mode, c.step, c.Interval())
+	}
+}
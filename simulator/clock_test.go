@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewCompressedClockRejectsTooShortIntervals(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  time.Duration
+		ratio float64
+		ok    bool
+	}{
+		{"default pace", time.Hour, 60, true},
+		{"one millisecond", time.Hour, 3600000, true},
+		{"under a millisecond", time.Hour, 3600001, false},
+		{"rounds to zero", time.Nanosecond, 2, false},
+		{"zero ratio", time.Hour, 0, false},
+		{"negative ratio", time.Hour, -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock, err := NewCompressedClock(test.step, test.ratio)
+			if test.ok != (err == nil) {
+				t.Fatalf("NewCompressedClock(%s, %v) error = %v, want ok %v", test.step, test.ratio, err, test.ok)
+			}
+			if err == nil && clock.Interval() < minClockInterval {
+				t.Fatalf("interval %s is under %s", clock.Interval(), minClockInterval)
+			}
+		})
+	}
+}
+
+func TestClockEnergyScalesWithStep(t *testing.T) {
+	tests := []struct {
+		step   time.Duration
+		energy float64
+	}{
+		{time.Hour, 2},
+		{15 * time.Minute, 0.5},
+		{24 * time.Hour, 48},
+	}
+	for _, test := range tests {
+		clock := mustRealtimeClock(t, test.step)
+		if energy := clock.Energy(2); energy != test.energy {
+			t.Errorf("step %s reported %f kWh of a 2 kW hour, want %f", test.step, energy, test.energy)
+		}
+	}
+}
+
+func mustRealtimeClock(t *testing.T, step time.Duration) *VirtualClock {
+	t.Helper()
+	clock, err := NewRealtimeClock(step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clock
+}
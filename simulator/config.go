@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"time"
 )
@@ -11,6 +10,9 @@ import (
 type ConfigEntry struct {
 	LastMeasurement    time.Time
 	DowntimeSimulation time.Duration
+	MeterSerial        string
+	ImportRegister     float64
+	ExportRegister     float64
 }
 
 type Config struct {
@@ -36,27 +38,32 @@ func (c *Config) LoadConfig() error {
 	return nil
 }
 
+// SaveConfig replaces the config file through a rename, so a crash leaves
+// either the old or the new registers and never a torn file.
 func (c *Config) SaveConfig() error {
-	file, err := os.Create(c.filename)
-	if err != nil {
-		return fmt.Errorf("could not create file: %w", err)
-	}
-	defer file.Close()
-
 	fileData, err := json.Marshal(c.data)
 	if err != nil {
 		return fmt.Errorf("could not encode data: %w", err)
 	}
 
-	_, err = file.Write(fileData)
+	tmp := c.filename + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+	if _, err := file.Write(fileData); err != nil {
+		file.Close()
 		return fmt.Errorf("could not write file: %w", err)
 	}
-	err = file.Close()
-	if err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("could not sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
 		return fmt.Errorf("could not close file: %w", err)
 	}
-	log.Printf("wrote config file to %s", c.filename)
-
+	if err := os.Rename(tmp, c.filename); err != nil {
+		return fmt.Errorf("could not replace file: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveConfigReplacesFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "device.json")
+	config := &Config{filename: filename, data: &ConfigEntry{MeterSerial: "SIM0001", ImportRegister: 10}}
+	if err := config.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.data.ImportRegister = 12.5
+	config.data.LastMeasurement = time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	if err := config.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary config left behind: %v", err)
+	}
+
+	loaded := &Config{filename: filename}
+	if err := loaded.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.data.ImportRegister != 12.5 || !loaded.data.LastMeasurement.Equal(config.data.LastMeasurement) {
+		t.Fatalf("loaded %+v, want %+v", loaded.data, config.data)
+	}
+}
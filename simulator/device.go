@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"sync"
 	"time"
 
@@ -19,22 +18,45 @@ type DeviceOptions struct {
 	downtime  time.Duration
 }
 
+// DevicePaths tells a device where to keep its measurement logs and config.
+type DevicePaths struct {
+	logsDir    string
+	configFile string
+}
+
+func defaultDevicePaths(deviceID string) DevicePaths {
+	return DevicePaths{
+		logsDir:    "measurements/" + deviceID,
+		configFile: "config/config.json",
+	}
+}
+
 type Device struct {
 	lastRotation time.Time
 	Household    *Household
 	broker       *MessageBroker
 	buffer       *MessageBuffer
+	outbox       *Outbox
 	logger       *lumberjack.Logger
 	config       *Config
+	clock        *VirtualClock
+	meter        *Meter
+	scenario     *Scenario
 	ID           string
 	wg           sync.WaitGroup
+	cancel       context.CancelFunc
+	// nextReading is the simulated time of the next measurement
+	nextReading time.Time
 }
 
-func NewDevice(deviceID string, household *Household, exchangeName string, amqpUri string) (*Device, error) {
-	logsDir := "measurements/" + deviceID
+func NewDevice(deviceID string, household *Household, broker *MessageBroker, paths DevicePaths) (*Device, error) {
+	logsDir := paths.logsDir
 	if err := os.MkdirAll(logsDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create logs directory: %v", err)
 	}
+	if err := os.MkdirAll(filepath.Dir(paths.configFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %v", err)
+	}
 
 	// Setup lumberjack logger
 	logger := &lumberjack.Logger{
@@ -43,35 +65,37 @@ func NewDevice(deviceID string, household *Household, exchangeName string, amqpU
 		Compress:  false,
 		LocalTime: false,
 	}
+	outbox, err := NewOutbox(filepath.Join(logsDir, "outbox"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %v", err)
+	}
 	config := &Config{
-		filename: "config/config.json",
+		filename: paths.configFile,
 		data:     &ConfigEntry{},
 	}
+	meter, err := NewMeter(MeterBasic, deviceSeed(deviceID))
+	if err != nil {
+		return nil, err
+	}
 	return &Device{
 		ID:        deviceID,
 		Household: household,
-		broker:    NewMessageBroker(exchangeName, amqpUri),
+		broker:    broker,
 		buffer:    NewMessageBuffer(),
+		outbox:    outbox,
 		logger:    logger,
 		config:    config,
+		clock:     defaultClock(),
+		meter:     meter,
 	}, nil
 }
 
 func (d *Device) Start(ctx context.Context, options *DeviceOptions) error {
-	if err := d.broker.Connect(); err != nil {
+	if err := d.prepare(options); err != nil {
 		return err
 	}
-	if options == nil {
-		if err := d.config.LoadConfig(); err != nil {
-			return err
-		}
-	} else {
-		d.config.data.LastMeasurement = options.startDate
-		d.config.data.DowntimeSimulation = options.downtime
-	}
-	d.lastRotation = d.config.data.LastMeasurement
-	d.config.data.LastMeasurement = d.config.data.LastMeasurement.Add(d.config.data.DowntimeSimulation)
 
+	ctx, d.cancel = context.WithCancel(ctx)
 	d.wg.Add(2)
 	go func() {
 		defer d.wg.Done()
@@ -79,30 +103,55 @@ func (d *Device) Start(ctx context.Context, options *DeviceOptions) error {
 	}()
 	go func() {
 		defer d.wg.Done()
-		d.sendMeasurements(ctx, d.config.data.LastMeasurement)
+		d.sendBufferedMessages(ctx)
+		d.sendMeasurements(ctx, d.nextReading)
 	}()
 	return nil
 }
 
-func (d *Device) Shutdown(ctx context.Context) error {
-	if err := d.logger.Rotate(); err != nil {
-		return fmt.Errorf("failed to rotate logger: %v", err)
-	}
-	if err := d.logger.Close(); err != nil {
-		return fmt.Errorf("failed to close logger: %v", err)
+// prepare connects the device and continues where its previous run stopped,
+// the first reading is due at nextReading.
+func (d *Device) prepare(options *DeviceOptions) error {
+	if err := d.broker.Connect(); err != nil {
+		return err
 	}
-
-	if d.broker.conn != nil {
-		if err := d.broker.conn.Close(); err != nil {
-			return fmt.Errorf("failed to close broker connection: %v", err)
+	if options == nil {
+		if err := d.config.LoadConfig(); err != nil {
+			return err
 		}
+	} else {
+		d.config.data.LastMeasurement = options.startDate
+		d.config.data.DowntimeSimulation = options.downtime
 	}
+	d.lastRotation = d.config.data.LastMeasurement
+	d.meter.Restore(d.config.data)
 
-	if err := d.config.SaveConfig(); err != nil {
-		log.Printf("failed to save config: %v", err)
+	// Readings left unconfirmed by a previous run are replayed first
+	pending, err := d.outbox.Pending()
+	if err != nil {
+		return fmt.Errorf("failed to read outbox: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Replaying %d unconfirmed messages from outbox", len(pending))
+		d.buffer.Requeue(pending)
+	}
+	d.config.data.LastMeasurement = d.config.data.LastMeasurement.Add(d.config.data.DowntimeSimulation)
+	startTime := d.clock.Start(d.config.data.LastMeasurement)
+	if d.clock.IsBackfill() {
+		d.lastRotation = startTime
 	}
+	log.Printf("Device %s clock: %s", d.ID, d.clock)
+	d.scenario.Restart()
+	d.nextReading = startTime
+	return nil
+}
 
-	// Wait for all goroutines to finish
+// Shutdown stops the device's goroutines and waits for them before it closes
+// the outbox and the broker they write to.
+func (d *Device) Shutdown(ctx context.Context) error {
+	if d.cancel != nil {
+		d.cancel()
+	}
 	done := make(chan struct{})
 	go func() {
 		d.wg.Wait()
@@ -111,10 +160,38 @@ func (d *Device) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-done:
-		return nil
 	case <-ctx.Done():
+		// The goroutines still use everything, leave it open
 		return fmt.Errorf("shutdown timed out: %v", ctx.Err())
 	}
+
+	if err := d.close(); err != nil {
+		return err
+	}
+	if err := d.config.SaveConfig(); err != nil {
+		log.Printf("failed to save config: %v", err)
+	}
+	return nil
+}
+
+// close releases the logs, outbox and broker of a device that is not running.
+func (d *Device) close() error {
+	if err := d.logger.Rotate(); err != nil {
+		return fmt.Errorf("failed to rotate logger: %v", err)
+	}
+	if err := d.logger.Close(); err != nil {
+		return fmt.Errorf("failed to close logger: %v", err)
+	}
+	if err := d.outbox.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox: %v", err)
+	}
+	if err := d.scenario.Close(); err != nil {
+		return fmt.Errorf("failed to close scenario log: %v", err)
+	}
+	if err := d.broker.Close(); err != nil {
+		return fmt.Errorf("failed to close broker: %v", err)
+	}
+	return nil
 }
 
 func (d *Device) sendHeartbeats(ctx context.Context) {
@@ -126,26 +203,53 @@ func (d *Device) sendHeartbeats(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			heartbeat := newHeartbeat(d.ID, time.Now().Format(time.RFC3339))
-			payload, _ := json.Marshal(heartbeat)
-			msg := Message{
-				Type:      "heartbeat",
-				Payload:   payload,
-				Queue:     "heartbeat." + d.Household.address.City,
-				Timestamp: time.Now(),
-			}
-
-			if err := d.broker.PublishMessage(ctx, msg); err != nil {
-				log.Printf("Failed to send heartbeat: %v", err)
-			} else {
-				log.Printf("Sent heartbeat")
-			}
+			d.sendHeartbeat(ctx)
 		}
 	}
 }
 
+// useScenario injects the faults of the spec into this device.
+func (d *Device) useScenario(spec *ScenarioSpec) error {
+	scenario, err := NewScenario(spec, d.ID, filepath.Dir(d.logger.Filename))
+	if err != nil {
+		return err
+	}
+	d.scenario = scenario
+	return nil
+}
+
+func (d *Device) sendHeartbeat(ctx context.Context) {
+	if d.scenario.fault(FaultHeartbeatSilence, time.Time{}) != nil {
+		return
+	}
+	now := time.Now()
+	if fault := d.scenario.fault(FaultClockSkew, time.Time{}); fault != nil {
+		now = now.Add(time.Duration(fault.Skew))
+	}
+	heartbeat := newHeartbeat(d.ID, now.Format(time.RFC3339))
+	payload, _ := json.Marshal(heartbeat)
+	msg := Message{
+		Type:      "heartbeat",
+		DeviceID:  d.ID,
+		Payload:   payload,
+		Queue:     "heartbeat." + d.Household.address.City,
+		Timestamp: time.Now(),
+	}
+
+	if err := d.broker.PublishMessage(ctx, msg); err != nil {
+		log.Printf("Failed to send heartbeat: %v", err)
+	} else {
+		log.Printf("Sent heartbeat")
+	}
+}
+
 func (d *Device) sendMeasurements(ctx context.Context, currentTime time.Time) {
-	ticker := time.NewTicker(measurementInterval)
+	if d.clock.IsBackfill() {
+		d.backfillMeasurements(ctx, currentTime)
+		return
+	}
+
+	ticker := time.NewTicker(d.clock.Interval())
 	defer ticker.Stop()
 
 	for {
@@ -156,45 +260,177 @@ func (d *Device) sendMeasurements(ctx context.Context, currentTime time.Time) {
 			// On reconnect, try to send buffered messages
 			d.sendBufferedMessages(ctx)
 		case <-ticker.C:
-			d.config.data.LastMeasurement = currentTime
-			if err := d.checkAndRotateLog(currentTime); err != nil {
-				log.Printf("Error rotating log: %v", err)
-			}
+			d.sendMeasurement(ctx, currentTime)
+			currentTime = d.clock.Next(currentTime)
+		}
+	}
+}
 
-			value := d.Household.SimulateConsumption(currentTime)
-			measurement := newMeasurement(d.ID, value, currentTime, *d.Household.address)
-			payload, _ := json.Marshal(measurement)
-			msg := Message{
-				Type:      "measurement",
-				Payload:   payload,
-				Queue:     "measurement." + d.Household.address.City,
-				Timestamp: currentTime,
-			}
-			if err := d.logMeasurement(measurement); err != nil {
-				log.Printf("Failed to log measurement: %v", err)
+// backfillMeasurements sends the clock's whole range back to back. Every
+// publish waits for the broker confirm, so the broker sets the pace.
+func (d *Device) backfillMeasurements(ctx context.Context, currentTime time.Time) {
+	for !d.clock.Done(currentTime) {
+		d.sendMeasurement(ctx, currentTime)
+		currentTime = d.clock.Next(currentTime)
+
+		// The broker is not accepting readings, wait for it instead of
+		// piling the rest of the range up in the buffer
+		for d.buffer.Len() > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.broker.reconnecting:
+			case <-time.After(reconnectDelay):
 			}
-			// Try to send measurement
+			d.sendBufferedMessages(ctx)
+		}
+	}
+	log.Printf("Backfill finished at %s", currentTime.Format(time.RFC3339))
+}
+
+// step sends the next reading of a device driven by the fleet scheduler
+// and returns how long to wait before the following one, false once the
+// clock is done. Readings the broker did not take are retried first, while
+// backfilling nothing new is produced until they went out.
+func (d *Device) step(ctx context.Context) (time.Duration, bool) {
+	select {
+	case <-d.broker.reconnecting:
+		d.sendBufferedMessages(ctx)
+	default:
+	}
+	if d.clock.IsBackfill() && d.buffer.Len() > 0 {
+		d.sendBufferedMessages(ctx)
+		if d.buffer.Len() > 0 {
+			return reconnectDelay, true
+		}
+	}
+	if d.clock.Done(d.nextReading) {
+		log.Printf("Backfill of device %s finished at %s", d.ID, d.nextReading.Format(time.RFC3339))
+		return 0, false
+	}
+	d.sendMeasurement(ctx, d.nextReading)
+	d.nextReading = d.clock.Next(d.nextReading)
+	return d.clock.Interval(), true
+}
+
+func (d *Device) sendMeasurement(ctx context.Context, currentTime time.Time) {
+	d.config.data.LastMeasurement = currentTime
+	if err := d.checkAndRotateLog(currentTime); err != nil {
+		log.Printf("Error rotating log: %v", err)
+	}
+
+	value := d.clock.Energy(d.Household.SimulateConsumption(currentTime))
+	if fault := d.scenario.fault(FaultSpike, currentTime); fault != nil {
+		value *= fault.Factor
+		d.scenario.logf("spike x%v at %s: %f", fault.Factor, currentTime.Format(time.RFC3339), value)
+	}
+	sentTime := currentTime
+	if fault := d.scenario.fault(FaultClockSkew, currentTime); fault != nil {
+		sentTime = currentTime.Add(time.Duration(fault.Skew))
+		d.scenario.logf("skewed measurement at %s to %s", currentTime.Format(time.RFC3339), sentTime.Format(time.RFC3339))
+	}
+	if fault := d.scenario.fault(FaultRegisterReset, currentTime); fault != nil && d.meter.Apply(fault) {
+		d.scenario.logf("reset meter registers at %s", currentTime.Format(time.RFC3339))
+	}
+	if fault := d.scenario.fault(FaultMeterReplacement, currentTime); fault != nil && d.meter.Apply(fault) {
+		d.scenario.logf("replaced meter at %s, new serial %s", currentTime.Format(time.RFC3339), d.meter.serial)
+	}
+	measurement := newMeasurement(d.ID, value, sentTime, *d.Household.address)
+	d.meter.Read(measurement, d.clock.Step())
+	d.meter.Save(d.config.data)
+	// The registers are on disk before the reading can reach the consumer,
+	// a restart never resumes from registers older than a sent reading
+	if err := d.config.SaveConfig(); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+	if err := d.logMeasurement(measurement); err != nil {
+		log.Printf("Failed to log measurement: %v", err)
+	}
+	if d.scenario.fault(FaultMeasurementSilence, currentTime) != nil {
+		// The meter still records the reading, it just never reports it
+		d.scenario.logf("suppressed measurement at %s", currentTime.Format(time.RFC3339))
+		return
+	}
+
+	payload, _ := json.Marshal(measurement)
+	if d.scenario.fault(FaultMalformedPayload, currentTime) != nil {
+		payload = d.scenario.corrupt(payload)
+		d.scenario.logf("malformed measurement at %s: %q", currentTime.Format(time.RFC3339), payload)
+	}
+	msg := Message{
+		Type:      "measurement",
+		DeviceID:  d.ID,
+		Payload:   payload,
+		Queue:     "measurement." + d.Household.address.City,
+		Timestamp: currentTime,
+	}
+	msg, err := d.outbox.Append(msg)
+	if err != nil {
+		log.Printf("Failed to store measurement in outbox: %v", err)
+	}
+
+	if fault := d.scenario.fault(FaultOutOfOrder, currentTime); fault != nil {
+		batch := d.scenario.hold(msg, fault.Window)
+		if len(batch) > 0 {
+			d.scenario.logf("sending %d measurements in reversed order", len(batch))
+		}
+		for _, held := range batch {
+			d.deliverMeasurement(ctx, held)
+		}
+		return
+	}
+	for _, held := range d.scenario.release() {
+		d.deliverMeasurement(ctx, held)
+	}
+	d.deliverMeasurement(ctx, msg)
+
+	if fault := d.scenario.fault(FaultDuplicateSend, currentTime); fault != nil {
+		for i := 0; i < fault.Copies; i++ {
 			if err := d.broker.PublishMessage(ctx, msg); err != nil {
-				log.Printf("Failed to send measurement: %v", err)
-				d.buffer.Add(msg)
-			} else {
-				log.Printf("Sent measurement")
+				log.Printf("Failed to send duplicate measurement: %v", err)
 			}
-
-			currentTime = currentTime.Add(1 * time.Hour)
 		}
+		d.scenario.logf("sent %d duplicates of measurement at %s", fault.Copies, currentTime.Format(time.RFC3339))
 	}
 }
 
+// deliverMeasurement publishes the message, or buffers it behind older
+// readings that are still waiting for the broker.
+func (d *Device) deliverMeasurement(ctx context.Context, msg Message) {
+	if d.buffer.Len() > 0 {
+		// Older readings are still waiting, keep them in order
+		d.buffer.Add(msg)
+		d.sendBufferedMessages(ctx)
+	} else if err := d.publishMeasurement(ctx, msg); err != nil {
+		log.Printf("Failed to send measurement: %v", err)
+		d.buffer.Add(msg)
+	} else {
+		log.Printf("Sent measurement")
+	}
+}
+
+func (d *Device) publishMeasurement(ctx context.Context, msg Message) error {
+	if err := d.broker.PublishMessage(ctx, msg); err != nil {
+		return err
+	}
+	if msg.Seq == 0 {
+		return nil
+	}
+	if err := d.outbox.Ack(msg.Seq); err != nil {
+		log.Printf("Failed to trim outbox: %v", err)
+	}
+	return nil
+}
+
 func (d *Device) sendBufferedMessages(ctx context.Context) {
 	messages := d.buffer.Flush()
-	for _, msg := range messages {
-		if err := d.broker.PublishMessage(ctx, msg); err != nil {
-			// If still failing, add back to buffer
-			d.buffer.Add(msg)
-		} else {
-			log.Printf("Sent buffered message of type: %s", msg.Type)
+	for i, msg := range messages {
+		if err := d.publishMeasurement(ctx, msg); err != nil {
+			// If still failing, put the rest back so the order is kept
+			d.buffer.Requeue(messages[i:])
+			return
 		}
+		log.Printf("Sent buffered message of type: %s", msg.Type)
 	}
 }
 
@@ -206,9 +442,6 @@ func (d *Device) checkAndRotateLog(currentTime time.Time) error {
 		if err := d.logger.Rotate(); err != nil {
 			return fmt.Errorf("failed to rotate log file: %v", err)
 		}
-		if err := d.config.SaveConfig(); err != nil {
-			return fmt.Errorf("failed to save config: %v", err)
-		}
 
 		d.lastRotation = currentTime
 		log.Printf("Rotated log file to %s", d.logger.Filename)
@@ -216,9 +449,15 @@ func (d *Device) checkAndRotateLog(currentTime time.Time) error {
 	return nil
 }
 
+// logMeasurement appends the measurement as sent, so the replay subcommand
+// can publish it again unchanged.
 func (d *Device) logMeasurement(m *Measurement) error {
-	logEntry := m.Timestamp.Local().String() + "->" + strconv.FormatFloat(m.Value, 'f', -1, 64)
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal measurement: %v", err)
+	}
+	logEntry := m.Timestamp.Local().String() + "->" + string(payload)
 
-	_, err := d.logger.Write(append([]byte(logEntry), '\n'))
+	_, err = d.logger.Write(append([]byte(logEntry), '\n'))
 	return err
 }
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultFleetConnections = 4
+	defaultFleetWorkers     = 64
+	defaultFleetDataDir     = "fleet"
+	defaultFleetStreet      = "Simulated Street"
+	defaultFleetNumber      = "123"
+)
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+// ManifestEntry describes one simulated device of a fleet.
+type ManifestEntry struct {
+	DeviceID string
+	City     string
+	Street   string
+	Number   string
+	Profile  string
+	Meter    MeterType
+}
+
+// LoadManifest reads fleet devices from a CSV file with a header row (like
+// the generator's simulators.csv) or from a JSON array of entries.
+func LoadManifest(filename string) ([]ManifestEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest: %w", err)
+	}
+	defer file.Close()
+
+	var entries []ManifestEntry
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		if err := json.NewDecoder(file).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("could not unmarshal manifest: %w", err)
+		}
+	} else {
+		entries, err = readCSVManifest(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	valid := make([]ManifestEntry, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.DeviceID == "" || entry.City == "" {
+			log.Printf("Skipping manifest entry without device id or city: %+v", entry)
+			continue
+		}
+		if seen[entry.DeviceID] {
+			log.Printf("Skipping duplicate manifest entry for device %s", entry.DeviceID)
+			continue
+		}
+		seen[entry.DeviceID] = true
+		if entry.Street == "" {
+			entry.Street = defaultFleetStreet
+		}
+		if entry.Number == "" {
+			entry.Number = defaultFleetNumber
+		}
+		valid = append(valid, entry)
+	}
+	return valid, nil
+}
+
+func readCSVManifest(r io.Reader) ([]ManifestEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["device_id"]; !ok {
+		return nil, fmt.Errorf("manifest header is missing the device_id column")
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var entries []ManifestEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest record: %w", err)
+		}
+		entries = append(entries, ManifestEntry{
+			DeviceID: field(record, "device_id"),
+			City:     field(record, "city"),
+			Street:   field(record, "street"),
+			Number:   field(record, "number"),
+			Profile:  field(record, "profile"),
+			Meter:    MeterType(field(record, "meter")),
+		})
+	}
+	return entries, nil
+}
+
+// deviceSeed keeps the uuid based seed of single device mode and falls back
+// to the FNV hash the generator uses for other device ids.
+func deviceSeed(deviceID string) int64 {
+	if _, err := uuid.Parse(strings.TrimSpace(deviceID)); err == nil {
+		seed, _ := uuidStrToInt64(deviceID)
+		return seed
+	}
+	hasher := fnv.New64a()
+	hasher.Write([]byte(deviceID))
+	return int64(hasher.Sum64())
+}
+
+// ConnectionPool shares a fixed number of AMQP connections between the
+// devices of a fleet. Every device still opens its own channel.
+type ConnectionPool struct {
+	amqpURI string
+	conns   []*amqp.Connection
+	mu      sync.Mutex
+	closed  bool
+}
+
+func NewConnectionPool(amqpURI string, size int) *ConnectionPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ConnectionPool{
+		amqpURI: amqpURI,
+		conns:   make([]*amqp.Connection, size),
+	}
+}
+
+// Connection returns the live connection of the slot, redialing it when the
+// previous one was lost.
+func (p *ConnectionPool) Connection(slot int) (*amqp.Connection, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	i := slot % len(p.conns)
+	if p.conns[i] != nil && !p.conns[i].IsClosed() {
+		return p.conns[i], nil
+	}
+	conn, err := amqp.DialConfig(p.amqpURI, amqp.Config{
+		Heartbeat: 10 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	p.conns[i] = conn
+	return conn, nil
+}
+
+func (p *ConnectionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for i, conn := range p.conns {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			log.Printf("Error closing pooled connection: %v", err)
+		}
+		p.conns[i] = nil
+	}
+}
+
+// Fleet runs many devices in one process over a shared connection pool.
+// The devices have no goroutines of their own, one scheduler hands their due
+// measurements and heartbeats to a fixed number of workers.
+type Fleet struct {
+	devices []*Device
+	pool    *ConnectionPool
+	workers int
+	dataDir string
+	wg      sync.WaitGroup
+}
+
+func NewFleet(entries []ManifestEntry, amqpURI string, connections int, workers int, dataDir string, clock *VirtualClock, scenario *ScenarioSpec) (*Fleet, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	fleet := &Fleet{
+		pool:    NewConnectionPool(amqpURI, connections),
+		workers: workers,
+		dataDir: dataDir,
+	}
+
+	for i, entry := range entries {
+		household, err := newHouseholdWithProfile(deviceSeed(entry.DeviceID), newLocation(entry.City, entry.Street, entry.Number), entry.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create device %s: %v", entry.DeviceID, err)
+		}
+		deviceDir := filepath.Join(dataDir, entry.DeviceID)
+		device, err := NewDevice(entry.DeviceID, household,
+			NewPooledMessageBroker(exchangeName, fleet.pool, i),
+			DevicePaths{
+				logsDir:    filepath.Join(deviceDir, "measurements"),
+				configFile: filepath.Join(deviceDir, "config.json"),
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create device %s: %v", entry.DeviceID, err)
+		}
+		device.clock = clock
+		device.meter, err = NewMeter(entry.Meter, deviceSeed(entry.DeviceID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create device %s: %v", entry.DeviceID, err)
+		}
+		if scenario != nil {
+			if err := device.useScenario(scenario); err != nil {
+				return nil, fmt.Errorf("failed to create device %s: %v", entry.DeviceID, err)
+			}
+		}
+		fleet.devices = append(fleet.devices, device)
+	}
+	return fleet, nil
+}
+
+// Start prepares the devices on the workers and then drives them until ctx
+// ends. Devices without a saved config start from the current time. When a
+// device fails to start, or ctx ends first, the devices already started are
+// shut down again.
+func (f *Fleet) Start(ctx context.Context) error {
+	var mu sync.Mutex
+	var started []*Device
+	var errs []error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	}
+
+	devices := make(chan *Device)
+	var wg sync.WaitGroup
+	for i := 0; i < min(f.workers, len(f.devices)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for device := range devices {
+				var options *DeviceOptions
+				if _, err := os.Stat(device.config.filename); os.IsNotExist(err) {
+					options = &DeviceOptions{startDate: time.Now()}
+				}
+				err := device.prepare(options)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("device %s: %w", device.ID, err))
+				} else {
+					started = append(started, device)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, device := range f.devices {
+		if failed() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break feed
+		case devices <- device:
+		}
+	}
+	close(devices)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		f.abort(started)
+		return errors.Join(errs...)
+	}
+	f.run(ctx)
+	log.Printf("Started fleet of %d devices on %d workers", len(f.devices), f.workers)
+	return nil
+}
+
+// abort shuts down the devices of a fleet that failed to start, the others
+// only have their files to close.
+func (f *Fleet) abort(started []*Device) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, device := range f.devices {
+		var err error
+		if slices.Contains(started, device) {
+			err = device.Shutdown(ctx)
+		} else {
+			err = device.close()
+		}
+		if err != nil {
+			log.Printf("Failed to stop device %s: %v", device.ID, err)
+		}
+	}
+	f.pool.Close()
+}
+
+// fleetJob is the next measurement or heartbeat of a device.
+type fleetJob struct {
+	device    *Device
+	heartbeat bool
+	due       time.Time
+	done      bool
+}
+
+// run does the job and moves it to when it is due again. A job running late
+// is due right away but does not catch up on the runs it missed.
+func (j *fleetJob) run(ctx context.Context) {
+	wait := heartbeatInterval
+	if j.heartbeat {
+		j.device.sendHeartbeat(ctx)
+	} else {
+		var more bool
+		wait, more = j.device.step(ctx)
+		j.done = !more
+	}
+	j.due = j.due.Add(wait)
+	if now := time.Now(); j.due.Before(now) {
+		j.due = now
+	}
+}
+
+// jobQueue orders the jobs waiting for their time by when they are due.
+type jobQueue []*fleetJob
+
+func (q jobQueue) Len() int           { return len(q) }
+func (q jobQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q jobQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *jobQueue) Push(x any)        { *q = append(*q, x.(*fleetJob)) }
+func (q *jobQueue) Pop() any {
+	old := *q
+	job := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return job
+}
+
+// run starts the scheduler and the workers, they stop once ctx ends and a
+// running job finished.
+func (f *Fleet) run(ctx context.Context) {
+	jobs := make(chan *fleetJob)
+	// Every worker holds at most one job, so handing it back never blocks
+	finished := make(chan *fleetJob, f.workers)
+	for i := 0; i < f.workers; i++ {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			for job := range jobs {
+				job.run(ctx)
+				finished <- job
+			}
+		}()
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer close(jobs)
+		f.schedule(ctx, jobs, finished)
+	}()
+}
+
+// schedule hands due jobs to the workers in the order they became due. A job
+// only goes back into the queue once it finished, so a device never runs
+// the same job twice at a time.
+func (f *Fleet) schedule(ctx context.Context, jobs chan<- *fleetJob, finished <-chan *fleetJob) {
+	queue := &jobQueue{}
+	now := time.Now()
+	for _, device := range f.devices {
+		heap.Push(queue, &fleetJob{device: device, due: now.Add(device.clock.Interval())})
+		heap.Push(queue, &fleetJob{device: device, heartbeat: true, due: now.Add(heartbeatInterval)})
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var ready []*fleetJob
+	for {
+		for queue.Len() > 0 && !(*queue)[0].due.After(time.Now()) {
+			ready = append(ready, heap.Pop(queue).(*fleetJob))
+		}
+		if queue.Len() > 0 {
+			timer.Reset(time.Until((*queue)[0].due))
+		}
+
+		var send chan<- *fleetJob
+		var next *fleetJob
+		if len(ready) > 0 {
+			send, next = jobs, ready[0]
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case send <- next:
+			ready = ready[1:]
+		case job := <-finished:
+			if !job.done {
+				heap.Push(queue, job)
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// Shutdown waits for the running jobs, the context given to Start has to be
+// cancelled first, and then shuts the devices down.
+func (f *Fleet) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown timed out: %v", ctx.Err())
+	}
+
+	var errs []error
+	for _, device := range f.devices {
+		if err := device.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", device.ID, err))
+		}
+	}
+	f.pool.Close()
+	return errors.Join(errs...)
+}
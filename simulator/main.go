@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,12 +37,106 @@ func uuidStrToInt64(uStr string) (int64, error) {
 	return int64(binary.BigEndian.Uint64(hash[:8])), nil
 }
 
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func runFleet(manifest string, amqpURI string, clock *VirtualClock, scenario *ScenarioSpec) {
+	entries, err := LoadManifest(manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) == 0 {
+		log.Fatalf("manifest %s has no devices", manifest)
+	}
+
+	// METER_TYPE applies to devices whose manifest entry names no meter
+	for i := range entries {
+		if entries[i].Meter == "" {
+			entries[i].Meter = MeterType(os.Getenv("METER_TYPE"))
+		}
+	}
+
+	dataDir := os.Getenv("FLEET_DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultFleetDataDir
+	}
+	fleet, err := NewFleet(entries, amqpURI,
+		envInt("FLEET_CONNECTIONS", defaultFleetConnections),
+		envInt("FLEET_WORKERS", defaultFleetWorkers),
+		dataDir, clock, scenario)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := fleet.Start(ctx); err != nil {
+		cancel()
+		log.Fatal(err)
+	}
+
+	sig := <-sigChan
+	log.Printf("Received signal: %v. Starting graceful shutdown of %d devices...", sig, len(entries))
+
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+
+	if err := fleet.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+		os.Exit(1)
+	}
+
+	log.Println("Graceful shutdown completed")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
+	amqpURI := os.Getenv("AMQP_URI")
+	// PROFILES_FILE adds consumption profiles on top of the built-in ones
+	if profilesFile := os.Getenv("PROFILES_FILE"); profilesFile != "" {
+		if err := LoadProfileSpecs(profilesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	clock, err := clockFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// SCENARIO_FILE scripts faults into the simulated devices
+	var scenario *ScenarioSpec
+	if scenarioFile := os.Getenv("SCENARIO_FILE"); scenarioFile != "" {
+		scenario, err = LoadScenario(scenarioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// FLEET_MANIFEST runs every device of the manifest in this process
+	if manifest := os.Getenv("FLEET_MANIFEST"); manifest != "" {
+		if amqpURI == "" {
+			log.Fatal("AMQP_URI is required!")
+		}
+		runFleet(manifest, amqpURI, clock, scenario)
+		return
+	}
+
 	deviceID := os.Getenv("DEVICE_ID")
 	city := os.Getenv("DEVICE_CITY")
 	street := os.Getenv("DEVICE_STREET")
 	number := os.Getenv("DEVICE_NUMBER")
-	amqpURI := os.Getenv("AMQP_URI")
 	// deviceID := flag.String("device", "0", "uuid of the device")
 	// city := flag.String("city", "0", "city")
 	// street := flag.String("street", "0", "street")
@@ -64,11 +159,24 @@ func main() {
 		log.Fatal(err)
 	}
 
-	household := newHousehold(deviceIDInt, address)
-	device, err := NewDevice(deviceID, household, exchangeName, amqpURI)
+	household, err := newHouseholdWithProfile(deviceIDInt, address, os.Getenv("DEVICE_PROFILE"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	device, err := NewDevice(deviceID, household, NewMessageBroker(exchangeName, amqpURI), defaultDevicePaths(deviceID))
+	if err != nil {
+		log.Fatal(err)
+	}
+	device.clock = clock
+	device.meter, err = NewMeter(MeterType(os.Getenv("METER_TYPE")), deviceIDInt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if scenario != nil {
+		if err := device.useScenario(scenario); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if err := device.Start(ctx, nil); err != nil {
 		cancel()
@@ -15,21 +15,48 @@ func newHeartbeat(device string, timestamp string) *Heartbeat {
 }
 
 type Message struct {
+	Seq       uint64
 	Type      string
+	DeviceID  string
 	Payload   []byte
 	Queue     string
 	Timestamp time.Time
 }
 
+// measurementSchemaVersion 2 adds the reading interval and the optional
+// electrical fields. Readings without a Version are version 1.
+const measurementSchemaVersion = 2
+
+type PhaseReading struct {
+	Voltage float64 // V
+	Current float64 // A
+	Power   float64 // kW, negative while exporting
+}
+
 type Measurement struct {
+	Version   int
 	DeviceID  string
-	Value     float64
+	Value     float64 // kWh consumed during the interval
 	Timestamp time.Time
 	Address   Location
+
+	// The registers are the meter's running totals, they let the consumer
+	// recover the energy of readings that never arrived.
+	MeterSerial    string   `json:",omitempty"`
+	ImportRegister *float64 `json:",omitempty"` // kWh drawn from the grid since installation
+	ExportRegister *float64 `json:",omitempty"` // kWh fed into the grid since installation
+
+	IntervalSeconds int            `json:",omitempty"`
+	Voltage         *float64       `json:",omitempty"` // V, average over the phases
+	Current         *float64       `json:",omitempty"` // A, sum over the phases
+	PowerFactor     *float64       `json:",omitempty"`
+	ReactiveEnergy  *float64       `json:",omitempty"` // kvarh during the interval
+	Phases          []PhaseReading `json:",omitempty"`
 }
 
 func newMeasurement(deviceID string, value float64, timestamp time.Time, location Location) *Measurement {
 	return &Measurement{
+		Version:   measurementSchemaVersion,
 		DeviceID:  deviceID,
 		Value:     value,
 		Timestamp: timestamp,
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+type MeterType string
+
+const (
+	// MeterBasic only reports the consumed energy.
+	MeterBasic MeterType = "basic"
+	// MeterSinglePhase adds voltage, current, power factor and reactive energy.
+	MeterSinglePhase MeterType = "single-phase"
+	// MeterThreePhase additionally reports every phase on its own.
+	MeterThreePhase MeterType = "three-phase"
+)
+
+const nominalVoltage = 230.0
+
+// Meter derives the electrical quantities a smart meter reports from the
+// simulated energy and keeps its import and export registers. It uses its own
+// random source, so picking a meter type never changes the consumption a
+// seeded household produces.
+type Meter struct {
+	kind           MeterType
+	rng            *rand.Rand
+	powerFactor    float64
+	phaseShare     [3]float64
+	serial         string
+	importRegister float64
+	exportRegister float64
+	// applied is the last scenario fault that reset or replaced the meter,
+	// faults stay active for a while but only act once.
+	applied *Fault
+}
+
+func NewMeter(kind MeterType, seed int64) (*Meter, error) {
+	if kind == "" {
+		kind = MeterBasic
+	}
+	switch kind {
+	case MeterBasic, MeterSinglePhase, MeterThreePhase:
+	default:
+		return nil, fmt.Errorf("unknown meter type %q", kind)
+	}
+
+	rng := rand.New(rand.NewSource(seed ^ 0x6d65746572))
+	meter := &Meter{
+		kind:        kind,
+		rng:         rng,
+		powerFactor: 0.88 + rng.Float64()*0.1,
+		serial:      fmt.Sprintf("SIM%08X", uint32(seed)),
+	}
+	// Loads are never spread evenly over the phases of a house
+	total := 0.0
+	for i := range meter.phaseShare {
+		meter.phaseShare[i] = 0.7 + rng.Float64()*0.6
+		total += meter.phaseShare[i]
+	}
+	for i := range meter.phaseShare {
+		meter.phaseShare[i] /= total
+	}
+	return meter, nil
+}
+
+func (m *Meter) voltage() float64 {
+	return nominalVoltage * (1 + m.rng.NormFloat64()*0.01)
+}
+
+// Restore continues the registers saved by a previous run.
+func (m *Meter) Restore(config *ConfigEntry) {
+	if config.MeterSerial == "" {
+		return
+	}
+	m.serial = config.MeterSerial
+	m.importRegister = config.ImportRegister
+	m.exportRegister = config.ExportRegister
+}
+
+func (m *Meter) Save(config *ConfigEntry) {
+	config.MeterSerial = m.serial
+	config.ImportRegister = m.importRegister
+	config.ExportRegister = m.exportRegister
+}
+
+// Apply resets the registers for a register-reset fault and installs a new
+// meter for a meter-replacement fault. It reports false when the fault was
+// already applied.
+func (m *Meter) Apply(fault *Fault) bool {
+	if m.applied == fault {
+		return false
+	}
+	m.applied = fault
+	if fault.Type == FaultMeterReplacement {
+		m.serial = fmt.Sprintf("SIM%08X", m.rng.Uint32())
+	}
+	m.importRegister = 0
+	m.exportRegister = 0
+	return true
+}
+
+// Read advances the registers by the measured energy and fills in the
+// interval, the registers and, depending on the meter type, the electrical
+// fields of the measurement.
+func (m *Meter) Read(measurement *Measurement, interval time.Duration) {
+	measurement.IntervalSeconds = int(interval / time.Second)
+	if measurement.Value >= 0 {
+		m.importRegister += measurement.Value
+	} else {
+		m.exportRegister -= measurement.Value
+	}
+	importRegister, exportRegister := m.importRegister, m.exportRegister
+	measurement.MeterSerial = m.serial
+	measurement.ImportRegister = &importRegister
+	measurement.ExportRegister = &exportRegister
+	if m.kind == MeterBasic {
+		return
+	}
+
+	power := measurement.Value / interval.Hours()
+	powerFactor := math.Min(1, m.powerFactor+m.rng.NormFloat64()*0.01)
+	reactiveEnergy := math.Abs(measurement.Value) * math.Tan(math.Acos(powerFactor))
+	measurement.PowerFactor = &powerFactor
+	measurement.ReactiveEnergy = &reactiveEnergy
+
+	if m.kind == MeterSinglePhase {
+		voltage := m.voltage()
+		current := math.Abs(power) * 1000 / (voltage * powerFactor)
+		measurement.Voltage = &voltage
+		measurement.Current = &current
+		return
+	}
+
+	var voltageSum, currentSum float64
+	measurement.Phases = make([]PhaseReading, len(m.phaseShare))
+	for i, share := range m.phaseShare {
+		phasePower := power * share
+		voltage := m.voltage()
+		current := math.Abs(phasePower) * 1000 / (voltage * powerFactor)
+		measurement.Phases[i] = PhaseReading{
+			Voltage: voltage,
+			Current: current,
+			Power:   phasePower,
+		}
+		voltageSum += voltage
+		currentSum += current
+	}
+	voltage := voltageSum / float64(len(m.phaseShare))
+	measurement.Voltage = &voltage
+	measurement.Current = &currentSum
+}
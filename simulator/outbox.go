@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	outboxSegmentExt = ".seg"
+	outboxCheckpoint = "checkpoint.json"
+)
+
+// outboxMaxSegmentLen is the size after which a new segment is started.
+var outboxMaxSegmentLen int64 = 1 << 20 // 1 MiB
+
+type outboxCheckpointEntry struct {
+	Acked uint64
+}
+
+type outboxSegment struct {
+	firstSeq uint64
+	path     string
+}
+
+// Outbox is a durable, append-only log of messages that still have to be
+// confirmed by the broker. Messages are written to segment files before they
+// are published and the checkpoint is moved forward once they are confirmed,
+// so unsent readings survive a device restart.
+type Outbox struct {
+	dir      string
+	segments []outboxSegment
+	active   *os.File
+	size     int64
+	nextSeq  uint64
+	acked    uint64
+	pending  map[uint64]bool
+	mu       sync.Mutex
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	ob := &Outbox{
+		dir:     dir,
+		nextSeq: 1,
+		pending: make(map[uint64]bool),
+	}
+
+	if err := ob.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	if err := ob.loadSegments(); err != nil {
+		return nil, err
+	}
+	if ob.nextSeq <= ob.acked {
+		ob.nextSeq = ob.acked + 1
+	}
+	return ob, nil
+}
+
+func (ob *Outbox) loadCheckpoint() error {
+	fileData, err := os.ReadFile(filepath.Join(ob.dir, outboxCheckpoint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read outbox checkpoint: %w", err)
+	}
+	var entry outboxCheckpointEntry
+	if err := json.Unmarshal(fileData, &entry); err != nil {
+		return fmt.Errorf("could not unmarshal outbox checkpoint: %w", err)
+	}
+	ob.acked = entry.Acked
+	return nil
+}
+
+func (ob *Outbox) loadSegments() error {
+	entries, err := os.ReadDir(ob.dir)
+	if err != nil {
+		return fmt.Errorf("could not read outbox directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, outboxSegmentExt) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(name, outboxSegmentExt), 10, 64)
+		if err != nil {
+			log.Printf("Ignoring unknown outbox file %s", name)
+			continue
+		}
+		ob.segments = append(ob.segments, outboxSegment{
+			firstSeq: firstSeq,
+			path:     filepath.Join(ob.dir, name),
+		})
+	}
+	sort.Slice(ob.segments, func(i, j int) bool {
+		return ob.segments[i].firstSeq < ob.segments[j].firstSeq
+	})
+
+	if len(ob.segments) == 0 {
+		return nil
+	}
+	last := ob.segments[len(ob.segments)-1]
+	messages, valid, err := readSegment(last.path)
+	if err != nil {
+		return err
+	}
+	// Cut a torn record off the tail, the next one would be appended to it
+	// and be lost along with it
+	if info, err := os.Stat(last.path); err == nil && info.Size() > valid {
+		log.Printf("Truncating torn outbox segment %s to %d bytes", last.path, valid)
+		if err := os.Truncate(last.path, valid); err != nil {
+			return fmt.Errorf("could not truncate outbox segment: %w", err)
+		}
+	}
+	ob.nextSeq = last.firstSeq
+	if len(messages) > 0 {
+		ob.nextSeq = messages[len(messages)-1].Seq + 1
+	}
+	return nil
+}
+
+// readSegment returns the records of a segment up to the first torn one,
+// together with the number of bytes they take.
+func readSegment(path string) ([]Message, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open outbox segment: %w", err)
+	}
+	defer file.Close()
+
+	messages := make([]Message, 0)
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Skipping unterminated outbox record in %s", path)
+			}
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read outbox segment: %w", err)
+		}
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			// A torn write at the tail of the segment, nothing after it is valid
+			log.Printf("Skipping corrupt outbox record in %s: %v", path, err)
+			break
+		}
+		messages = append(messages, msg)
+		valid += int64(len(line))
+	}
+	return messages, valid, nil
+}
+
+// Append durably stores the message and returns it with its assigned sequence number.
+func (ob *Outbox) Append(msg Message) (Message, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.active == nil || ob.size >= outboxMaxSegmentLen {
+		if err := ob.openSegment(); err != nil {
+			return msg, err
+		}
+	}
+
+	stored := msg
+	stored.Seq = ob.nextSeq
+	record, err := json.Marshal(stored)
+	if err != nil {
+		return msg, fmt.Errorf("could not encode outbox record: %w", err)
+	}
+	n, err := ob.active.Write(append(record, '\n'))
+	if err != nil {
+		return msg, fmt.Errorf("could not write outbox record: %w", err)
+	}
+	if err := ob.active.Sync(); err != nil {
+		return msg, fmt.Errorf("could not sync outbox segment: %w", err)
+	}
+	ob.size += int64(n)
+	ob.nextSeq++
+	return stored, nil
+}
+
+func (ob *Outbox) openSegment() error {
+	if ob.active != nil {
+		if err := ob.active.Close(); err != nil {
+			return fmt.Errorf("could not close outbox segment: %w", err)
+		}
+	}
+	path := filepath.Join(ob.dir, fmt.Sprintf("%020d%s", ob.nextSeq, outboxSegmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open outbox segment: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not stat outbox segment: %w", err)
+	}
+	ob.active = file
+	ob.size = info.Size()
+	if len(ob.segments) == 0 || ob.segments[len(ob.segments)-1].path != path {
+		ob.segments = append(ob.segments, outboxSegment{firstSeq: ob.nextSeq, path: path})
+	}
+	return nil
+}
+
+// Ack marks the message as confirmed by the broker. The checkpoint only moves
+// over a contiguous run of confirmed messages, so an unconfirmed message is
+// never skipped on replay.
+func (ob *Outbox) Ack(seq uint64) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if seq <= ob.acked {
+		return nil
+	}
+	ob.pending[seq] = true
+	advanced := false
+	for ob.pending[ob.acked+1] {
+		delete(ob.pending, ob.acked+1)
+		ob.acked++
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+	if err := ob.saveCheckpoint(); err != nil {
+		return err
+	}
+	return ob.trim()
+}
+
+func (ob *Outbox) saveCheckpoint() error {
+	fileData, err := json.Marshal(outboxCheckpointEntry{Acked: ob.acked})
+	if err != nil {
+		return fmt.Errorf("could not encode outbox checkpoint: %w", err)
+	}
+	tmp := filepath.Join(ob.dir, outboxCheckpoint+".tmp")
+	if err := os.WriteFile(tmp, fileData, 0644); err != nil {
+		return fmt.Errorf("could not write outbox checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(ob.dir, outboxCheckpoint)); err != nil {
+		return fmt.Errorf("could not replace outbox checkpoint: %w", err)
+	}
+	return nil
+}
+
+// trim removes segments whose every record is covered by the checkpoint.
+// The segment currently written to is always kept.
+func (ob *Outbox) trim() error {
+	for len(ob.segments) > 1 && ob.segments[1].firstSeq-1 <= ob.acked {
+		if err := os.Remove(ob.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove outbox segment: %w", err)
+		}
+		ob.segments = ob.segments[1:]
+	}
+	return nil
+}
+
+// Pending returns every stored message that is not yet confirmed, in the
+// order it was appended.
+func (ob *Outbox) Pending() ([]Message, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	messages := make([]Message, 0)
+	for _, segment := range ob.segments {
+		segmentMessages, _, err := readSegment(segment.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range segmentMessages {
+			if msg.Seq > ob.acked && !ob.pending[msg.Seq] {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	return messages, nil
+}
+
+func (ob *Outbox) Close() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.active == nil {
+		return nil
+	}
+	err := ob.active.Close()
+	ob.active = nil
+	return err
+}
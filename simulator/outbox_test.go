@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestOutbox(t *testing.T, dir string) *Outbox {
+	t.Helper()
+	ob, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	return ob
+}
+
+func appendMeasurements(t *testing.T, ob *Outbox, count int) []Message {
+	t.Helper()
+	var stored []Message
+	for i := 0; i < count; i++ {
+		msg, err := ob.Append(Message{
+			Type:      "measurement",
+			Payload:   []byte(fmt.Sprintf(`{"Value":%d}`, i)),
+			Queue:     "measurement.Novi Sad",
+			Timestamp: time.Date(2024, 3, 4, i, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		stored = append(stored, msg)
+	}
+	return stored
+}
+
+func pendingSeqs(t *testing.T, ob *Outbox) []uint64 {
+	t.Helper()
+	pending, err := ob.Pending()
+	if err != nil {
+		t.Fatalf("failed to read pending messages: %v", err)
+	}
+	var seqs []uint64
+	for _, msg := range pending {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+outboxSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestOutboxRecoversPendingAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ob := openTestOutbox(t, dir)
+	stored := appendMeasurements(t, ob, 5)
+	for _, seq := range []uint64{1, 2} {
+		if err := ob.Ack(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ob.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ob = openTestOutbox(t, dir)
+	defer ob.Close()
+	pending, err := ob.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pendingSeqs(t, ob)) != "[3 4 5]" {
+		t.Fatalf("pending after restart = %v, want [3 4 5]", pendingSeqs(t, ob))
+	}
+	if string(pending[0].Payload) != string(stored[2].Payload) || !pending[0].Timestamp.Equal(stored[2].Timestamp) {
+		t.Fatalf("recovered %+v, want %+v", pending[0], stored[2])
+	}
+
+	next := appendMeasurements(t, ob, 1)
+	if next[0].Seq != 6 {
+		t.Fatalf("first sequence after restart = %d, want 6", next[0].Seq)
+	}
+}
+
+func TestOutboxDropsTornTailRecord(t *testing.T) {
+	tests := []struct {
+		name  string
+		tail  string
+		fresh bool
+	}{
+		{"partial record", `{"Seq":4,"Type":"measu`, false},
+		{"corrupt terminated record", "{\"Seq\":4,\"Ty\x00\n", false},
+		// The first write to a new segment tore, the segment is reused
+		{"partial first record of a segment", `{"Seq":4,"Type":"measu`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ob := openTestOutbox(t, dir)
+			appendMeasurements(t, ob, 3)
+			ob.Close()
+
+			segments := segmentFiles(t, dir)
+			torn := segments[len(segments)-1]
+			if test.fresh {
+				torn = filepath.Join(dir, fmt.Sprintf("%020d%s", 4, outboxSegmentExt))
+			}
+			file, err := os.OpenFile(torn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(test.tail)
+			file.Close()
+
+			ob = openTestOutbox(t, dir)
+			if fmt.Sprint(pendingSeqs(t, ob)) != "[1 2 3]" {
+				t.Fatalf("pending with a torn tail = %v, want [1 2 3]", pendingSeqs(t, ob))
+			}
+			// A record appended after the torn one has to survive the next restart
+			next := appendMeasurements(t, ob, 1)
+			if next[0].Seq != 4 {
+				t.Fatalf("sequence after the torn record = %d, want 4", next[0].Seq)
+			}
+			ob.Close()
+
+			ob = openTestOutbox(t, dir)
+			defer ob.Close()
+			if fmt.Sprint(pendingSeqs(t, ob)) != "[1 2 3 4]" {
+				t.Fatalf("pending after the next restart = %v, want [1 2 3 4]", pendingSeqs(t, ob))
+			}
+		})
+	}
+}
+
+func TestOutboxTrimsAckedSegments(t *testing.T) {
+	defer func(size int64) { outboxMaxSegmentLen = size }(outboxMaxSegmentLen)
+	// Every record starts a segment of its own
+	outboxMaxSegmentLen = 1
+
+	dir := t.TempDir()
+	ob := openTestOutbox(t, dir)
+	defer ob.Close()
+	appendMeasurements(t, ob, 5)
+	if segments := segmentFiles(t, dir); len(segments) != 5 {
+		t.Fatalf("%d segments for 5 records, want 5", len(segments))
+	}
+
+	steps := []struct {
+		ack      uint64
+		segments int
+		pending  string
+	}{
+		{1, 4, "[2 3 4 5]"},
+		// Out of order, the checkpoint waits for 2 and 3
+		{4, 4, "[2 3 5]"},
+		{2, 3, "[3 5]"},
+		{3, 1, "[5]"},
+		// The segment written to is kept even once it is acked
+		{5, 1, "[]"},
+	}
+	for _, step := range steps {
+		if err := ob.Ack(step.ack); err != nil {
+			t.Fatal(err)
+		}
+		if segments := segmentFiles(t, dir); len(segments) != step.segments {
+			t.Errorf("after ack %d: %d segments, want %d", step.ack, len(segments), step.segments)
+		}
+		if pending := fmt.Sprint(pendingSeqs(t, ob)); pending != step.pending {
+			t.Errorf("after ack %d: pending %s, want %s", step.ack, pending, step.pending)
+		}
+	}
+}
+
+func TestOutboxRewritesCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	ob := openTestOutbox(t, dir)
+	appendMeasurements(t, ob, 3)
+
+	readCheckpoint := func() uint64 {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, outboxCheckpoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry outboxCheckpointEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry.Acked
+	}
+	for _, seq := range []uint64{1, 2} {
+		if err := ob.Ack(seq); err != nil {
+			t.Fatal(err)
+		}
+		if acked := readCheckpoint(); acked != seq {
+			t.Fatalf("checkpoint after ack %d = %d", seq, acked)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, outboxCheckpoint+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary checkpoint left behind: %v", err)
+	}
+	ob.Close()
+
+	// A rewrite that crashed before its rename leaves the old checkpoint
+	if err := os.WriteFile(filepath.Join(dir, outboxCheckpoint+".tmp"), []byte(`{"Acked":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ob = openTestOutbox(t, dir)
+	defer ob.Close()
+	if fmt.Sprint(pendingSeqs(t, ob)) != "[3]" {
+		t.Fatalf("pending after restart = %v, want [3]", pendingSeqs(t, ob))
+	}
+	if err := ob.Ack(3); err != nil {
+		t.Fatal(err)
+	}
+	if acked := readCheckpoint(); acked != 3 {
+		t.Fatalf("checkpoint after rewrite = %d, want 3", acked)
+	}
+}
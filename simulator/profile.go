@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultProfile = "residential"
+
+// ConsumptionProfile shapes the hourly net consumption of a household.
+// Negative values mean the household exported energy during that hour.
+type ConsumptionProfile interface {
+	Name() string
+	Consumption(timestamp time.Time, rng *rand.Rand) float64
+}
+
+// Range is an interval a device draws its own parameter value from.
+type Range struct {
+	Min float64
+	Max float64
+}
+
+func (r Range) draw(rng *rand.Rand) float64 {
+	return r.Min + rng.Float64()*(r.Max-r.Min)
+}
+
+// EVSpec adds a nightly charging session of an electric vehicle.
+type EVSpec struct {
+	ChargeKW    Range
+	StartHour   int
+	Hours       int
+	Probability float64 // chance that the car is charged on a given night
+}
+
+// SolarSpec subtracts rooftop solar production from the consumption.
+type SolarSpec struct {
+	PeakKW Range
+}
+
+// ProfileSpec describes a consumption profile in a data file.
+type ProfileSpec struct {
+	Name         string
+	BaseLoad     Range
+	Weekday      []float64 // 24 hourly multipliers of the base load
+	Weekend      []float64 // optional, Weekday is used when empty
+	SeasonImpact Range
+	PeakMonth    time.Month // month with the highest seasonal factor
+	Noise        float64    // relative random variation, 0.15 is ±15%
+	EV           *EVSpec
+	Solar        *SolarSpec
+}
+
+func (spec ProfileSpec) validate() error {
+	if spec.Name == "" {
+		return fmt.Errorf("profile has no name")
+	}
+	if len(spec.Weekday) != 24 {
+		return fmt.Errorf("profile %s: Weekday needs 24 hourly values, got %d", spec.Name, len(spec.Weekday))
+	}
+	if len(spec.Weekend) != 0 && len(spec.Weekend) != 24 {
+		return fmt.Errorf("profile %s: Weekend needs 24 hourly values, got %d", spec.Name, len(spec.Weekend))
+	}
+	if spec.PeakMonth < time.January || spec.PeakMonth > time.December {
+		return fmt.Errorf("profile %s: invalid PeakMonth %d", spec.Name, spec.PeakMonth)
+	}
+	if spec.EV != nil && (spec.EV.Hours < 1 || spec.EV.StartHour < 0 || spec.EV.StartHour > 23) {
+		return fmt.Errorf("profile %s: invalid EV charging window", spec.Name)
+	}
+	return nil
+}
+
+type profileFactory func(rng *rand.Rand) ConsumptionProfile
+
+var (
+	profileRegistry = map[string]profileFactory{
+		defaultProfile: newResidentialProfile,
+	}
+	profileMu sync.RWMutex
+)
+
+func init() {
+	for _, spec := range builtinProfileSpecs {
+		if err := RegisterProfileSpec(spec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterProfileSpec makes a profile described by spec available by name,
+// replacing a profile of the same name.
+func RegisterProfileSpec(spec ProfileSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profileRegistry[spec.Name] = func(rng *rand.Rand) ConsumptionProfile {
+		return newSpecProfile(spec, rng)
+	}
+	return nil
+}
+
+// LoadProfileSpecs registers every profile of a file holding an array of
+// profile specs. Files ending in .yaml or .yml are YAML, anything else JSON.
+func LoadProfileSpecs(filename string) error {
+	fileData, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read profiles file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		// Convert to JSON so both formats share the same keys, which
+		// match the field names regardless of case
+		var document interface{}
+		if err := yaml.Unmarshal(fileData, &document); err != nil {
+			return fmt.Errorf("could not parse YAML profiles: %w", err)
+		}
+		if fileData, err = json.Marshal(document); err != nil {
+			return fmt.Errorf("could not convert YAML profiles: %w", err)
+		}
+	}
+	var specs []ProfileSpec
+	if err := json.Unmarshal(fileData, &specs); err != nil {
+		return fmt.Errorf("could not unmarshal profiles: %w", err)
+	}
+	for _, spec := range specs {
+		if err := RegisterProfileSpec(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewProfile creates the named profile, drawing its parameters from rng.
+func NewProfile(name string, rng *rand.Rand) (ConsumptionProfile, error) {
+	if name == "" {
+		name = defaultProfile
+	}
+	profileMu.RLock()
+	factory, ok := profileRegistry[name]
+	profileMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown consumption profile %q, available: %v", name, ProfileNames())
+	}
+	return factory(rng), nil
+}
+
+func ProfileNames() []string {
+	profileMu.RLock()
+	defer profileMu.RUnlock()
+	names := make([]string, 0, len(profileRegistry))
+	for name := range profileRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// residentialProfile is the original household curve: fixed morning and
+// evening peaks, a cosine season peaking in winter and ±15% noise.
+type residentialProfile struct {
+	baseLoad       float64
+	peakMultiplier float64
+	seasonImpact   float64
+}
+
+func newResidentialProfile(rng *rand.Rand) ConsumptionProfile {
+	return &residentialProfile{
+		baseLoad:       0.7 + (rng.Float64() * 0.6),
+		peakMultiplier: 2.5 + rng.Float64(),
+		seasonImpact:   0.3 + (rng.Float64() * 0.6),
+	}
+}
+
+func (p *residentialProfile) Name() string {
+	return defaultProfile
+}
+
+func (p *residentialProfile) calculateDailyPattern(hour float64) float64 {
+	// Morning peak (7-9 AM)
+	if hour >= 7 && hour <= 9 {
+		return p.peakMultiplier * 0.8
+	}
+	// Evening peak (18-22)
+	if hour >= 18 && hour <= 22 {
+		return p.peakMultiplier
+	}
+	// Nighttime (23-5)
+	if hour >= 23 || hour <= 5 {
+		return 0.8
+	}
+	// Mid-day (9-18)
+	if hour > 9 && hour < 18 {
+		return 1.5
+	}
+	// Early morning (5-7)
+	return 1.2
+}
+
+func (p *residentialProfile) calculateSeasonalFactor(month time.Month) float64 {
+	monthAngle := float64(month-1) * (2 * math.Pi / 12)
+	// Create a sinusoidal pattern with peak in winter (December/January)
+	// and trough in summer (June/July)
+	seasonalVariation := math.Cos(monthAngle)*p.seasonImpact + 1.0
+	return seasonalVariation
+}
+
+func (p *residentialProfile) Consumption(timestamp time.Time, rng *rand.Rand) float64 {
+	// Time-of-day factor
+	hour := float64(timestamp.Hour())
+	dailyPattern := p.calculateDailyPattern(hour)
+
+	// Seasonal factor
+	month := timestamp.Month()
+	seasonalFactor := p.calculateSeasonalFactor(month)
+
+	// Random variation (±15% to simulate appliance usage)
+	randomFactor := 0.85 + (rng.Float64() * 0.3)
+
+	// Calculate total consumption
+	consumption := p.baseLoad * dailyPattern * seasonalFactor * randomFactor
+
+	return consumption
+}
+
+// specProfile is a profile built from a ProfileSpec.
+type specProfile struct {
+	spec         ProfileSpec
+	baseLoad     float64
+	seasonImpact float64
+	evChargeKW   float64
+	solarPeakKW  float64
+}
+
+func newSpecProfile(spec ProfileSpec, rng *rand.Rand) ConsumptionProfile {
+	p := &specProfile{
+		spec:         spec,
+		baseLoad:     spec.BaseLoad.draw(rng),
+		seasonImpact: spec.SeasonImpact.draw(rng),
+	}
+	if spec.EV != nil {
+		p.evChargeKW = spec.EV.ChargeKW.draw(rng)
+	}
+	if spec.Solar != nil {
+		p.solarPeakKW = spec.Solar.PeakKW.draw(rng)
+	}
+	return p
+}
+
+func (p *specProfile) Name() string {
+	return p.spec.Name
+}
+
+func (p *specProfile) seasonalFactor(month time.Month) float64 {
+	monthAngle := float64(month-p.spec.PeakMonth) * (2 * math.Pi / 12)
+	return math.Max(0.05, math.Cos(monthAngle)*p.seasonImpact+1.0)
+}
+
+func (p *specProfile) hourlyPattern(timestamp time.Time) float64 {
+	pattern := p.spec.Weekday
+	weekday := timestamp.Weekday()
+	if len(p.spec.Weekend) == 24 && (weekday == time.Saturday || weekday == time.Sunday) {
+		pattern = p.spec.Weekend
+	}
+	return pattern[timestamp.Hour()]
+}
+
+func (p *specProfile) evCharging(timestamp time.Time, rng *rand.Rand) float64 {
+	ev := p.spec.EV
+	// Hours since the charging window opened, the window may cross midnight
+	elapsed := (timestamp.Hour() - ev.StartHour + 24) % 24
+	if elapsed >= ev.Hours {
+		return 0
+	}
+	// Decide once per session whether the car is plugged in, so a session
+	// is never charged only partially
+	sessionStart := timestamp.Add(-time.Duration(elapsed) * time.Hour)
+	sessionRng := rand.New(rand.NewSource(int64(p.evChargeKW*1e6) ^ sessionStart.Unix()/3600))
+	if sessionRng.Float64() >= ev.Probability {
+		return 0
+	}
+	return p.evChargeKW * (0.9 + rng.Float64()*0.1)
+}
+
+func (p *specProfile) solarProduction(timestamp time.Time, rng *rand.Rand) float64 {
+	// Days are longer and the sun higher around the June solstice
+	summer := (1 - math.Cos(float64(timestamp.YearDay())*2*math.Pi/365.25)) / 2
+	sunrise := 7.5 - 2.5*summer
+	sunset := 16.5 + 4*summer
+	hour := float64(timestamp.Hour()) + 0.5
+	if hour <= sunrise || hour >= sunset {
+		return 0
+	}
+	elevation := math.Sin(math.Pi * (hour - sunrise) / (sunset - sunrise))
+	clouds := 0.4 + rng.Float64()*0.6
+	return p.solarPeakKW * elevation * (0.35 + 0.65*summer) * clouds
+}
+
+func (p *specProfile) Consumption(timestamp time.Time, rng *rand.Rand) float64 {
+	randomFactor := 1 - p.spec.Noise + rng.Float64()*2*p.spec.Noise
+	consumption := p.baseLoad * p.hourlyPattern(timestamp) * p.seasonalFactor(timestamp.Month()) * randomFactor
+
+	if p.spec.EV != nil {
+		consumption += p.evCharging(timestamp, rng)
+	}
+	if p.spec.Solar != nil {
+		consumption -= p.solarProduction(timestamp, rng)
+	}
+	return consumption
+}
+
+var builtinProfileSpecs = []ProfileSpec{
+	{
+		Name:     "office",
+		BaseLoad: Range{Min: 1.5, Max: 4},
+		Weekday: []float64{
+			0.3, 0.3, 0.3, 0.3, 0.3, 0.3, 0.4, 0.8, 1.8, 2.2, 2.3, 2.3,
+			2.0, 2.2, 2.3, 2.2, 2.0, 1.5, 0.8, 0.5, 0.4, 0.3, 0.3, 0.3,
+		},
+		Weekend: []float64{
+			0.3, 0.3, 0.3, 0.3, 0.3, 0.3, 0.3, 0.3, 0.35, 0.4, 0.4, 0.4,
+			0.4, 0.4, 0.4, 0.4, 0.35, 0.3, 0.3, 0.3, 0.3, 0.3, 0.3, 0.3,
+		},
+		SeasonImpact: Range{Min: 0.1, Max: 0.3},
+		PeakMonth:    time.July, // air conditioning
+		Noise:        0.1,
+	},
+	{
+		Name:     "electric-heating",
+		BaseLoad: Range{Min: 1.2, Max: 2},
+		Weekday: []float64{
+			1.6, 1.6, 1.6, 1.6, 1.5, 1.4, 1.6, 1.8, 1.6, 1.2, 1.1, 1.1,
+			1.1, 1.1, 1.1, 1.2, 1.4, 1.7, 2.0, 2.1, 2.0, 1.8, 1.7, 1.6,
+		},
+		SeasonImpact: Range{Min: 0.75, Max: 0.9},
+		PeakMonth:    time.January,
+		Noise:        0.15,
+	},
+	{
+		Name:     "ev-charging",
+		BaseLoad: Range{Min: 0.7, Max: 1.3},
+		Weekday: []float64{
+			0.8, 0.8, 0.8, 0.8, 0.8, 0.8, 1.2, 2.4, 2.4, 1.5, 1.5, 1.5,
+			1.5, 1.5, 1.5, 1.5, 1.5, 1.5, 3.0, 3.0, 3.0, 3.0, 3.0, 0.8,
+		},
+		SeasonImpact: Range{Min: 0.3, Max: 0.9},
+		PeakMonth:    time.January,
+		Noise:        0.15,
+		EV: &EVSpec{
+			ChargeKW:    Range{Min: 3.7, Max: 11},
+			StartHour:   22,
+			Hours:       5,
+			Probability: 0.6,
+		},
+	},
+	{
+		Name:     "solar-prosumer",
+		BaseLoad: Range{Min: 0.7, Max: 1.3},
+		Weekday: []float64{
+			0.8, 0.8, 0.8, 0.8, 0.8, 0.8, 1.2, 2.4, 2.4, 1.5, 1.5, 1.5,
+			1.5, 1.5, 1.5, 1.5, 1.5, 1.5, 3.0, 3.0, 3.0, 3.0, 3.0, 0.8,
+		},
+		SeasonImpact: Range{Min: 0.3, Max: 0.9},
+		PeakMonth:    time.January,
+		Noise:        0.15,
+		Solar: &SolarSpec{
+			PeakKW: Range{Min: 3, Max: 8},
+		},
+	},
+}
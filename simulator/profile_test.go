@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuiltinProfiles(t *testing.T) {
+	for _, spec := range builtinProfileSpecs {
+		if err := spec.validate(); err != nil {
+			t.Errorf("built-in profile %s: %v", spec.Name, err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	consumption := func(name string, timestamp time.Time) float64 {
+		profile, err := NewProfile(name, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return profile.Consumption(timestamp, rng)
+	}
+	// A Wednesday and a Saturday
+	summerNoon := time.Date(2024, 6, 19, 12, 0, 0, 0, time.UTC)
+	saturdayNoon := time.Date(2024, 6, 22, 12, 0, 0, 0, time.UTC)
+	winterNight := time.Date(2024, 1, 17, 3, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 50; i++ {
+		// The base load is at most 1.3 * 1.5 * 1.15 kW midday in summer,
+		// solar produces at least 3 * 0.4 kW then
+		if net := consumption("solar-prosumer", summerNoon); net >= 0 {
+			t.Fatalf("solar-prosumer consumed %v at noon in June, want a net export", net)
+		}
+		if net := consumption("solar-prosumer", winterNight); net <= 0 {
+			t.Fatalf("solar-prosumer consumed %v at night, want a net import", net)
+		}
+		if load := consumption("ev-charging", winterNight); load <= 0 {
+			t.Fatalf("ev-charging consumed %v, want a positive load", load)
+		}
+		if weekday, weekend := consumption("office", summerNoon), consumption("office", saturdayNoon); weekday <= weekend {
+			t.Fatalf("office consumed %v on a weekday and %v on a weekend, want less on the weekend", weekday, weekend)
+		}
+		if winter, summer := consumption("electric-heating", winterNight), consumption("electric-heating", summerNoon); winter <= summer {
+			t.Fatalf("electric-heating consumed %v in winter and %v in summer, want more in winter", winter, summer)
+		}
+		if load := consumption("", winterNight); load <= 0 {
+			t.Fatalf("the default profile consumed %v, want a positive load", load)
+		}
+	}
+}
+
+func TestLoadProfileSpecs(t *testing.T) {
+	hours := "[1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2]"
+	files := map[string]string{
+		"profiles.json": `[{"Name": "test-json", "BaseLoad": {"Min": 1, "Max": 1}, "Weekday": ` + hours + `, "PeakMonth": 7}]`,
+		"profiles.yaml": "- Name: test-yaml\n  BaseLoad: {Min: 1, Max: 1}\n  Weekday: " + hours + "\n  PeakMonth: 7\n",
+		"profiles.yml": "- name: test-yml\n  baseLoad:\n    min: 1\n    max: 1\n  weekday: " + hours + "\n  peakMonth: 7\n" +
+			"  solar:\n    peakKW: {min: 2, max: 2}\n",
+	}
+	dir := t.TempDir()
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadProfileSpecs(filename); err != nil {
+			t.Fatalf("loading %s: %v", name, err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, name := range []string{"test-json", "test-yaml", "test-yml"} {
+		profile, err := NewProfile(name, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without noise and season impact the last hour doubles the base load
+		if got := profile.Consumption(time.Date(2024, 7, 1, 23, 0, 0, 0, time.UTC), rng); got != 2 {
+			t.Errorf("%s consumed %v at 23:00, want 2", name, got)
+		}
+	}
+	profile, _ := NewProfile("test-yml", rng)
+	if net := profile.Consumption(time.Date(2024, 7, 1, 13, 0, 0, 0, time.UTC), rng); net >= 1 {
+		t.Errorf("test-yml consumed %v at noon, want its solar production subtracted", net)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("- Name: short\n  Weekday: [1, 2]\n  PeakMonth: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadProfileSpecs(invalid); err == nil {
+		t.Error("a profile with 2 hourly values was loaded")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// measurementLogLayout is the format of time.Time.String used by logMeasurement.
+const measurementLogLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+const replayMaxAttempts = 5
+
+// loggedMeasurement is a line of measurements.log. Lines carry the whole
+// measurement as sent, with its version, serial, interval and registers.
+// Lines of older simulators only have the value, Reading is nil for them.
+type loggedMeasurement struct {
+	Timestamp time.Time
+	Value     float64
+	Reading   *Measurement
+}
+
+// parseMeasurementLine reads a "timestamp->measurement" or an older
+// "timestamp->value" line of measurements.log.
+func parseMeasurementLine(line string) (loggedMeasurement, error) {
+	timestamp, value, found := strings.Cut(strings.TrimSpace(line), "->")
+	if !found {
+		return loggedMeasurement{}, fmt.Errorf("missing separator")
+	}
+	// Drop a monotonic clock reading, it is not part of the layout
+	if i := strings.Index(timestamp, " m="); i >= 0 {
+		timestamp = timestamp[:i]
+	}
+	parsedTime, err := time.Parse(measurementLogLayout, timestamp)
+	if err != nil {
+		return loggedMeasurement{}, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if strings.HasPrefix(value, "{") {
+		var reading Measurement
+		if err := json.Unmarshal([]byte(value), &reading); err != nil {
+			return loggedMeasurement{}, fmt.Errorf("invalid measurement: %w", err)
+		}
+		return loggedMeasurement{Timestamp: parsedTime, Value: reading.Value, Reading: &reading}, nil
+	}
+	parsedValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return loggedMeasurement{}, fmt.Errorf("invalid value: %w", err)
+	}
+	return loggedMeasurement{Timestamp: parsedTime, Value: parsedValue}, nil
+}
+
+// measurementLogFiles lists measurements.log and the backups lumberjack
+// rotated out of it, compressed or not.
+func measurementLogFiles(logsDir string) ([]string, error) {
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read logs directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "measurements") {
+			continue
+		}
+		if strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz") {
+			files = append(files, filepath.Join(logsDir, name))
+		}
+	}
+	return files, nil
+}
+
+func readMeasurementLog(filename string, from time.Time, to time.Time) ([]loggedMeasurement, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %w", filename, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	var readings []loggedMeasurement
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		reading, err := parseMeasurementLine(scanner.Text())
+		if err != nil {
+			log.Printf("Skipping %s:%d: %v", filename, lineNumber, err)
+			continue
+		}
+		if reading.Timestamp.Before(from) || !reading.Timestamp.Before(to) {
+			continue
+		}
+		readings = append(readings, reading)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", filename, err)
+	}
+	return readings, nil
+}
+
+// collectMeasurements reads every logged reading in [from, to) ordered by
+// timestamp. A timestamp logged more than once, which happens when a device
+// restarts, keeps the reading from the most recently written file.
+func collectMeasurements(logsDir string, from time.Time, to time.Time) ([]loggedMeasurement, error) {
+	files, err := measurementLogFiles(logsDir)
+	if err != nil {
+		return nil, err
+	}
+	modTimes := make(map[string]time.Time)
+	for _, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat %s: %w", filename, err)
+		}
+		modTimes[filename] = info.ModTime()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return modTimes[files[i]].Before(modTimes[files[j]])
+	})
+
+	byTimestamp := make(map[int64]loggedMeasurement)
+	for _, filename := range files {
+		readings, err := readMeasurementLog(filename, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, reading := range readings {
+			byTimestamp[reading.Timestamp.UnixNano()] = reading
+		}
+	}
+
+	readings := make([]loggedMeasurement, 0, len(byTimestamp))
+	for _, reading := range byTimestamp {
+		readings = append(readings, reading)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Timestamp.Before(readings[j].Timestamp)
+	})
+	return readings, nil
+}
+
+// runReplay implements the replay subcommand, it republishes a device's
+// logged readings with their original timestamps.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	deviceID := flags.String("device", "", "id of the device to replay")
+	city := flags.String("city", "", "city of the device, for readings logged without their address")
+	street := flags.String("street", defaultFleetStreet, "street of the device")
+	number := flags.String("number", defaultFleetNumber, "street number of the device")
+	logsDir := flags.String("logs", "", "measurement logs directory (default measurements/<device>)")
+	fromFlag := flags.String("from", "", "first timestamp to replay, RFC3339")
+	toFlag := flags.String("to", "", "end of the replayed range, RFC3339 (default now)")
+	rate := flags.Float64("rate", 50, "messages per second, 0 sends as fast as the broker confirms")
+	dryRun := flags.Bool("dry-run", false, "print what would be sent without publishing")
+	flags.Parse(args)
+
+	if *deviceID == "" || *fromFlag == "" {
+		flags.Usage()
+		log.Fatal("-device and -from are required!")
+	}
+	from, err := time.Parse(time.RFC3339, *fromFlag)
+	if err != nil {
+		log.Fatalf("invalid -from: %v", err)
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		to, err = time.Parse(time.RFC3339, *toFlag)
+		if err != nil {
+			log.Fatalf("invalid -to: %v", err)
+		}
+	}
+	if *logsDir == "" {
+		*logsDir = defaultDevicePaths(*deviceID).logsDir
+	}
+
+	readings, err := collectMeasurements(*logsDir, from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Found %d readings of device %s between %s and %s", len(readings), *deviceID, from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	// Logged measurements are sent again exactly as they were, older lines
+	// only kept the value and are rebuilt from the flags
+	address := newLocation(*city, *street, *number)
+	messages := make([]Message, 0, len(readings))
+	for _, reading := range readings {
+		measurement := reading.Reading
+		if measurement == nil {
+			if *city == "" {
+				log.Fatalf("reading at %s was logged without its address, -city is required", reading.Timestamp.Format(time.RFC3339))
+			}
+			measurement = newMeasurement(*deviceID, reading.Value, reading.Timestamp, *address)
+		}
+		payload, _ := json.Marshal(measurement)
+		messages = append(messages, Message{
+			Type:      "measurement",
+			DeviceID:  measurement.DeviceID,
+			Payload:   payload,
+			Queue:     "measurement." + measurement.Address.City,
+			Timestamp: reading.Timestamp,
+		})
+	}
+
+	if *dryRun {
+		for _, msg := range messages {
+			fmt.Printf("%s %s %s\n", msg.Timestamp.Format(time.RFC3339), msg.Queue, msg.Payload)
+		}
+		return
+	}
+
+	amqpURI := os.Getenv("AMQP_URI")
+	if amqpURI == "" {
+		log.Fatal("AMQP_URI is required!")
+	}
+	broker := NewMessageBroker(exchangeName, amqpURI)
+	if err := broker.Connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer broker.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	sent, err := replayMessages(ctx, broker, messages, *rate)
+	if err != nil {
+		log.Fatalf("Replay stopped after %d of %d readings: %v", sent, len(messages), err)
+	}
+	log.Printf("Replayed %d readings of device %s", sent, *deviceID)
+}
+
+// replayMessages publishes the messages in order, at most rate per second,
+// and returns how many of them the broker confirmed.
+func replayMessages(ctx context.Context, broker *MessageBroker, messages []Message, rate float64) (int, error) {
+	var ticker *time.Ticker
+	if rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+	}
+
+	for i, msg := range messages {
+		if ticker != nil {
+			select {
+			case <-ctx.Done():
+				return i, ctx.Err()
+			case <-ticker.C:
+			}
+		}
+
+		var err error
+		for attempt := 1; attempt <= replayMaxAttempts; attempt++ {
+			if err = broker.PublishMessage(ctx, msg); err == nil {
+				break
+			}
+			log.Printf("Failed to replay reading %s (attempt %d): %v", msg.Timestamp.Format(time.RFC3339), attempt, err)
+			select {
+			case <-ctx.Done():
+				return i, ctx.Err()
+			case <-time.After(reconnectDelay):
+			}
+		}
+		if err != nil {
+			return i, err
+		}
+		if (i+1)%100 == 0 {
+			log.Printf("Replayed %d/%d readings", i+1, len(messages))
+		}
+	}
+	return len(messages), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseMeasurementLineKeepsLoggedPayload(t *testing.T) {
+	importRegister := 1234.5
+	sent := newMeasurement("device-1", 0.25, time.Date(2024, 3, 4, 12, 15, 0, 0, time.UTC), *newLocation("Novi Sad", "Main", "1"))
+	sent.MeterSerial = "SIM0000ABCD"
+	sent.ImportRegister = &importRegister
+	sent.IntervalSeconds = 900
+	payload, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := sent.Timestamp.Local().String() + "->" + string(payload)
+	reading, err := parseMeasurementLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Reading == nil {
+		t.Fatal("logged measurement was not kept")
+	}
+	if !reading.Timestamp.Equal(sent.Timestamp) || reading.Value != sent.Value {
+		t.Fatalf("got %s %f, want %s %f", reading.Timestamp, reading.Value, sent.Timestamp, sent.Value)
+	}
+	replayed, _ := json.Marshal(reading.Reading)
+	if string(replayed) != string(payload) {
+		t.Fatalf("replayed payload %s, want %s", replayed, payload)
+	}
+}
+
+func TestParseMeasurementLineReadsLegacyLines(t *testing.T) {
+	reading, err := parseMeasurementLine("2024-03-04 13:00:00 +0100 CET m=+3.000000001->1.75")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Reading != nil {
+		t.Fatal("legacy line produced a logged measurement")
+	}
+	want := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	if !reading.Timestamp.Equal(want) || reading.Value != 1.75 {
+		t.Fatalf("got %s %f, want %s 1.75", reading.Timestamp, reading.Value, want)
+	}
+
+	for _, line := range []string{"no separator", "2024-03-04->1", "2024-03-04 13:00:00 +0100 CET->{broken"} {
+		if _, err := parseMeasurementLine(line); err == nil {
+			t.Errorf("parseMeasurementLine(%q) accepted a broken line", line)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type FaultType string
+
+const (
+	FaultHeartbeatSilence   FaultType = "heartbeat-silence"
+	FaultMeasurementSilence FaultType = "measurement-silence"
+	FaultClockSkew          FaultType = "clock-skew"
+	FaultDuplicateSend      FaultType = "duplicate-send"
+	FaultOutOfOrder         FaultType = "out-of-order"
+	FaultMalformedPayload   FaultType = "malformed-payload"
+	FaultSpike              FaultType = "spike"
+	FaultRegisterReset      FaultType = "register-reset"
+	FaultMeterReplacement   FaultType = "meter-replacement"
+)
+
+// Duration reads durations like "90s" or "2h" from scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Fault is one scripted misbehaviour of a device. It is scheduled either by
+// wall time since the device started (After/For) or by a window of simulated
+// time (From/To), the latter stays reproducible in backfill mode.
+type Fault struct {
+	Type      FaultType
+	After     Duration
+	For       Duration
+	From      time.Time
+	To        time.Time
+	DeviceIDs []string // empty applies the fault to every device
+
+	Skew   Duration // clock-skew: offset added to sent timestamps
+	Copies int      // duplicate-send: extra copies of every measurement
+	Window int      // out-of-order: readings held back and sent reversed
+	Factor float64  // spike: multiplier of the simulated consumption
+}
+
+func (f Fault) validate() error {
+	switch f.Type {
+	case FaultHeartbeatSilence, FaultMeasurementSilence, FaultMalformedPayload, FaultRegisterReset, FaultMeterReplacement:
+	case FaultClockSkew:
+		if f.Skew == 0 {
+			return fmt.Errorf("%s fault needs a Skew", f.Type)
+		}
+	case FaultDuplicateSend:
+		if f.Copies < 1 {
+			return fmt.Errorf("%s fault needs Copies of at least 1", f.Type)
+		}
+	case FaultOutOfOrder:
+		if f.Window < 2 {
+			return fmt.Errorf("%s fault needs a Window of at least 2", f.Type)
+		}
+	case FaultSpike:
+		if f.Factor == 0 {
+			return fmt.Errorf("%s fault needs a Factor", f.Type)
+		}
+	default:
+		return fmt.Errorf("unknown fault type %q", f.Type)
+	}
+	if f.From.IsZero() != f.To.IsZero() {
+		return fmt.Errorf("%s fault needs both From and To", f.Type)
+	}
+	if f.From.IsZero() && f.For <= 0 {
+		return fmt.Errorf("%s fault needs a positive For or a From/To window", f.Type)
+	}
+	return nil
+}
+
+func (f Fault) appliesTo(deviceID string) bool {
+	return len(f.DeviceIDs) == 0 || slices.Contains(f.DeviceIDs, deviceID)
+}
+
+// activeAt reports whether the fault applies at the given wall time offset,
+// or at the simulated time when the fault has a From/To window.
+func (f Fault) activeAt(elapsed time.Duration, simulated time.Time) bool {
+	if !f.From.IsZero() {
+		return !simulated.IsZero() && !simulated.Before(f.From) && simulated.Before(f.To)
+	}
+	return elapsed >= time.Duration(f.After) && elapsed < time.Duration(f.After+f.For)
+}
+
+type ScenarioSpec struct {
+	Name   string
+	Faults []Fault
+}
+
+func LoadScenario(filename string) (*ScenarioSpec, error) {
+	fileData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read scenario file: %w", err)
+	}
+	var spec ScenarioSpec
+	if err := json.Unmarshal(fileData, &spec); err != nil {
+		return nil, fmt.Errorf("could not unmarshal scenario: %w", err)
+	}
+	for i, fault := range spec.Faults {
+		if err := fault.validate(); err != nil {
+			return nil, fmt.Errorf("scenario %s, fault %d: %w", spec.Name, i, err)
+		}
+	}
+	return &spec, nil
+}
+
+// activeKey tracks the state of a fault separately for heartbeats and
+// measurements, only measurements carry a simulated time.
+type activeKey struct {
+	fault     int
+	heartbeat bool
+}
+
+// Scenario applies the faults of a spec to a single device and logs every
+// injected fault next to the device's measurements.log.
+type Scenario struct {
+	name    string
+	faults  []Fault
+	started time.Time
+	rng     *rand.Rand
+	logger  *log.Logger
+	file    *os.File
+	active  map[activeKey]bool
+	held    []Message
+	mu      sync.Mutex
+}
+
+func NewScenario(spec *ScenarioSpec, deviceID string, logsDir string) (*Scenario, error) {
+	file, err := os.OpenFile(filepath.Join(logsDir, "scenario.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario log: %v", err)
+	}
+
+	faults := make([]Fault, 0, len(spec.Faults))
+	for _, fault := range spec.Faults {
+		if fault.appliesTo(deviceID) {
+			faults = append(faults, fault)
+		}
+	}
+
+	hasher := fnv.New64a()
+	hasher.Write([]byte(spec.Name + deviceID))
+	scenario := &Scenario{
+		name:    spec.Name,
+		faults:  faults,
+		started: time.Now(),
+		rng:     rand.New(rand.NewSource(int64(hasher.Sum64()))),
+		logger:  log.New(file, "", log.LstdFlags|log.LUTC),
+		file:    file,
+		active:  make(map[activeKey]bool),
+	}
+	scenario.logger.Printf("scenario %s loaded with %d faults for device %s", spec.Name, len(faults), deviceID)
+	return scenario, nil
+}
+
+// Restart moves the wall time schedule to begin now.
+func (s *Scenario) Restart() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = time.Now()
+}
+
+// fault returns the first fault of the type that is active right now and
+// logs faults being switched on and off. Heartbeats pass a zero simulated time.
+func (s *Scenario) fault(faultType FaultType, simulated time.Time) *Fault {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.started)
+	var found *Fault
+	for i := range s.faults {
+		fault := &s.faults[i]
+		if fault.Type != faultType {
+			continue
+		}
+		active := fault.activeAt(elapsed, simulated)
+		key := activeKey{fault: i, heartbeat: simulated.IsZero()}
+		if active != s.active[key] {
+			s.active[key] = active
+			state := "ended"
+			if active {
+				state = "started"
+			}
+			target := "measurements"
+			if key.heartbeat {
+				target = "heartbeats"
+			}
+			s.logger.Printf("fault %s %s for %s (simulated time %s)", fault.Type, state, target, formatSimulated(simulated))
+		}
+		if active && found == nil {
+			found = fault
+		}
+	}
+	return found
+}
+
+func (s *Scenario) logf(format string, args ...interface{}) {
+	if s != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+// hold keeps back a measurement while an out-of-order fault is active and
+// returns the held batch in reversed order once the window is full.
+func (s *Scenario) hold(msg Message, window int) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.held = append(s.held, msg)
+	if len(s.held) < window {
+		return nil
+	}
+	batch := s.held
+	s.held = nil
+	slices.Reverse(batch)
+	return batch
+}
+
+// release hands back measurements still held after an out-of-order fault ended.
+func (s *Scenario) release() []Message {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := s.held
+	s.held = nil
+	slices.Reverse(batch)
+	return batch
+}
+
+// corrupt turns a payload into invalid JSON in one of a few realistic ways.
+func (s *Scenario) corrupt(payload []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.rng.Intn(3) {
+	case 0:
+		// Truncated frame
+		return payload[:len(payload)/2]
+	case 1:
+		// Garbage in the middle of the document
+		corrupted := append([]byte{}, payload...)
+		corrupted[len(corrupted)/2] = 0xff
+		return corrupted
+	default:
+		// Unbalanced document
+		return []byte(`{"DeviceID":` + string(payload))
+	}
+}
+
+func (s *Scenario) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func formatSimulated(simulated time.Time) string {
+	if simulated.IsZero() {
+		return "-"
+	}
+	return simulated.Format(time.RFC3339)
+}